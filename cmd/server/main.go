@@ -5,6 +5,7 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -12,22 +13,48 @@ import (
 
 	"github.com/reMarkable/orbit/pkg/auth"
 	"github.com/reMarkable/orbit/pkg/envconfig"
+	"github.com/reMarkable/orbit/pkg/filesystem"
+	"github.com/reMarkable/orbit/pkg/git"
 	"github.com/reMarkable/orbit/pkg/github"
+	"github.com/reMarkable/orbit/pkg/gitlab"
 	"github.com/reMarkable/orbit/pkg/mcache"
+	"github.com/reMarkable/orbit/pkg/oci"
+	"github.com/reMarkable/orbit/pkg/registry"
+	"github.com/reMarkable/orbit/pkg/resilient"
 	"github.com/reMarkable/orbit/pkg/router"
+	"github.com/reMarkable/orbit/pkg/s3"
 	"github.com/reMarkable/orbit/pkg/server"
 	"github.com/reMarkable/orbit/services/modules"
 )
 
 type config struct {
-	Cache struct {
+	Backend string `envconfig:"BACKEND" default:"github"`
+	Cache   struct {
 		Enabled    bool          `envconfig:"ENABLED"`
 		Path       string        `envconfig:"PATH" default:"/tmp"`
 		Expiration time.Duration `envconfig:"EXPIRATION" default:"10s"`
 	} `envconfig:"CACHE_"`
-	Github  github.Config  `envconfig:"GITHUB_"`
+	Filesystem filesystem.Config `envconfig:"FILESYSTEM_"`
+	Git        git.Config        `envconfig:"GIT_"`
+	Github     github.Config     `envconfig:"GITHUB_"`
+	Gitlab     gitlab.Config     `envconfig:"GITLAB_"`
+	Mirror     struct {
+		Enabled    bool          `envconfig:"ENABLED"`
+		Path       string        `envconfig:"PATH" default:"/tmp"`
+		Expiration time.Duration `envconfig:"EXPIRATION" default:"10m"`
+		Timeout    time.Duration `envconfig:"TIMEOUT" default:"5m"`
+		Registry   registry.Config
+	} `envconfig:"MIRROR_"`
 	Modules modules.Config `envconfig:"MODULES_"`
-	Server  server.Config
+	OCI     oci.Config     `envconfig:"OCI_"`
+	Pins    struct {
+		Path    string        `envconfig:"PATH"`
+		Mode    string        `envconfig:"MODE" default:"keep"`
+		Recheck time.Duration `envconfig:"RECHECK" default:"10m"`
+	} `envconfig:"PINS_"`
+	S3       s3.Config `envconfig:"S3_"`
+	Server   server.Config
+	Upstream resilient.Config `envconfig:"UPSTREAM_"`
 }
 
 func main() {
@@ -36,10 +63,50 @@ func main() {
 
 	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	var repo modules.Repository
-	repo = github.New(cfg.Github, &http.Client{
+	httpClient := &http.Client{
 		Timeout: 5 * time.Second,
-	})
+	}
+	client := resilient.New(cfg.Upstream, httpClient)
+
+	var (
+		repo modules.Repository
+		gh   *github.Service
+	)
+	switch cfg.Backend {
+	case "filesystem":
+		repo = filesystem.New(cfg.Filesystem, os.DirFS(cfg.Filesystem.Path))
+	case "git":
+		repo = git.New(cfg.Git, client)
+	case "github":
+		transport, err := github.NewTransport(cfg.Github)
+		if err != nil {
+			panic(err)
+		}
+		httpClient.Transport = transport
+		// The provider packages are much larger than the modules, so they get
+		// a client of their own, with a timeout to match.
+		assetClient := resilient.New(cfg.Upstream, &http.Client{
+			Timeout:   cfg.Github.AssetTimeout,
+			Transport: transport,
+		})
+		gh = github.New(cfg.Github, client).
+			WithETagStore(mcache.New[string, []string](cfg.Github.ETagExpiration)).
+			WithAssetClient(assetClient)
+		repo = gh
+	case "gitlab":
+		repo = gitlab.New(cfg.Gitlab, client)
+	case "oci":
+		repo = oci.New(cfg.OCI, client)
+	case "s3":
+		repo = s3.New(cfg.S3, client)
+	default:
+		panic(fmt.Sprintf("unknown backend: %s", cfg.Backend))
+	}
+	log.Info("using backend", "backend", cfg.Backend)
+
+	if _, ok := repo.(modules.CommitRepository); cfg.Pins.Path != "" && !ok {
+		panic(fmt.Sprintf("the %s backend does not support pinning versions", cfg.Backend))
+	}
 
 	if cfg.Cache.Enabled {
 		log.Info("enabling cache", "path", cfg.Cache.Path, "expiration", cfg.Cache.Expiration)
@@ -51,10 +118,49 @@ func main() {
 		)
 	}
 
+	var pinner *modules.Pinner
+	if cfg.Pins.Path != "" {
+		mode, err := modules.ParsePinMode(cfg.Pins.Mode)
+		if err != nil {
+			panic(err)
+		}
+		pins, err := modules.NewFilePins(cfg.Pins.Path)
+		if err != nil {
+			panic(err)
+		}
+		log.Info("pinning versions", "path", cfg.Pins.Path, "mode", mode, "recheck", cfg.Pins.Recheck)
+		pinner = modules.NewPinner(
+			repo.(modules.CommitRepository),
+			pins,
+			mcache.New[string, []string](cfg.Pins.Recheck),
+			mode,
+			log,
+		)
+		repo = pinner
+	}
+
 	mh, err := modules.NewMetricsHandler(log)
 	if err != nil {
 		panic(err)
 	}
+	registerUpstreamMetrics(mh, client)
+	if gh != nil {
+		mh.Register(modules.MetricTypeGauge, "github_rate_limit_remaining", "Remaining GitHub API requests", func() []modules.Sample {
+			var samples []modules.Sample
+			for _, l := range gh.RateLimits() {
+				samples = append(samples, modules.Sample{
+					Labels: map[string]string{"host": l.Host, "token": l.Token},
+					Value:  l.Remaining,
+				})
+			}
+			return samples
+		})
+	}
+	if pinner != nil {
+		mh.Register(modules.MetricTypeCounter, "module_version_moved_count", "Total number of downloads of versions whose tag moved since pinned", func() []modules.Sample {
+			return []modules.Sample{{Value: pinner.Moved()}}
+		})
+	}
 	h, err := modules.NewHTTP(cfg.Modules, log, repo, mh)
 	if err != nil {
 		panic(err)
@@ -63,10 +169,45 @@ func main() {
 	r := router.New()
 	r.Use(auth.TokenMiddleware)
 
+	r.Get("/v1/modules", h.ListModules)
+	r.Get("/v1/modules/search", h.SearchModules)
+	r.Get("/v1/modules/:namespace", h.ListModules)
+	r.Get("/v1/modules/:namespace/:name/:system", h.ModuleDetail)
+	r.Get("/v1/modules/:namespace/:name/:system/:version", h.ModuleDetail)
 	r.Get("/v1/modules/:namespace/:name/:system/versions", h.ListVersions)
 	r.Get("/v1/modules/:namespace/:name/:system/:version/download", h.DownloadURL)
 	r.Get("/v1/modules/:namespace/:name/:system/:version/proxy", h.ProxyDownload)
+	r.Get("/v1/modules/:namespace/:name/:system/:version/proxy.sha256", h.Checksum)
+	r.Get("/v1/providers/:namespace/:type/versions", h.ListProviderVersions)
+	r.Get("/v1/providers/:namespace/:type/:version/download/:os/:arch", h.ProviderDownload)
+	r.Get("/v1/providers/:namespace/:type/:version/asset/:filename", h.ProviderAssetProxy)
+	if cfg.Mirror.Enabled {
+		log.Info("enabling provider mirror", "path", cfg.Mirror.Path, "hosts", cfg.Mirror.Registry.Hosts)
+		// The packages are much larger than the modules, so they get a client
+		// of their own, with a timeout to match.
+		mirrorClient := resilient.New(cfg.Upstream, &http.Client{Timeout: cfg.Mirror.Timeout})
+		mirror := modules.NewMirror(
+			registry.New(cfg.Mirror.Registry, mirrorClient),
+			mcache.New[string, []string](cfg.Mirror.Expiration),
+			modules.StoreInPath(cfg.Mirror.Path),
+			log,
+			mh,
+		)
+		mh.Register(modules.MetricTypeCounter, "provider_mirror_hit_count", "Total number of provider packages served from the mirror cache", func() []modules.Sample {
+			return []modules.Sample{{Value: mirror.Hits()}}
+		})
+		mh.Register(modules.MetricTypeCounter, "provider_mirror_miss_count", "Total number of provider packages downloaded from upstream registries", func() []modules.Sample {
+			return []modules.Sample{{Value: mirror.Misses()}}
+		})
+		r.Get("/v1/mirror/:hostname/:namespace/:type/index.json", mirror.Index)
+		r.Get("/v1/mirror/:hostname/:namespace/:type/:version", mirror.Version)
+		r.Get("/v1/mirror/:hostname/:namespace/:type/:version/:filename", mirror.Archive)
+	}
 	r.Get("/.well-known/terraform.json", discovery)
+	r.Get("/ui", h.UIIndex)
+	r.Get("/ui/:namespace", h.UINamespace)
+	r.Get("/ui/:namespace/:name/:system", h.UIModule)
+	r.Get("/ui/:namespace/:name/:system/:version", h.UIModule)
 
 	http.DefaultServeMux.HandleFunc("GET /metrics", mh.Metrics)
 
@@ -75,9 +216,35 @@ func main() {
 	}
 }
 
+// registerUpstreamMetrics exports the retries and circuit breaker states of
+// the requests to the upstream repositories.
+func registerUpstreamMetrics(mh *modules.MetricsHandler, client *resilient.Client) {
+	collect := func(value func(resilient.Stats) int) func() []modules.Sample {
+		return func() []modules.Sample {
+			var samples []modules.Sample
+			for _, s := range client.Stats() {
+				samples = append(samples, modules.Sample{
+					Labels: map[string]string{"host": s.Host},
+					Value:  value(s),
+				})
+			}
+			return samples
+		}
+	}
+
+	mh.Register(modules.MetricTypeCounter, "upstream_retry_count", "Total number of retried upstream requests",
+		collect(func(s resilient.Stats) int { return s.Retries }))
+	mh.Register(modules.MetricTypeCounter, "upstream_failure_count", "Total number of failed upstream requests",
+		collect(func(s resilient.Stats) int { return s.Failures }))
+	mh.Register(modules.MetricTypeCounter, "upstream_breaker_open_count", "Total number of times the circuit breaker opened",
+		collect(func(s resilient.Stats) int { return s.Opened }))
+	mh.Register(modules.MetricTypeGauge, "upstream_breaker_state", "Circuit breaker state (0 closed, 1 open, 2 half-open)",
+		collect(func(s resilient.Stats) int { return int(s.State) }))
+}
+
 func discovery(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
-	if _, err := w.Write([]byte(`{"modules.v1":"/v1/modules"}`)); err != nil {
+	if _, err := w.Write([]byte(`{"modules.v1":"/v1/modules","providers.v1":"/v1/providers"}`)); err != nil {
 		slog.Error("failed to write response", "error", err)
 	}
 }
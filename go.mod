@@ -1,3 +1,8 @@
 module github.com/reMarkable/orbit
 
 go 1.24
+
+require (
+	github.com/dsnet/compress v0.0.1
+	github.com/ulikunitz/xz v0.5.17
+)
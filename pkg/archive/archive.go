@@ -0,0 +1,600 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxFileSize = 64 << 20
+	DefaultMaxSize     = 256 << 20
+
+	// maxLinkHops bounds how many symlinks we follow, in case of loops.
+	maxLinkHops = 40
+)
+
+// ModTime is the modification time of all entries of the repacked archives,
+// which is the earliest time zip archives can hold.
+var ModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ErrInvalid is returned for tarballs with entries that can't be served
+// safely, or that exceed the size limits.
+var ErrInvalid = errors.New("invalid archive")
+
+// Options tune the repacking of the tarballs.
+type Options struct {
+	// Ignore rules used when there's no .terraformignore file.
+	Ignore []string
+	// MaxFileSize and MaxSize limit the size of the files of the module, and
+	// all of them together, with zero meaning the default limits.
+	MaxFileSize int64
+	MaxSize     int64
+}
+
+// Repack reads a gzipped tarball from r, and writes a new gzipped tarball to
+// w, only containing the entries matching the prefix regexp. The prefix must
+// have exactly one capture group, which will be used as the new entry name.
+//
+// Entries matching the rules of the .terraformignore file of the module, or
+// else the one at the root of the tarball, are left out. Without either, the
+// ignore rules of the options are used, or DefaultIgnore if there are none.
+// The ignore files are expected in the order git archives them, i.e. before
+// the entries of their directory sorting after them, and entries are only held
+// back until it's known which rules apply to them.
+//
+// Since the archives are unpacked by every client, entries escaping the
+// module, or files written exceeding the size limits, fail the whole archive.
+// Symlinks leading out of the module, and anything but directories, regular
+// files and symlinks, are left out. Some of that is only known at the end, so
+// the archive is spooled, and nothing is written to w unless all of it is
+// valid.
+func Repack(w io.Writer, r io.Reader, prefix string, opts Options) error {
+	re, err := regexp.Compile(prefix)
+	if err != nil {
+		return fmt.Errorf("compile prefix regexp: %w", err)
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("read gzip: %w", err)
+	}
+	defer func() {
+		if err := zr.Close(); err != nil {
+			slog.Warn("error closing gzip reader", "err", err)
+		}
+	}()
+
+	// The gzip header is left without a name or modification time, so the
+	// output only depends on the content.
+	var out spool
+	defer out.close()
+	zw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(zw)
+	p := &repacker{
+		re:    re,
+		opts:  opts,
+		w:     tw,
+		links: map[string]string{},
+		dirs:  map[string]string{},
+	}
+	defer p.held.close()
+
+	if err := p.repack(tar.NewReader(zr)); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("closing tar writer: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("closing gzip writer: %w", err)
+	}
+
+	src, err := out.reader()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return fmt.Errorf("copying archive: %w", err)
+	}
+	return nil
+}
+
+// ignoreFiles holds the content of the ignore files found in the tarball.
+type ignoreFiles struct {
+	module *bytes.Buffer
+	root   *bytes.Buffer
+}
+
+// rules returns the rules that apply, and the path of the module relative to
+// where they're anchored, given the path of the module in the repository.
+func (f ignoreFiles) rules(base string, fallback []string) (ignoreRules, string, error) {
+	switch {
+	case f.module != nil:
+		rules, err := parseIgnore(f.module.String())
+		return rules, "", err
+	case f.root != nil:
+		rules, err := parseIgnore(f.root.String())
+		return rules, base, err
+	case len(fallback) > 0:
+		rules, err := parseIgnore(strings.Join(fallback, "\n"))
+		return rules, "", err
+	}
+	rules, err := parseIgnore(strings.Join(DefaultIgnore, "\n"))
+	return rules, "", err
+}
+
+// rootIgnore matches the ignore file at the root of the repository, which is
+// below the single top-level directory of the tarball.
+var rootIgnore = regexp.MustCompile("^[^/]+/" + regexp.QuoteMeta(IgnoreFile) + "$")
+
+// maxIgnoreSize bounds the size of the ignore files we hold on to.
+const maxIgnoreSize = 1 << 20
+
+// repacker keeps track of what we've learnt about the module while repacking
+// it. The entries are held back until we know which ignore rules apply to
+// them, and after that written as they come.
+type repacker struct {
+	re   *regexp.Regexp
+	opts Options
+	w    *tar.Writer
+
+	files ignoreFiles
+	// base is the path of the module in the repository, which the rules of
+	// the root ignore file are relative to.
+	base string
+	// rootPassed and modulePassed tell whether we've seen the entries that
+	// come after where the ignore files would have been, if there were any.
+	rootPassed   bool
+	modulePassed bool
+
+	settled bool
+	rules   ignoreRules
+	anchor  string
+	held    held
+
+	size        int64
+	maxFileSize int64
+	maxSize     int64
+	// links holds the targets of all the symlinks, which are written last,
+	// when we know them all. dirs holds the directories of the entries
+	// written, along with the first entry below each.
+	links    map[string]string
+	symlinks []*tar.Header
+	dirs     map[string]string
+}
+
+func (p *repacker) repack(r *tar.Reader) error {
+	p.maxFileSize = orDefault(p.opts.MaxFileSize, DefaultMaxFileSize)
+	p.maxSize = orDefault(p.opts.MaxSize, DefaultMaxSize)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+
+		// The tarball has a single top-level directory, holding the
+		// repository.
+		_, repoPath, _ := strings.Cut(hdr.Name, "/")
+		if after(repoPath) {
+			p.rootPassed = true
+		}
+
+		var ignore *bytes.Buffer
+		if hdr.Typeflag == tar.TypeReg && hdr.Size <= maxIgnoreSize && rootIgnore.MatchString(hdr.Name) {
+			if p.settled && p.files.module == nil {
+				return invalid(hdr.Name, "ignore file after the entries it applies to")
+			}
+			p.files.root = &bytes.Buffer{}
+			ignore = p.files.root
+		}
+
+		match := capture(p.re, hdr.Name)
+		if match == "" {
+			if ignore != nil {
+				if _, err := io.Copy(ignore, r); err != nil {
+					return fmt.Errorf("reading %s: %w", hdr.Name, err)
+				}
+			}
+			if err := p.settle(false); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name, err := cleanName(match)
+		if err != nil {
+			return err
+		}
+		if p.base == "" && strings.HasSuffix(repoPath, match) {
+			p.base = strings.TrimSuffix(repoPath, match)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			name += "/"
+		case tar.TypeReg:
+			if name == IgnoreFile && hdr.Size <= maxIgnoreSize {
+				if p.settled {
+					return invalid(name, "ignore file after the entries it applies to")
+				}
+				p.files.module = &bytes.Buffer{}
+				ignore = p.files.module
+			}
+		case tar.TypeSymlink:
+			p.links[name] = hdr.Linkname
+		default:
+			slog.Debug("skipping tar entry", "name", name, "type", hdr.Typeflag)
+			continue
+		}
+		if after(name) {
+			p.modulePassed = true
+		}
+
+		// The content of the ignore files is needed to tell what to do with
+		// the entry itself.
+		var src io.Reader = r
+		if ignore != nil {
+			if _, err := io.Copy(ignore, r); err != nil {
+				return fmt.Errorf("reading %s: %w", name, err)
+			}
+			src = bytes.NewReader(ignore.Bytes())
+		}
+
+		if err := p.settle(false); err != nil {
+			return err
+		}
+		hdr = entryHeader(hdr, name)
+		if !p.settled {
+			if err := p.held.add(hdr, src); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.write(hdr, src); err != nil {
+			return err
+		}
+	}
+
+	if err := p.settle(true); err != nil {
+		return err
+	}
+	return p.writeSymlinks()
+}
+
+// capture returns what the prefix captures of the name, if it matches.
+func capture(prefix *regexp.Regexp, name string) string {
+	if m := prefix.FindStringSubmatch(name); len(m) == 2 {
+		return m[1]
+	}
+	return ""
+}
+
+// after tells whether the path, relative to a directory, comes after where
+// the ignore file of the directory would have been in an archive made by git,
+// which sorts the entries of directories as if they had a trailing slash.
+func after(path string) bool {
+	first, _, ok := strings.Cut(path, "/")
+	if ok {
+		first += "/"
+	}
+	return first > IgnoreFile
+}
+
+// settle decides which ignore rules apply, once we know which ignore files
+// there are, or at the end of the tarball, and writes the entries held back
+// until then.
+func (p *repacker) settle(final bool) error {
+	if p.settled {
+		return nil
+	}
+	known := p.files.module != nil || p.modulePassed && (p.files.root != nil || p.rootPassed)
+	if !known && !final {
+		return nil
+	}
+
+	var err error
+	if p.rules, p.anchor, err = p.files.rules(p.base, p.opts.Ignore); err != nil {
+		return err
+	}
+	p.settled = true
+	return p.held.each(p.write)
+}
+
+// write writes the entry unless it's ignored, holding back the symlinks. Only
+// the files written count towards the size limits.
+func (p *repacker) write(hdr *tar.Header, r io.Reader) error {
+	if p.rules.ignored(p.anchor + hdr.Name) {
+		return nil
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		if hdr.Size > p.maxFileSize {
+			return invalid(hdr.Name, fmt.Sprintf("%d bytes exceeds the limit of %d", hdr.Size, p.maxFileSize))
+		}
+		if p.size += hdr.Size; p.size > p.maxSize {
+			return invalid(hdr.Name, fmt.Sprintf("module exceeds the limit of %d bytes", p.maxSize))
+		}
+	}
+	if dir, ok := throughLink(p.links, hdr.Name); ok {
+		return invalid(hdr.Name, "below the symlink "+dir)
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		p.symlinks = append(p.symlinks, hdr)
+		return nil
+	}
+
+	name := strings.TrimSuffix(hdr.Name, "/")
+	for i := range len(name) {
+		if _, ok := p.dirs[name[:i]]; name[i] == '/' && !ok {
+			p.dirs[name[:i]] = hdr.Name
+		}
+	}
+
+	if err := p.w.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+	if _, err := io.Copy(p.w, r); err != nil {
+		return fmt.Errorf("copying %s: %w", hdr.Name, err)
+	}
+	return nil
+}
+
+// writeSymlinks writes the symlinks last, since the entries below them, and
+// the symlinks they lead through, may come in any order. Symlinks escaping
+// the module are left out.
+func (p *repacker) writeSymlinks() error {
+	for _, hdr := range p.symlinks {
+		if entry, ok := p.dirs[hdr.Name]; ok {
+			return invalid(entry, "below the symlink "+hdr.Name)
+		}
+		if escapes(p.links, hdr.Name) {
+			slog.Warn("skipping symlink escaping the module", "name", hdr.Name, "target", hdr.Linkname)
+			continue
+		}
+		if err := p.w.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+	}
+	return nil
+}
+
+// held holds back the entries that come before we know which ignore rules
+// apply to them. Archives made by git only have a few of them, if any, before
+// the ignore files, so they're usually kept in memory.
+type held struct {
+	spool
+	tw *tar.Writer
+}
+
+func (h *held) add(hdr *tar.Header, r io.Reader) error {
+	if h.tw == nil {
+		h.tw = tar.NewWriter(&h.spool)
+	}
+	if err := h.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("holding back %s: %w", hdr.Name, err)
+	}
+	if _, err := io.Copy(h.tw, r); err != nil {
+		return fmt.Errorf("holding back %s: %w", hdr.Name, err)
+	}
+	return nil
+}
+
+// each calls fn with every entry held back, in order.
+func (h *held) each(fn func(hdr *tar.Header, r io.Reader) error) error {
+	if h.tw == nil {
+		return nil
+	}
+	if err := h.tw.Close(); err != nil {
+		return fmt.Errorf("closing spool: %w", err)
+	}
+
+	src, err := h.reader()
+	if err != nil {
+		return err
+	}
+
+	r := tar.NewReader(src)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading spool: %w", err)
+		}
+		if err := fn(hdr, r); err != nil {
+			return err
+		}
+	}
+}
+
+// maxSpoolMemory is how much of a spool we keep in memory, before writing it
+// to disk.
+const maxSpoolMemory = 1 << 20
+
+// spool keeps what's written to it in memory, or in a temporary file once
+// there's too much to keep in memory.
+type spool struct {
+	buf  bytes.Buffer
+	file *os.File
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(b) <= maxSpoolMemory {
+		return s.buf.Write(b)
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp("", "orbit-*.spool")
+		if err != nil {
+			return 0, fmt.Errorf("create spool file: %w", err)
+		}
+		s.file = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, fmt.Errorf("writing spool file: %w", err)
+		}
+	}
+	return s.file.Write(b)
+}
+
+// reader returns what's been written, from the start.
+func (s *spool) reader() (io.Reader, error) {
+	if s.file == nil {
+		return &s.buf, nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("rewinding spool file: %w", err)
+	}
+	return s.file, nil
+}
+
+func (s *spool) close() {
+	if s.file == nil {
+		return
+	}
+	if err := s.file.Close(); err != nil {
+		slog.Warn("error closing spool file", "err", err)
+	}
+	if err := os.Remove(s.file.Name()); err != nil {
+		slog.Warn("error removing spool file", "err", err)
+	}
+}
+
+// entryHeader returns a header with only what's needed to unpack the entry,
+// normalized so that a given tag always yields the same bytes, whenever and
+// wherever it was fetched: the ownership is dropped, the modification time is
+// fixed, and the mode is either executable or not.
+func entryHeader(hdr *tar.Header, name string) *tar.Header {
+	mode := int64(0o644)
+	switch {
+	case hdr.Typeflag == tar.TypeSymlink:
+		mode = 0o777
+	case hdr.Typeflag == tar.TypeDir, hdr.Mode&0o111 != 0:
+		mode = 0o755
+	}
+	return &tar.Header{
+		Typeflag: hdr.Typeflag,
+		Name:     name,
+		Linkname: hdr.Linkname,
+		Size:     hdr.Size,
+		Mode:     mode,
+		ModTime:  ModTime,
+		Format:   tar.FormatPAX,
+	}
+}
+
+// cleanName returns the name of the entry, relative to the module, failing
+// for names that would end up outside of it.
+func cleanName(name string) (string, error) {
+	if path.IsAbs(name) || strings.Contains(name, "\\") {
+		return "", invalid(name, "absolute path")
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", invalid(name, "path escapes the module")
+		}
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", invalid(name, "empty path")
+	}
+	return name, nil
+}
+
+// throughLink tells whether the entry is below one of the symlinks, which
+// would have it unpacked wherever the symlink leads.
+func throughLink(links map[string]string, name string) (string, bool) {
+	name = strings.TrimSuffix(name, "/")
+	for i := range len(name) {
+		if name[i] == '/' {
+			if _, ok := links[name[:i]]; ok {
+				return name[:i], true
+			}
+		}
+	}
+	return "", false
+}
+
+// escapes tells whether following the symlink, and any other symlinks it
+// leads through, ends up outside the module.
+func escapes(links map[string]string, name string) bool {
+	target := links[name]
+	if path.IsAbs(target) {
+		return true
+	}
+
+	var (
+		resolved []string
+		todo     = append(strings.Split(path.Dir(name), "/"), strings.Split(target, "/")...)
+		hops     int
+	)
+	for len(todo) > 0 {
+		part := todo[0]
+		todo = todo[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return true
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, part)
+		if next, ok := links[strings.Join(resolved, "/")]; ok {
+			if hops++; hops > maxLinkHops || path.IsAbs(next) {
+				return true
+			}
+			resolved = resolved[:len(resolved)-1]
+			todo = append(strings.Split(next, "/"), todo...)
+		}
+	}
+	return false
+}
+
+func orDefault(v, def int64) int64 {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+type archiveErr struct {
+	name   string
+	reason string
+}
+
+func invalid(name, reason string) error {
+	return &archiveErr{name: name, reason: reason}
+}
+
+func (e *archiveErr) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrInvalid, e.name, e.reason)
+}
+
+func (e *archiveErr) Unwrap() error {
+	return ErrInvalid
+}
+
+// StatusCode reports the archive as a bad response from the upstream.
+func (e *archiveErr) StatusCode() int {
+	return http.StatusBadGateway
+}
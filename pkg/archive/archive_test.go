@@ -0,0 +1,399 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type entry struct {
+	name    string
+	content string
+}
+
+func TestRepack(t *testing.T) {
+	src := mockTarball(t, []entry{
+		{"owner-repo-abc123/module/main.tf", "resource {}"},
+		{"owner-repo-abc123/module/sub/vars.tf", "variable {}"},
+		{"owner-repo-abc123/other/main.tf", "nope"},
+		{"owner-repo-abc123/README.md", "nope"},
+	})
+
+	var buf bytes.Buffer
+	if err := Repack(&buf, src, "^owner-repo-[^/]+/module/(.+)", Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := readTarball(t, &buf)
+	exp := []entry{
+		{"main.tf", "resource {}"},
+		{"sub/vars.tf", "variable {}"},
+	}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected entries, exp: %v, got: %v", exp, got)
+	}
+}
+
+func TestRepack_Ignore(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+		ignore  []string
+		exp     []entry
+	}{
+		{
+			name: "module",
+			entries: []entry{
+				{"owner-repo-abc123/.terraformignore", "*.tf"},
+				{"owner-repo-abc123/module/.terraformignore", "examples/\n*.zip"},
+				{"owner-repo-abc123/module/examples/main.tf", "nope"},
+				{"owner-repo-abc123/module/lambda.zip", "nope"},
+				{"owner-repo-abc123/module/main.tf", "resource {}"},
+			},
+			exp: []entry{
+				{".terraformignore", "examples/\n*.zip"},
+				{"main.tf", "resource {}"},
+			},
+		},
+		{
+			name: "root",
+			entries: []entry{
+				{"owner-repo-abc123/-module/main.tf", "nope"},
+				{"owner-repo-abc123/.terraformignore", "test/"},
+				{"owner-repo-abc123/module/main.tf", "resource {}"},
+				{"owner-repo-abc123/module/test/fixture.json", "nope"},
+			},
+			exp: []entry{
+				{"main.tf", "resource {}"},
+			},
+		},
+		{
+			name: "root_anchored",
+			entries: []entry{
+				{"owner-repo-abc123/.terraformignore", "/test/\n/module/examples/"},
+				{"owner-repo-abc123/module/examples/main.tf", "nope"},
+				{"owner-repo-abc123/module/main.tf", "resource {}"},
+				{"owner-repo-abc123/module/test/fixture.json", "{}"},
+				{"owner-repo-abc123/test/main.tf", "nope"},
+			},
+			exp: []entry{
+				{"main.tf", "resource {}"},
+				{"test/fixture.json", "{}"},
+			},
+		},
+		{
+			name: "held_back",
+			entries: []entry{
+				{"owner-repo-abc123/module/.github/CODEOWNERS", "nope"},
+				{"owner-repo-abc123/module/.gitignore", "*.zip"},
+				{"owner-repo-abc123/module/.terraformignore", ".git*"},
+				{"owner-repo-abc123/module/main.tf", "resource {}"},
+			},
+			exp: []entry{
+				{".terraformignore", ".git*"},
+				{"main.tf", "resource {}"},
+			},
+		},
+		{
+			name: "configured",
+			entries: []entry{
+				{"owner-repo-abc123/module/.github/CODEOWNERS", "nope"},
+				{"owner-repo-abc123/module/main.tf", "resource {}"},
+			},
+			ignore: []string{".github/"},
+			exp: []entry{
+				{"main.tf", "resource {}"},
+			},
+		},
+		{
+			name: "defaults",
+			entries: []entry{
+				{"owner-repo-abc123/module/.terraform/terraform.tfstate", "nope"},
+				{"owner-repo-abc123/module/.terraform/modules/vpc/main.tf", "module {}"},
+				{"owner-repo-abc123/module/main.tf", "resource {}"},
+			},
+			exp: []entry{
+				{".terraform/modules/vpc/main.tf", "module {}"},
+				{"main.tf", "resource {}"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Repack(&buf, mockTarball(t, tt.entries), "^owner-repo-[^/]+/module/(.+)", Options{Ignore: tt.ignore}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := readTarball(t, &buf); !slices.Equal(got, tt.exp) {
+				t.Errorf("unexpected entries, exp: %v, got: %v", tt.exp, got)
+			}
+		})
+	}
+}
+
+func TestRepack_Invalid(t *testing.T) {
+	tests := map[string]struct {
+		hdrs []*tar.Header
+		opts Options
+	}{
+		"traversal": {
+			hdrs: []*tar.Header{{Name: "owner-repo-abc123/module/../../etc/passwd", Typeflag: tar.TypeReg}},
+		},
+		"absolute": {
+			hdrs: []*tar.Header{{Name: "owner-repo-abc123/module//etc/passwd", Typeflag: tar.TypeReg}},
+		},
+		"file_size": {
+			hdrs: []*tar.Header{{Name: "owner-repo-abc123/module/big.bin", Typeflag: tar.TypeReg, Size: 11}},
+			opts: Options{MaxFileSize: 10},
+		},
+		"total_size": {
+			hdrs: []*tar.Header{
+				{Name: "owner-repo-abc123/module/a.bin", Typeflag: tar.TypeReg, Size: 10},
+				{Name: "owner-repo-abc123/module/b.bin", Typeflag: tar.TypeReg, Size: 10},
+			},
+			opts: Options{MaxSize: 15},
+		},
+		"late_ignore": {
+			hdrs: []*tar.Header{
+				{Name: "owner-repo-abc123/module/main.tf", Typeflag: tar.TypeReg, Size: 1},
+				{Name: "owner-repo-abc123/module/.terraformignore", Typeflag: tar.TypeReg, Size: 1},
+			},
+		},
+		"below_symlink": {
+			hdrs: []*tar.Header{
+				{Name: "owner-repo-abc123/module/link/main.tf", Typeflag: tar.TypeReg, Size: 1},
+				{Name: "owner-repo-abc123/module/link", Typeflag: tar.TypeSymlink, Linkname: "sub"},
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Nothing is written, even when the archive is only found to
+			// be invalid at the end.
+			var buf bytes.Buffer
+			err := Repack(&buf, mockTarballHeaders(t, tt.hdrs), "^owner-repo-[^/]+/module/(.+)", tt.opts)
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("expected an invalid archive error, got: %v", err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("expected nothing written, got %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestRepack_IgnoredSize(t *testing.T) {
+	// Only the files written count towards the limits.
+	src := mockTarball(t, []entry{
+		{"owner-repo-abc123/module/.terraformignore", "test/"},
+		{"owner-repo-abc123/module/main.tf", "resource {}"},
+		{"owner-repo-abc123/module/test/fixture.json", strings.Repeat("x", 1000)},
+	})
+
+	var buf bytes.Buffer
+	if err := Repack(&buf, src, "^owner-repo-[^/]+/module/(.+)", Options{MaxFileSize: 100, MaxSize: 100}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := readTarball(t, &buf)
+	exp := []entry{
+		{".terraformignore", "test/"},
+		{"main.tf", "resource {}"},
+	}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected entries, exp: %v, got: %v", exp, got)
+	}
+}
+
+func TestRepack_Spool(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	// More than we keep in memory comes before we know whether there's an
+	// ignore file, so it's spooled to disk.
+	big := strings.Repeat("x", maxSpoolMemory+1)
+	src := mockTarball(t, []entry{
+		{"owner-repo-abc123/module/.data/big.json", big},
+		{"owner-repo-abc123/module/.terraformignore", "*.zip"},
+		{"owner-repo-abc123/module/lambda.zip", "nope"},
+		{"owner-repo-abc123/module/main.tf", "resource {}"},
+	})
+
+	var buf bytes.Buffer
+	if err := Repack(&buf, src, "^owner-repo-[^/]+/module/(.+)", Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := readTarball(t, &buf)
+	exp := []entry{
+		{".data/big.json", big},
+		{".terraformignore", "*.zip"},
+		{"main.tf", "resource {}"},
+	}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected entries: %d, exp: %d", len(got), len(exp))
+	}
+	if files, err := os.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Errorf("expected the spool file to be removed, got %v (%v)", files, err)
+	}
+}
+
+func TestRepack_Entries(t *testing.T) {
+	src := mockTarballHeaders(t, []*tar.Header{
+		{Name: "owner-repo-abc123/module/sub/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "owner-repo-abc123/module/sub/main.tf", Typeflag: tar.TypeReg, Size: 3, Mode: 0644 | 04000},
+		{Name: "owner-repo-abc123/module/ok", Typeflag: tar.TypeSymlink, Linkname: "sub/main.tf"},
+		{Name: "owner-repo-abc123/module/sub/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "owner-repo-abc123/module/abs", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "owner-repo-abc123/module/parent", Typeflag: tar.TypeSymlink, Linkname: "../other"},
+		{Name: "owner-repo-abc123/module/chained", Typeflag: tar.TypeSymlink, Linkname: "sub/up/.."},
+		{Name: "owner-repo-abc123/module/loop", Typeflag: tar.TypeSymlink, Linkname: "loop/x"},
+		{Name: "owner-repo-abc123/module/hard", Typeflag: tar.TypeLink, Linkname: "owner-repo-abc123/module/sub/main.tf"},
+		{Name: "owner-repo-abc123/module/dev", Typeflag: tar.TypeChar},
+		{Name: "owner-repo-abc123/module/fifo", Typeflag: tar.TypeFifo},
+	})
+
+	var buf bytes.Buffer
+	if err := Repack(&buf, src, "^owner-repo-[^/]+/module/(.+)", Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("reading gzip: %v", err)
+	}
+	var got []string
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		if hdr.Mode&^0o777 != 0 {
+			t.Errorf("%s: unexpected mode %o", hdr.Name, hdr.Mode)
+		}
+		got = append(got, hdr.Name)
+	}
+
+	exp := []string{"sub/", "sub/main.tf", "ok", "sub/up"}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected entries, exp: %v, got: %v", exp, got)
+	}
+}
+
+func TestRepack_Reproducible(t *testing.T) {
+	repack := func(mtime time.Time, uid int) []byte {
+		src := mockTarballHeaders(t, []*tar.Header{
+			{Name: "owner-repo-abc123/module/main.tf", Typeflag: tar.TypeReg, Size: 3, Mode: 0664, ModTime: mtime, Uid: uid, Uname: "runner"},
+			{Name: "owner-repo-abc123/module/run.sh", Typeflag: tar.TypeReg, Size: 3, Mode: 0775, ModTime: mtime, Gid: uid},
+		})
+		var buf bytes.Buffer
+		if err := Repack(&buf, src, "^owner-repo-[^/]+/module/(.+)", Options{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	a := repack(time.Now(), 1000)
+	b := repack(time.Now().Add(time.Hour), 1001)
+	if !bytes.Equal(a, b) {
+		t.Error("expected identical archives")
+	}
+}
+
+func TestRepack_InvalidGzip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Repack(&buf, bytes.NewReader([]byte("not gzip")), "(.+)", Options{}); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func mockTarball(t *testing.T, entries []entry) io.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name: e.name,
+			Mode: 0644,
+			Size: int64(len(e.content)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("writing header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("writing content: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing gzip writer: %v", err)
+	}
+	return &buf
+}
+
+func mockTarballHeaders(t *testing.T, hdrs []*tar.Header) io.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("writing header: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(bytes.Repeat([]byte{'x'}, int(hdr.Size))); err != nil {
+				t.Fatalf("writing content: %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing gzip writer: %v", err)
+	}
+	return &buf
+}
+
+func readTarball(t *testing.T, r io.Reader) []entry {
+	t.Helper()
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("reading gzip: %v", err)
+	}
+
+	var entries []entry
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading entry: %v", err)
+		}
+		entries = append(entries, entry{hdr.Name, string(b)})
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/ulikunitz/xz"
+)
+
+// Format is an archive format understood by go-getter, named as by the
+// archive query parameter.
+type Format string
+
+const (
+	TarGzip  Format = "tar.gz"
+	TarBzip2 Format = "tar.bz2"
+	TarXz    Format = "tar.xz"
+	Zip      Format = "zip"
+)
+
+// DefaultLevel leaves the compression level to the format.
+const DefaultLevel = 0
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case TarGzip, TarBzip2, TarXz, Zip:
+		return f, nil
+	}
+	return "", fmt.Errorf("unsupported archive format: %q", s)
+}
+
+// ValidLevel checks that the compression level is either the default, or
+// between 1 and 9, which all formats support.
+func ValidLevel(level int) error {
+	if level < DefaultLevel || level > 9 {
+		return fmt.Errorf("invalid compression level: %d", level)
+	}
+	return nil
+}
+
+// Transcode reads a gzipped tarball from r, and writes it to w in the format,
+// compressed at the level. Gzipped tarballs at the default level are copied
+// as they are.
+func Transcode(w io.Writer, r io.Reader, format Format, level int) error {
+	if err := ValidLevel(level); err != nil {
+		return err
+	}
+	if format == TarGzip && level == DefaultLevel {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("read gzip: %w", err)
+	}
+	defer func() {
+		if err := zr.Close(); err != nil {
+			slog.Warn("error closing gzip reader", "err", err)
+		}
+	}()
+	tr := tar.NewReader(zr)
+
+	if format == Zip {
+		return writeZip(w, tr, level)
+	}
+
+	zw, err := compressor(w, format, level)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	if err := copyAll(tw, tr); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("closing tar writer: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("closing %s writer: %w", format, err)
+	}
+	return nil
+}
+
+func compressor(w io.Writer, format Format, level int) (io.WriteCloser, error) {
+	switch format {
+	case TarGzip:
+		if level == DefaultLevel {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case TarBzip2:
+		// The default level is taken for the one of bzip2.
+		return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+	case TarXz:
+		if level == DefaultLevel {
+			level = 6
+		}
+		return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported archive format: %q", format)
+}
+
+// xzDictCaps are the dictionary sizes of the presets of xz, by level, which is
+// what sets the levels apart.
+var xzDictCaps = [...]int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+func copyAll(w *tar.Writer, r *tar.Reader) error {
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return fmt.Errorf("copying %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// writeZip writes the entries of the tarball to a zip archive, keeping the
+// directories, files and symlinks, with the rest being of no use in modules.
+func writeZip(w io.Writer, r *tar.Reader, level int) error {
+	zw := zip.NewWriter(w)
+	if level != DefaultLevel {
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+		default:
+			continue
+		}
+
+		zh, err := zip.FileInfoHeader(hdr.FileInfo())
+		if err != nil {
+			return fmt.Errorf("zip header of %s: %w", hdr.Name, err)
+		}
+		zh.Name = hdr.Name
+		if hdr.Typeflag == tar.TypeDir {
+			zh.Name = strings.TrimSuffix(zh.Name, "/") + "/"
+		} else {
+			zh.Method = zip.Deflate
+		}
+
+		fw, err := zw.CreateHeader(zh)
+		if err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if _, err := io.Copy(fw, r); err != nil {
+				return fmt.Errorf("copying %s: %w", hdr.Name, err)
+			}
+		case tar.TypeSymlink:
+			if _, err := io.WriteString(fw, hdr.Linkname); err != nil {
+				return fmt.Errorf("writing link %s: %w", hdr.Name, err)
+			}
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("closing zip writer: %w", err)
+	}
+	return nil
+}
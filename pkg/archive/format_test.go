@@ -0,0 +1,129 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestParseFormat(t *testing.T) {
+	for _, s := range []string{"tar.gz", "tar.bz2", "tar.xz", "zip", "ZIP"} {
+		if _, err := ParseFormat(s); err != nil {
+			t.Errorf("%s: unexpected error: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "rar", "tar"} {
+		if _, err := ParseFormat(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	entries := []entry{
+		{"main.tf", "resource {}"},
+		{"sub/vars.tf", "variable {}"},
+	}
+
+	tests := map[Format]func(t *testing.T, r io.Reader) []entry{
+		TarGzip:  readTarball,
+		TarBzip2: func(t *testing.T, r io.Reader) []entry { return readTar(t, bzip2.NewReader(r)) },
+		TarXz:    readXz,
+		Zip:      readZip,
+	}
+	for format, read := range tests {
+		for _, level := range []int{DefaultLevel, 1} {
+			var buf bytes.Buffer
+			if err := Transcode(&buf, mockTarball(t, entries), format, level); err != nil {
+				t.Fatalf("%s: unexpected error: %v", format, err)
+			}
+			if got := read(t, &buf); !slices.Equal(got, entries) {
+				t.Errorf("%s: unexpected entries, exp: %v, got: %v", format, entries, got)
+			}
+		}
+	}
+}
+
+func TestTranscode_PassThrough(t *testing.T) {
+	src := []byte("not even gzip")
+	var buf bytes.Buffer
+	if err := Transcode(&buf, bytes.NewReader(src), TarGzip, DefaultLevel); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), src) {
+		t.Errorf("expected the archive as is, got %q", buf.Bytes())
+	}
+}
+
+func TestTranscode_InvalidLevel(t *testing.T) {
+	for _, level := range []int{-1, 10} {
+		if err := Transcode(io.Discard, mockTarball(t, nil), Zip, level); err == nil {
+			t.Errorf("%d: expected an error", level)
+		}
+	}
+}
+
+func readTar(t *testing.T, r io.Reader) []entry {
+	t.Helper()
+
+	var entries []entry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading entry: %v", err)
+		}
+		entries = append(entries, entry{hdr.Name, string(b)})
+	}
+}
+
+func readXz(t *testing.T, r io.Reader) []entry {
+	t.Helper()
+
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		t.Fatalf("reading xz: %v", err)
+	}
+	return readTar(t, xr)
+}
+
+func readZip(t *testing.T, r io.Reader) []entry {
+	t.Helper()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+
+	var entries []entry
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", f.Name, err)
+		}
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("reading %s: %v", f.Name, err)
+		}
+		_ = rc.Close()
+		entries = append(entries, entry{f.Name, string(b)})
+	}
+	return entries
+}
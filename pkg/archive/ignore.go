@@ -0,0 +1,138 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is the name of the file listing the paths to leave out of the
+// module archives, as when Terraform uploads configurations.
+const IgnoreFile = ".terraformignore"
+
+// DefaultIgnore are the rules used by Terraform when there's no ignore file.
+var DefaultIgnore = []string{".git/", ".terraform/", "!.terraform/modules/"}
+
+type rule struct {
+	re       *regexp.Regexp
+	excluded bool
+}
+
+// ignoreRules holds the rules of a .terraformignore file, where later rules
+// take precedence, and rules starting with an exclamation mark re-include the
+// paths that were ignored.
+type ignoreRules []rule
+
+// parseIgnore parses the rules, one per line, with the same semantics as
+// Terraform: patterns are matched against the whole path unless anchored by a
+// leading slash, a trailing slash matches everything below the directory, and
+// "**" matches any number of directories.
+func parseIgnore(s string) (ignoreRules, error) {
+	var rules ignoreRules
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || pattern[0] == '#' {
+			continue
+		}
+
+		var r rule
+		if pattern[0] == '!' {
+			r.excluded = true
+			pattern = pattern[1:]
+		}
+		if pattern == "" {
+			continue
+		}
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "**"
+		}
+		if pattern[0] == '/' {
+			pattern = pattern[1:]
+		} else {
+			pattern = "**/" + pattern
+		}
+
+		re, err := regexp.Compile(globToRegexp(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("ignore pattern %q: %w", pattern, err)
+		}
+		r.re = re
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				// Treat "**/" as "**", and let it match any number of
+				// directories, even none.
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+				}
+				if i+1 == len(pattern) {
+					b.WriteString(".*")
+				} else {
+					b.WriteString("(.*/)?")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '.', '$', '+', '(', ')', '{', '}', '|', '^':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// ignored tells whether the path, relative to the module, should be left
+// out, where directories end with a slash. Paths no rule matches follow their
+// parent directory, like when Terraform skips the ignored directories, unless
+// re-included explicitly.
+func (rules ignoreRules) ignored(path string) bool {
+	dir := strings.HasSuffix(path, "/")
+	path = strings.TrimSuffix(path, "/")
+	for {
+		if ignored, ok := rules.match(path, dir); ok {
+			return ignored
+		}
+		i := strings.LastIndexByte(path, '/')
+		if i < 0 {
+			return false
+		}
+		path, dir = path[:i], true
+	}
+}
+
+// match returns whether the last rule matching the path ignores it, and
+// whether any rule matched at all.
+func (rules ignoreRules) match(path string, dir bool) (ignored, ok bool) {
+	for _, r := range rules {
+		if r.re.MatchString(path) || dir && r.re.MatchString(path+"/") {
+			ignored, ok = !r.excluded, true
+		}
+	}
+	return ignored, ok
+}
@@ -0,0 +1,69 @@
+package archive
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules, err := parseIgnore(`
+# Comments and blank lines are skipped
+
+examples/
+!examples/basic/
+*.zip
+/fixtures
+test/**/*.json
+docs/*.md
+.github/
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := map[string]bool{
+		"main.tf":                      false,
+		"examples/":                    true,
+		"examples/complete/main.tf":    true,
+		"examples/basic/main.tf":       false,
+		"modules/lambda/function.zip":  true,
+		"function.zip":                 true,
+		"fixtures/data.json":           true,
+		"modules/fixtures/main.tf":     false,
+		"test/data.json":               true,
+		"test/unit/deep/data.json":     true,
+		"test/main.tf":                 false,
+		"docs/README.md":               true,
+		"docs/images/diagram.md":       false,
+		".github/workflows/test.yml":   true,
+		"modules/.github/CODEOWNERS":   true,
+		"modules/sub/variables.tf":     false,
+		"README.md":                    false,
+		"test/unit/deep/data.json.bak": false,
+	}
+	for path, exp := range tests {
+		if got := rules.ignored(path); got != exp {
+			t.Errorf("%s: expected ignored %t, got %t", path, exp, got)
+		}
+	}
+}
+
+func TestIgnoreRules_Defaults(t *testing.T) {
+	rules, err := parseIgnore(strings.Join(DefaultIgnore, "\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := map[string]bool{
+		"main.tf":                    false,
+		".git/config":                true,
+		".terraform/providers/x":     true,
+		".terraform/modules/vpc/a":   false,
+		"sub/.terraform/terraform.x": true,
+	}
+	for path, exp := range tests {
+		if got := rules.ignored(path); got != exp {
+			t.Errorf("%s: expected ignored %t, got %t", path, exp, got)
+		}
+	}
+}
@@ -222,18 +222,20 @@ func processMap(field reflect.Value, value string) error {
 	if strings.TrimSpace(value) != "" {
 		pairs := strings.Split(value, ";")
 		for _, pair := range pairs {
-			kv := strings.Split(pair, ":")
-			if len(kv) != 2 {
+			// Only split on the first colon, so that values may contain them,
+			// as URLs do.
+			key, value, ok := strings.Cut(pair, ":")
+			if !ok {
 				return fmt.Errorf("%w: %q", ErrInvalidMapItem, pair)
 			}
 
 			k := reflect.New(t.Key()).Elem()
-			if err := processField(k, kv[0]); err != nil {
+			if err := processField(k, key); err != nil {
 				return err
 			}
 
 			v := reflect.New(t.Elem()).Elem()
-			if err := processField(v, kv[1]); err != nil {
+			if err := processField(v, value); err != nil {
 				return err
 			}
 
@@ -175,3 +175,30 @@ func TestProcess_MapField(t *testing.T) {
 		}
 	}
 }
+
+func TestProcess_MapFieldURLs(t *testing.T) {
+	type MapConfig struct {
+		Values map[string]string `envconfig:"VALUES"`
+	}
+
+	os.Clearenv()
+	if err := os.Setenv("VALUES", "key1:https://example.com:8443/api;key2:value2"); err != nil {
+		panic(err)
+	}
+
+	var cfg MapConfig
+	err := Process(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{"key1": "https://example.com:8443/api", "key2": "value2"}
+	if len(cfg.Values) != len(expected) {
+		t.Fatalf("expected %d map entries, got %d", len(expected), len(cfg.Values))
+	}
+	for k, v := range expected {
+		if cfg.Values[k] != v {
+			t.Errorf("expected key %q to have value %q, got %q", k, v, cfg.Values[k])
+		}
+	}
+}
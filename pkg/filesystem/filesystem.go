@@ -0,0 +1,133 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+const extension = ".tar.gz"
+
+type Config struct {
+	Path         string              `envconfig:"PATH"`
+	Repositories map[string][]string `envconfig:"REPOSITORIES"`
+	OrgMappings  map[string]string   `envconfig:"ORG_MAPPINGS"`
+}
+
+func New(cfg Config, fsys fs.FS) *Service {
+	return &Service{
+		cfg:  cfg,
+		fsys: fsys,
+	}
+}
+
+// Service implements the modules repository by serving pre-built archives
+// from a directory tree, laid out as `<owner>/<repo>/<module>/<version>.tar.gz`,
+// e.g. for air-gapped sites that can't reach any upstream at all. The owner is
+// mapped and validated the same way as for the other backends, so the same
+// tree can be populated by mirroring those.
+type Service struct {
+	cfg  Config
+	fsys fs.FS
+}
+
+func (s *Service) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
+	owner := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, owner, repo); err != nil {
+		return nil, err
+	}
+
+	dir, err := modulePath(owner, repo, module)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(s.fsys, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Just like there being no tags for a module, there being no
+		// directory simply means that there are no versions.
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+
+	versions := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.Type().IsRegular() && strings.HasSuffix(name, extension) && name != extension {
+			versions = append(versions, strings.TrimSuffix(name, extension))
+		}
+	}
+	return versions, nil
+}
+
+func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
+	owner := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, owner, repo); err != nil {
+		return err
+	}
+
+	dir, err := modulePath(owner, repo, module)
+	if err != nil {
+		return err
+	}
+	if !validName(version) {
+		return &backend.Error{
+			Code: http.StatusBadRequest,
+			Msg:  "invalid version",
+		}
+	}
+
+	f, err := s.fsys.Open(path.Join(dir, version+extension))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &backend.Error{
+			Code: http.StatusNotFound,
+			Msg:  "no such version",
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("opening archive: %w", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("error closing archive", "err", err)
+		}
+	}()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("copying archive: %w", err)
+	}
+	return nil
+}
+
+// modulePath returns the directory of the module, making sure that none of
+// the names would take us anywhere else in the tree.
+func modulePath(owner, repo, module string) (string, error) {
+	elems := append(strings.Split(owner, "/"), repo, module)
+	for _, elem := range elems {
+		if !validName(elem) {
+			return "", &backend.Error{
+				Code: http.StatusBadRequest,
+				Msg:  "invalid module path",
+			}
+		}
+	}
+	return path.Join(elems...), nil
+}
+
+func validName(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
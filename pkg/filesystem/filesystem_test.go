@@ -0,0 +1,120 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+func mockFS() fstest.MapFS {
+	return fstest.MapFS{
+		"test-org/test-repo/module/v1.0.0.tar.gz": {Data: []byte("v1.0.0 content")},
+		"test-org/test-repo/module/v1.1.0.tar.gz": {Data: []byte("v1.1.0 content")},
+		"test-org/test-repo/module/README.md":     {Data: []byte("not a version")},
+		"test-org/test-repo/other/v2.0.0.tar.gz":  {Data: []byte("v2.0.0 content")},
+	}
+}
+
+func TestService_ListVersions(t *testing.T) {
+	cfg := Config{
+		OrgMappings: map[string]string{"test-system": "test-org"},
+	}
+	service := New(cfg, mockFS())
+
+	versions, err := service.ListVersions(context.Background(), "test-system", "test-repo", "module")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"v1.0.0", "v1.1.0"}
+	if !slices.Equal(versions, expected) {
+		t.Errorf("expected versions %q, got %q", expected, versions)
+	}
+}
+
+func TestService_ListVersions_NoModule(t *testing.T) {
+	service := New(Config{}, mockFS())
+
+	versions, err := service.ListVersions(context.Background(), "test-org", "test-repo", "missing")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("expected no versions, got %q", versions)
+	}
+}
+
+func TestService_ProxyDownload(t *testing.T) {
+	cfg := Config{
+		OrgMappings: map[string]string{"test-system": "test-org"},
+	}
+	service := New(cfg, mockFS())
+
+	var buf bytes.Buffer
+	err := service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v1.1.0", &buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != "v1.1.0 content" {
+		t.Errorf("expected content %q, got %q", "v1.1.0 content", buf.String())
+	}
+}
+
+func TestService_ProxyDownload_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		system  string
+		module  string
+		version string
+		expCode int
+	}{
+		{
+			name:    "missing_version",
+			system:  "test-org",
+			module:  "module",
+			version: "v9.9.9",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "traversal",
+			system:  "test-org",
+			module:  "..",
+			version: "v2.0.0",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid_version",
+			system:  "test-org",
+			module:  "module",
+			version: "..",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid_repo",
+			cfg:     Config{Repositories: map[string][]string{"test-org": {"other-repo"}}},
+			system:  "test-org",
+			module:  "module",
+			version: "v1.0.0",
+			expCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := New(tt.cfg, mockFS())
+
+			err := service.ProxyDownload(context.Background(), tt.system, "test-repo", tt.module, tt.version, io.Discard)
+			var herr *backend.Error
+			if !errors.As(err, &herr) || herr.StatusCode() != tt.expCode {
+				t.Errorf("expected status %d, got %v", tt.expCode, err)
+			}
+		})
+	}
+}
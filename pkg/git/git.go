@@ -0,0 +1,197 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/reMarkable/orbit/pkg/archive"
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+type Config struct {
+	URL          string              `envconfig:"URL"`
+	Repositories map[string][]string `envconfig:"REPOSITORIES"`
+	OrgMappings  map[string]string   `envconfig:"ORG_MAPPINGS"`
+	Username     string              `envconfig:"USERNAME" default:"git"`
+	Token        string              `envconfig:"TOKEN"`
+	MaxPackSize  int64               `envconfig:"MAX_PACK_SIZE" default:"536870912"`
+
+	Ignore         []string `envconfig:"IGNORE"`
+	MaxFileSize    int64    `envconfig:"MAX_FILE_SIZE"`
+	MaxArchiveSize int64    `envconfig:"MAX_ARCHIVE_SIZE"`
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func New(cfg Config, c HTTPClient) *Service {
+	return &Service{
+		cfg:    cfg,
+		client: c,
+	}
+}
+
+// Service implements the modules repository directly on top of git, either
+// by talking to any server supporting the smart HTTP protocol, or by reading
+// bare repositories on the local file-system, depending on the configured URL.
+// The repositories are expected at `<URL>/<owner>/<repo>.git`, with modules
+// being released with `module/vX.Y.Z` tags.
+type Service struct {
+	cfg    Config
+	client HTTPClient
+}
+
+type source interface {
+	refs(ctx context.Context) (map[string]hash, error)
+	objects(ctx context.Context, want hash) (objectStore, error)
+}
+
+func (s *Service) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
+	owner := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, owner, repo); err != nil {
+		return nil, err
+	}
+
+	src, err := s.source(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := src.refs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		prefix   = "refs/tags/" + module + "/"
+		versions = []string{}
+	)
+	for name := range refs {
+		if strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, "^{}") {
+			versions = append(versions, strings.TrimPrefix(name, prefix))
+		}
+	}
+	return versions, nil
+}
+
+func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
+	owner := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, owner, repo); err != nil {
+		return err
+	}
+
+	src, err := s.source(owner, repo)
+	if err != nil {
+		return err
+	}
+	refs, err := src.refs(ctx)
+	if err != nil {
+		return err
+	}
+	tag, ok := refs["refs/tags/"+module+"/"+version]
+	if !ok {
+		return &backend.Error{
+			Code: http.StatusNotFound,
+			Msg:  "no such version",
+		}
+	}
+
+	store, err := src.objects(ctx, tag)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			slog.Warn("error closing object store", "err", err)
+		}
+	}()
+
+	root, mtime, err := peel(store, tag)
+	if err != nil {
+		return err
+	}
+	tree, err := lookupTree(store, root, module)
+	if errors.Is(err, errNotFound) {
+		return &backend.Error{
+			Code: http.StatusNotFound,
+			Msg:  "no such module",
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// The trees come straight from the remote, so they're archived the way
+	// git would, and repacked like the archives of the other backends, to get
+	// the same checks, ignore rules and headers.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeArchive(pw, store, root, tree, module, mtime))
+	}()
+
+	prefix := fmt.Sprintf("^[^/]+/%s/(.+)", regexp.QuoteMeta(module))
+	err = archive.Repack(w, pr, prefix, archive.Options{
+		Ignore:      s.cfg.Ignore,
+		MaxFileSize: s.cfg.MaxFileSize,
+		MaxSize:     s.cfg.MaxArchiveSize,
+	})
+	// Should the repacking stop early, the archiving has to be stopped as
+	// well, before the object store is closed.
+	pr.Close()
+	<-done
+	return err
+}
+
+func (s *Service) source(owner, repo string) (source, error) {
+	// The names end up in both URLs and paths, so make sure nobody's trying to
+	// sneak out of the configured location.
+	for _, elem := range strings.Split(owner+"/"+repo, "/") {
+		if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, `\?#%`) {
+			return nil, &backend.Error{
+				Code: http.StatusBadRequest,
+				Msg:  "invalid repository name",
+			}
+		}
+	}
+
+	base := strings.TrimSuffix(s.cfg.URL, "/")
+	if strings.HasPrefix(base, "http://") || strings.HasPrefix(base, "https://") {
+		return &remote{
+			client:   s.client,
+			url:      fmt.Sprintf("%s/%s/%s.git", base, owner, repo),
+			username: s.cfg.Username,
+			token:    s.cfg.Token,
+			maxSize:  s.cfg.MaxPackSize,
+		}, nil
+	}
+
+	// Bare repositories conventionally have a `.git` suffix, but we'll accept
+	// them without as well.
+	dir := filepath.Join(strings.TrimPrefix(base, "file://"), owner, repo)
+	for _, d := range []string{dir + ".git", dir} {
+		if fi, err := os.Stat(filepath.Join(d, "objects")); err == nil && fi.IsDir() {
+			return &local{dir: d}, nil
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, &backend.Error{
+		Code: http.StatusNotFound,
+		Msg:  "no such repository",
+	}
+}
@@ -0,0 +1,240 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+func TestService_ListVersions(t *testing.T) {
+	for name, cfg := range configs(t) {
+		t.Run(name, func(t *testing.T) {
+			service := New(cfg, http.DefaultClient)
+
+			versions, err := service.ListVersions(context.Background(), "test-system", "test-repo", "module")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The refs come in no particular order, and the versions are
+			// sorted by the modules service.
+			slices.Sort(versions)
+			expected := []string{"v1.0.0", "v1.1.0", "v1.2.0"}
+			if !slices.Equal(versions, expected) {
+				t.Errorf("expected versions %q, got %q", expected, versions)
+			}
+		})
+	}
+}
+
+func TestService_ProxyDownload(t *testing.T) {
+	for name, cfg := range configs(t) {
+		t.Run(name, func(t *testing.T) {
+			service := New(cfg, http.DefaultClient)
+
+			tests := map[string]map[string]string{
+				"v1.0.0": {
+					"main.tf": "# v1\n",
+				},
+				"v1.1.0": {
+					"main.tf":       "# v1.1\n",
+					"sub/":          "",
+					"sub/nested.tf": "# nested\n",
+				},
+				// The ignore file at the root applies, and the symlink
+				// leading out of the module is left out.
+				"v1.2.0": {
+					"main.tf":       "# v1.1\n",
+					"sub/":          "",
+					"sub/nested.tf": "# nested\n",
+					"link.tf":       "",
+				},
+			}
+			for version, expected := range tests {
+				var buf bytes.Buffer
+				err := service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", version, &buf)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				got := readTarball(t, &buf)
+				if len(got) != len(expected) {
+					t.Errorf("%s: expected entries %q, got %q", version, expected, got)
+				}
+				for name, content := range expected {
+					if got[name] != content {
+						t.Errorf("%s: expected %s to be %q, got %q", version, name, content, got[name])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestService_ProxyDownload_NotFound(t *testing.T) {
+	for name, cfg := range configs(t) {
+		t.Run(name, func(t *testing.T) {
+			service := New(cfg, http.DefaultClient)
+
+			err := service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v9.9.9", io.Discard)
+			var herr *backend.Error
+			if !errors.As(err, &herr) || herr.StatusCode() != http.StatusNotFound {
+				t.Errorf("expected not found error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestService_ProxyDownload_PackTooLarge(t *testing.T) {
+	cfg := configs(t)["http"]
+	cfg.MaxPackSize = 64
+	service := New(cfg, http.DefaultClient)
+
+	err := service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v1.0.0", io.Discard)
+	if !errors.Is(err, errPackTooLarge) {
+		t.Errorf("expected pack too large error, got %v", err)
+	}
+}
+
+func TestService_InvalidRepo(t *testing.T) {
+	service := New(Config{URL: t.TempDir()}, http.DefaultClient)
+
+	_, err := service.ListVersions(context.Background(), "..", "test-repo", "module")
+	var herr *backend.Error
+	if !errors.As(err, &herr) || herr.StatusCode() != http.StatusBadRequest {
+		t.Errorf("expected bad request error, got %v", err)
+	}
+}
+
+// configs sets up a bare repository with a couple of module releases, and
+// returns configurations for reading it both from disk and over smart HTTP,
+// served by `git http-backend`.
+func configs(t *testing.T) map[string]Config {
+	t.Helper()
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not available")
+	}
+
+	root := t.TempDir()
+	work := filepath.Join(root, "work")
+	bare := filepath.Join(root, "repos", "test-org", "test-repo.git")
+
+	run := func(dir string, args ...string) {
+		t.Helper()
+		cmd := exec.Command(gitPath, args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_CONFIG_GLOBAL=/dev/null",
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(work, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(root, "init", "-q", "-b", "main", work)
+	write("module/main.tf", "# v1\n")
+	write("other/main.tf", "# other\n")
+	run(work, "add", ".")
+	run(work, "commit", "-q", "-m", "first")
+	run(work, "tag", "module/v1.0.0")
+	run(work, "tag", "other/v2.0.0")
+
+	write("module/main.tf", "# v1.1\n")
+	write("module/sub/nested.tf", "# nested\n")
+	run(work, "add", ".")
+	run(work, "commit", "-q", "-m", "second")
+	run(work, "tag", "-a", "-m", "annotated", "module/v1.1.0")
+
+	write(".terraformignore", "*.bak\n")
+	write("module/notes.bak", "# ignored\n")
+	for name, target := range map[string]string{"link.tf": "main.tf", "escape.tf": "../other/main.tf"} {
+		if err := os.Symlink(target, filepath.Join(work, "module", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(work, "add", ".")
+	run(work, "commit", "-q", "-m", "third")
+	run(work, "tag", "module/v1.2.0")
+
+	run(root, "clone", "-q", "--bare", work, bare)
+	// Pack everything so that we exercise reading both packs and deltas.
+	run(bare, "repack", "-a", "-d", "-q")
+	run(bare, "config", "http.uploadpack", "true")
+
+	srv := httptest.NewServer(&cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Join(root, "repos"),
+			"GIT_HTTP_EXPORT_ALL=1",
+			"GIT_CONFIG_GLOBAL=/dev/null",
+		},
+	})
+	t.Cleanup(srv.Close)
+
+	mappings := map[string]string{"test-system": "test-org"}
+	return map[string]Config{
+		"local": {
+			URL:         filepath.Join(root, "repos"),
+			OrgMappings: mappings,
+		},
+		"http": {
+			URL:         srv.URL,
+			OrgMappings: mappings,
+		},
+	}
+}
+
+func readTarball(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("reading gzip: %v", err)
+	}
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading entry: %v", err)
+		}
+		entries[hdr.Name] = string(b)
+	}
+}
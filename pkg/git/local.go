@@ -0,0 +1,225 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// local reads refs and objects directly from a (bare) repository on disk.
+//
+// https://git-scm.com/docs/gitrepository-layout
+type local struct {
+	dir string
+}
+
+func (l *local) refs(ctx context.Context) (map[string]hash, error) {
+	refs := make(map[string]hash)
+
+	f, err := os.Open(filepath.Join(l.dir, "packed-refs"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("opening packed refs: %w", err)
+	}
+	if err == nil {
+		defer func() {
+			if err := f.Close(); err != nil {
+				slog.Warn("error closing packed refs", "err", err)
+			}
+		}()
+
+		var last string
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Text()
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			if line[0] == '^' {
+				// The peeled value of the preceding annotated tag.
+				h, err := parseHash(line[1:])
+				if err != nil {
+					return nil, err
+				}
+				refs[last+"^{}"] = h
+				continue
+			}
+
+			id, name, ok := strings.Cut(line, " ")
+			if !ok {
+				return nil, fmt.Errorf("invalid packed ref: %q", line)
+			}
+			h, err := parseHash(id)
+			if err != nil {
+				return nil, err
+			}
+			refs[name], last = h, name
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("reading packed refs: %w", err)
+		}
+	}
+
+	// Loose refs take precedence over the packed ones. We only care about
+	// tags, so there's no need to walk the branches.
+	root := filepath.Join(l.dir, "refs", "tags")
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == root {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		s := strings.TrimSpace(string(b))
+		if strings.HasPrefix(s, "ref: ") {
+			// Symbolic refs among the tags are odd enough to ignore.
+			return nil
+		}
+		h, err := parseHash(s)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(l.dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		refs[name] = h
+		delete(refs, name+"^{}")
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading loose refs: %w", err)
+	}
+	return refs, nil
+}
+
+func (l *local) objects(ctx context.Context, want hash) (objectStore, error) {
+	s := &diskStore{
+		dir: filepath.Join(l.dir, "objects"),
+	}
+
+	idxs, err := filepath.Glob(filepath.Join(s.dir, "pack", "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range idxs {
+		if err := s.openPack(idx); err != nil {
+			if cerr := s.Close(); cerr != nil {
+				slog.Warn("error closing object store", "err", cerr)
+			}
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// diskStore reads objects from the object database of a repository, both
+// loose objects and from any packs.
+type diskStore struct {
+	dir   string
+	packs []*pack
+	files []*os.File
+}
+
+func (s *diskStore) openPack(idx string) error {
+	b, err := os.ReadFile(idx)
+	if err != nil {
+		return fmt.Errorf("reading pack index: %w", err)
+	}
+	offsets, err := readIndex(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(idx), err)
+	}
+
+	f, err := os.Open(strings.TrimSuffix(idx, ".idx") + ".pack")
+	if err != nil {
+		return fmt.Errorf("opening pack: %w", err)
+	}
+	s.files = append(s.files, f)
+	s.packs = append(s.packs, &pack{
+		r:        f,
+		offsets:  offsets,
+		external: s.object,
+	})
+	return nil
+}
+
+func (s *diskStore) object(h hash) (*object, error) {
+	for _, p := range s.packs {
+		if _, ok := p.offsets[h]; ok {
+			return p.object(h)
+		}
+	}
+	return s.loose(h)
+}
+
+// loose reads an object stored on its own, which is just zlib compressed, with
+// a small header of its type and size.
+func (s *diskStore) loose(h hash) (*object, error) {
+	name := h.String()
+	f, err := os.Open(filepath.Join(s.dir, name[:2], name[2:]))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", errNotFound, h)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("error closing object", "err", err)
+		}
+	}()
+
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("object %s: %w", h, err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("object %s: %w", h, err)
+	}
+
+	hdr, data, ok := bytes.Cut(b, []byte{0})
+	if !ok {
+		return nil, fmt.Errorf("object %s: missing header", h)
+	}
+	typ, size, _ := strings.Cut(string(hdr), " ")
+	if n, err := strconv.Atoi(size); err != nil || n != len(data) {
+		return nil, fmt.Errorf("object %s: size mismatch", h)
+	}
+
+	for t, name := range objectTypeName {
+		if name == typ {
+			return &object{typ: t, data: data}, nil
+		}
+	}
+	return nil, fmt.Errorf("object %s: unknown type %q", h, typ)
+}
+
+func (s *diskStore) Close() error {
+	var errs []error
+	for _, f := range s.files {
+		errs = append(errs, f.Close())
+	}
+	return errors.Join(errs...)
+}
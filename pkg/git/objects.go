@@ -0,0 +1,351 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/archive"
+)
+
+var errNotFound = errors.New("object not found")
+
+type objectType int
+
+const (
+	objCommit   objectType = 1
+	objTree     objectType = 2
+	objBlob     objectType = 3
+	objTag      objectType = 4
+	objOfsDelta objectType = 6
+	objRefDelta objectType = 7
+)
+
+var objectTypeName = map[objectType]string{
+	objCommit: "commit",
+	objTree:   "tree",
+	objBlob:   "blob",
+	objTag:    "tag",
+}
+
+func (t objectType) String() string {
+	if name, ok := objectTypeName[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+// hash is the SHA-1 name of a git object.
+type hash [sha1.Size]byte
+
+func parseHash(s string) (hash, error) {
+	var h hash
+	if len(s) != hex.EncodedLen(len(h)) {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		return h, fmt.Errorf("invalid object name %q: %w", s, err)
+	}
+	return h, nil
+}
+
+func (h hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+type object struct {
+	typ  objectType
+	data []byte
+}
+
+// hash calculates the name of the object, as git would.
+func (o *object) hash() hash {
+	d := sha1.New()
+	fmt.Fprintf(d, "%s %d\x00", o.typ, len(o.data))
+	d.Write(o.data)
+
+	var h hash
+	d.Sum(h[:0])
+	return h
+}
+
+// objectStore is the common interface of the places we can read git objects
+// from, i.e. a pack fetched from a remote or a repository on disk.
+type objectStore interface {
+	object(h hash) (*object, error)
+	Close() error
+}
+
+// peel follows the annotated tags, starting at the object h, until it reaches
+// a commit. It returns the tree of that commit, as well as the commit time.
+func peel(s objectStore, h hash) (hash, time.Time, error) {
+	for {
+		obj, err := s.object(h)
+		if err != nil {
+			return hash{}, time.Time{}, err
+		}
+
+		switch obj.typ {
+		case objTag:
+			v, ok := header(obj.data, "object")
+			if !ok {
+				return hash{}, time.Time{}, fmt.Errorf("tag %s: missing object", h)
+			}
+			next, err := parseHash(v)
+			if err != nil {
+				return hash{}, time.Time{}, fmt.Errorf("tag %s: %w", h, err)
+			}
+			h = next
+		case objCommit:
+			v, ok := header(obj.data, "tree")
+			if !ok {
+				return hash{}, time.Time{}, fmt.Errorf("commit %s: missing tree", h)
+			}
+			tree, err := parseHash(v)
+			if err != nil {
+				return hash{}, time.Time{}, fmt.Errorf("commit %s: %w", h, err)
+			}
+			committer, _ := header(obj.data, "committer")
+			return tree, signatureTime(committer), nil
+		default:
+			return hash{}, time.Time{}, fmt.Errorf("%s %s: not a commit", obj.typ, h)
+		}
+	}
+}
+
+// header returns the value of the named header of a commit or tag object.
+func header(data []byte, name string) (string, bool) {
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			// An empty line separates the headers from the message.
+			break
+		}
+		if k, v, ok := strings.Cut(line, " "); ok && k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// signatureTime parses the time of a signature, such as the committer of a
+// commit, which has the format `Name <email> 1700000000 +0100`.
+func signatureTime(sig string) time.Time {
+	fields := strings.Fields(sig)
+	if len(fields) < 2 {
+		return time.Time{}
+	}
+	ts, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0).UTC()
+}
+
+type treeEntry struct {
+	mode uint32
+	name string
+	hash hash
+}
+
+func (e treeEntry) isDir() bool {
+	return e.mode&0o170000 == 0o040000
+}
+
+func parseTree(data []byte) ([]treeEntry, error) {
+	var entries []treeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return nil, errors.New("invalid tree entry: missing mode")
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree entry mode: %w", err)
+		}
+		data = data[sp+1:]
+
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 || len(data) < nul+1+len(hash{}) {
+			return nil, errors.New("invalid tree entry: truncated")
+		}
+
+		e := treeEntry{
+			mode: uint32(mode),
+			name: string(data[:nul]),
+		}
+		copy(e.hash[:], data[nul+1:])
+		entries = append(entries, e)
+		data = data[nul+1+len(e.hash):]
+	}
+	return entries, nil
+}
+
+// lookupTree finds the sub-tree at the slash separated path, starting at the
+// tree h.
+func lookupTree(s objectStore, h hash, path string) (hash, error) {
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		entries, err := readTree(s, h)
+		if err != nil {
+			return hash{}, err
+		}
+
+		found := false
+		for _, e := range entries {
+			if e.name == name && e.isDir() {
+				h, found = e.hash, true
+				break
+			}
+		}
+		if !found {
+			return hash{}, fmt.Errorf("%w: %s", errNotFound, path)
+		}
+	}
+	return h, nil
+}
+
+func readTree(s objectStore, h hash) ([]treeEntry, error) {
+	obj, err := s.object(h)
+	if err != nil {
+		return nil, err
+	}
+	if obj.typ != objTree {
+		return nil, fmt.Errorf("%s %s: not a tree", obj.typ, h)
+	}
+	return parseTree(obj.data)
+}
+
+// archiveDir is the single top-level directory of the archives we write, as
+// in those of git, which holds the repository.
+const archiveDir = "repo/"
+
+// writeArchive writes a gzipped tarball of the module, with the tree of the
+// module below the top-level directory, preceded by the ignore file at the
+// root of the repository, if there is one. It's only read by archive.Repack,
+// so it's compressed as little as possible.
+func writeArchive(w io.Writer, s objectStore, root, tree hash, module string, mtime time.Time) error {
+	zw, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+
+	entries, err := readTree(s, root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.name != archive.IgnoreFile || e.mode&0o170000 != 0o100000 {
+			continue
+		}
+		blob, err := s.object(e.hash)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     archiveDir + e.name,
+			Mode:     0o644,
+			Size:     int64(len(blob.data)),
+			ModTime:  mtime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+		if _, err := tw.Write(blob.data); err != nil {
+			return fmt.Errorf("writing %s: %w", hdr.Name, err)
+		}
+	}
+
+	if err := writeTree(tw, s, tree, archiveDir+module+"/", mtime); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("closing tar writer: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("closing gzip writer: %w", err)
+	}
+	return nil
+}
+
+// writeTree writes the entire tree h to the tar writer, recursively, with the
+// paths of all entries relative to the tree, below the prefix.
+func writeTree(tw *tar.Writer, s objectStore, h hash, prefix string, mtime time.Time) error {
+	entries, err := readTree(s, h)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := prefix + e.name
+		switch e.mode & 0o170000 {
+		case 0o040000:
+			hdr := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     name + "/",
+				Mode:     0o755,
+				ModTime:  mtime,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("writing header: %w", err)
+			}
+			if err := writeTree(tw, s, e.hash, name+"/", mtime); err != nil {
+				return err
+			}
+		case 0o100000, 0o120000:
+			blob, err := s.object(e.hash)
+			if err != nil {
+				return err
+			}
+			if blob.typ != objBlob {
+				return fmt.Errorf("%s %s: not a blob", blob.typ, e.hash)
+			}
+
+			hdr := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Mode:     0o644,
+				Size:     int64(len(blob.data)),
+				ModTime:  mtime,
+			}
+			if e.mode&0o111 != 0 {
+				hdr.Mode = 0o755
+			}
+			if e.mode&0o170000 == 0o120000 {
+				hdr.Typeflag = tar.TypeSymlink
+				hdr.Linkname = string(blob.data)
+				hdr.Mode = 0o777
+				hdr.Size = 0
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("writing header: %w", err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := tw.Write(blob.data); err != nil {
+					return fmt.Errorf("writing %s: %w", name, err)
+				}
+			}
+		default:
+			// Submodules (gitlinks) point at commits in other repositories,
+			// which we have no way of including, so we just skip them.
+		}
+	}
+	return nil
+}
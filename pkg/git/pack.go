@@ -0,0 +1,430 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var (
+	errInvalidPack  = errors.New("invalid pack")
+	errInvalidDelta = errors.New("invalid delta")
+)
+
+// maxDeltaDepth limits how long delta chains we're prepared to follow, to
+// guard against cycles in broken packs. Git itself defaults to 50.
+const maxDeltaDepth = 4096
+
+// pack gives random access to the objects in a packfile, given the offsets of
+// the objects by name, either from an index file or by scanning the pack.
+//
+// https://git-scm.com/docs/pack-format
+type pack struct {
+	r       io.ReaderAt
+	offsets map[hash]int64
+	cache   map[int64]*object
+
+	// external is used to resolve the bases of ref-deltas that aren't part of
+	// the pack itself, if set.
+	external func(h hash) (*object, error)
+}
+
+func (p *pack) object(h hash) (*object, error) {
+	off, ok := p.offsets[h]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNotFound, h)
+	}
+	return p.objectAt(off, 0)
+}
+
+func (p *pack) objectAt(off int64, depth int) (*object, error) {
+	if obj, ok := p.cache[off]; ok {
+		return obj, nil
+	}
+	if depth > maxDeltaDepth {
+		return nil, fmt.Errorf("%w: delta chain too long", errInvalidPack)
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(p.r, off, math.MaxInt64-off))
+	typ, size, err := readEntryHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("object at %d: %w", off, err)
+	}
+
+	var base *object
+	switch typ {
+	case objCommit, objTree, objBlob, objTag:
+	case objOfsDelta:
+		rel, err := readOffset(br)
+		if err != nil {
+			return nil, fmt.Errorf("object at %d: %w", off, err)
+		}
+		if rel <= 0 || rel > off {
+			return nil, fmt.Errorf("%w: delta base out of range at %d", errInvalidPack, off)
+		}
+		if base, err = p.objectAt(off-rel, depth+1); err != nil {
+			return nil, err
+		}
+	case objRefDelta:
+		var h hash
+		if _, err := io.ReadFull(br, h[:]); err != nil {
+			return nil, fmt.Errorf("object at %d: %w", off, err)
+		}
+		if base, err = p.base(h, depth+1); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown object type %d at %d", errInvalidPack, typ, off)
+	}
+
+	data, err := inflate(br, size)
+	if err != nil {
+		return nil, fmt.Errorf("object at %d: %w", off, err)
+	}
+
+	obj := &object{typ: typ, data: data}
+	if base != nil {
+		if obj.data, err = applyDelta(base.data, data); err != nil {
+			return nil, fmt.Errorf("object at %d: %w", off, err)
+		}
+		obj.typ = base.typ
+	}
+
+	if p.cache == nil {
+		p.cache = make(map[int64]*object)
+	}
+	p.cache[off] = obj
+	return obj, nil
+}
+
+func (p *pack) base(h hash, depth int) (*object, error) {
+	if off, ok := p.offsets[h]; ok {
+		return p.objectAt(off, depth)
+	}
+	if p.external != nil {
+		return p.external(h)
+	}
+	return nil, fmt.Errorf("%w: delta base %s", errNotFound, h)
+}
+
+// scanPack parses a complete packfile of the given size, such as the one
+// received from a remote, and indexes all objects in it by name.
+func scanPack(r io.ReaderAt, size int64) (*pack, error) {
+	if size < 12+sha1.Size {
+		return nil, fmt.Errorf("%w: too short", errInvalidPack)
+	}
+	var header [12]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, fmt.Errorf("reading pack: %w", err)
+	}
+	if string(header[:4]) != "PACK" {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidPack)
+	}
+	if v := binary.BigEndian.Uint32(header[4:8]); v != 2 && v != 3 {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidPack, v)
+	}
+
+	body := io.NewSectionReader(r, 0, size-sha1.Size)
+	var sum [sha1.Size]byte
+	if _, err := r.ReadAt(sum[:], size-sha1.Size); err != nil {
+		return nil, fmt.Errorf("reading pack: %w", err)
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return nil, fmt.Errorf("reading pack: %w", err)
+	}
+	if !bytes.Equal(h.Sum(nil), sum[:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errInvalidPack)
+	}
+
+	// First we need to find where all objects start, which means that we have
+	// to inflate every one of them, since the pack doesn't store the length
+	// of the compressed data.
+	count := binary.BigEndian.Uint32(header[8:12])
+	offsets := make([]int64, 0, min(count, 1<<16))
+	cr := &countingReader{
+		r: bufio.NewReader(io.NewSectionReader(body, 12, body.Size()-12)),
+		n: 12,
+	}
+	for range count {
+		off := cr.n
+		typ, length, err := readEntryHeader(cr)
+		if err != nil {
+			return nil, fmt.Errorf("object at %d: %w", off, err)
+		}
+		switch typ {
+		case objOfsDelta:
+			if _, err := readOffset(cr); err != nil {
+				return nil, fmt.Errorf("object at %d: %w", off, err)
+			}
+		case objRefDelta:
+			if _, err := io.CopyN(io.Discard, cr, sha1.Size); err != nil {
+				return nil, fmt.Errorf("object at %d: %w", off, err)
+			}
+		}
+		// The countingReader implements io.ByteReader, so zlib won't read
+		// past the end of the compressed data.
+		if _, err := inflate(cr, length); err != nil {
+			return nil, fmt.Errorf("object at %d: %w", off, err)
+		}
+		offsets = append(offsets, off)
+	}
+
+	// Then we can resolve all objects to calculate their names. Ref-deltas may
+	// refer to bases we haven't named yet, so we keep going until we either
+	// are done or no longer make any progress.
+	p := &pack{
+		r:       body,
+		offsets: make(map[hash]int64, len(offsets)),
+	}
+	for len(offsets) > 0 {
+		var pending []int64
+		for _, off := range offsets {
+			obj, err := p.objectAt(off, 0)
+			if errors.Is(err, errNotFound) {
+				pending = append(pending, off)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			p.offsets[obj.hash()] = off
+		}
+		if len(pending) == len(offsets) {
+			return nil, fmt.Errorf("%w: %d unresolvable deltas", errInvalidPack, len(pending))
+		}
+		offsets = pending
+	}
+
+	// Once named, the objects are read back from the pack as they're needed,
+	// rather than all of them being kept in memory.
+	p.cache = nil
+	return p, nil
+}
+
+// countingReader keeps track of the offset into the pack while scanning it.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// readIndex parses a version 2 pack index, and returns the offsets of all
+// objects in the corresponding pack.
+//
+// https://git-scm.com/docs/pack-format#_version_2_pack_idx_files_support_packs_larger_than_4_gib_and
+func readIndex(data []byte) (map[hash]int64, error) {
+	const headerLen = 8 + 256*4
+	if len(data) < headerLen || string(data[:4]) != "\377tOc" {
+		return nil, fmt.Errorf("%w: unsupported index", errInvalidPack)
+	}
+	if v := binary.BigEndian.Uint32(data[4:8]); v != 2 {
+		return nil, fmt.Errorf("%w: unsupported index version %d", errInvalidPack, v)
+	}
+
+	n := int(binary.BigEndian.Uint32(data[headerLen-4 : headerLen]))
+	var (
+		names   = headerLen
+		offsets = names + n*sha1.Size + n*4
+		large   = offsets + n*4
+	)
+	if len(data) < large {
+		return nil, fmt.Errorf("%w: truncated index", errInvalidPack)
+	}
+
+	m := make(map[hash]int64, n)
+	for i := range n {
+		var h hash
+		copy(h[:], data[names+i*sha1.Size:])
+
+		off := int64(binary.BigEndian.Uint32(data[offsets+i*4:]))
+		if off&0x80000000 != 0 {
+			idx := large + int(off&0x7fffffff)*8
+			if len(data) < idx+8 {
+				return nil, fmt.Errorf("%w: truncated index", errInvalidPack)
+			}
+			off = int64(binary.BigEndian.Uint64(data[idx:]))
+		}
+		m[h] = off
+	}
+	return m, nil
+}
+
+// readEntryHeader reads the type and (inflated) size of a pack entry.
+func readEntryHeader(r io.ByteReader) (objectType, int64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	typ := objectType(b >> 4 & 7)
+	size := int64(b & 0x0f)
+	for shift := 4; b&0x80 != 0; shift += 7 {
+		if shift > 56 {
+			return 0, 0, fmt.Errorf("%w: size overflow", errInvalidPack)
+		}
+		if b, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= int64(b&0x7f) << shift
+	}
+	return typ, size, nil
+}
+
+// readOffset reads the relative offset to the base of an ofs-delta, which
+// uses a slightly different variable length encoding than the sizes do.
+func readOffset(r io.ByteReader) (int64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	off := int64(b & 0x7f)
+	for b&0x80 != 0 {
+		if off > math.MaxInt64>>7 {
+			return 0, fmt.Errorf("%w: offset overflow", errInvalidPack)
+		}
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		off = (off+1)<<7 | int64(b&0x7f)
+	}
+	return off, nil
+}
+
+func inflate(r io.Reader, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("inflate: %w", err)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, min(size, 1<<20)))
+	if _, err := io.Copy(buf, zr); err != nil {
+		return nil, fmt.Errorf("inflate: %w", err)
+	}
+	if err := zr.Close(); err != nil {
+		return nil, fmt.Errorf("inflate: %w", err)
+	}
+	if int64(buf.Len()) != size {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", errInvalidPack, size, buf.Len())
+	}
+	return buf.Bytes(), nil
+}
+
+// applyDelta reconstructs an object from its base and a delta.
+//
+// https://git-scm.com/docs/pack-format#_deltified_representation
+func applyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	srcSize, err := readDeltaSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if srcSize != uint64(len(base)) {
+		return nil, fmt.Errorf("%w: base size mismatch", errInvalidDelta)
+	}
+	dstSize, err := readDeltaSize(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sizes come from the delta itself, so we don't trust them enough to
+	// allocate everything up front.
+	out := make([]byte, 0, min(dstSize, 1<<20))
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+
+		switch {
+		case op&0x80 != 0:
+			// Copy from the base, with the offset and size stored in the
+			// following bytes as indicated by the bits of the op.
+			var off, size uint64
+			for i := range 4 {
+				if op&(1<<i) != 0 {
+					b, err := r.ReadByte()
+					if err != nil {
+						return nil, fmt.Errorf("%w: truncated copy", errInvalidDelta)
+					}
+					off |= uint64(b) << (8 * i)
+				}
+			}
+			for i := range 3 {
+				if op&(0x10<<i) != 0 {
+					b, err := r.ReadByte()
+					if err != nil {
+						return nil, fmt.Errorf("%w: truncated copy", errInvalidDelta)
+					}
+					size |= uint64(b) << (8 * i)
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if off+size > uint64(len(base)) {
+				return nil, fmt.Errorf("%w: copy out of range", errInvalidDelta)
+			}
+			out = append(out, base[off:off+size]...)
+		case op != 0:
+			// Insert the next op bytes of the delta as is.
+			n := int(op)
+			if r.Len() < n {
+				return nil, fmt.Errorf("%w: truncated insert", errInvalidDelta)
+			}
+			b := make([]byte, n)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			out = append(out, b...)
+		default:
+			return nil, fmt.Errorf("%w: reserved instruction", errInvalidDelta)
+		}
+	}
+
+	if uint64(len(out)) != dstSize {
+		return nil, fmt.Errorf("%w: result size mismatch", errInvalidDelta)
+	}
+	return out, nil
+}
+
+func readDeltaSize(r io.ByteReader) (uint64, error) {
+	var size uint64
+	for shift := 0; ; shift += 7 {
+		if shift > 63 {
+			return 0, fmt.Errorf("%w: size overflow", errInvalidDelta)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("%w: truncated size", errInvalidDelta)
+		}
+		size |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return size, nil
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello, world")
+	delta := []byte{
+		12,             // base size
+		14,             // result size
+		0x80 | 0x10, 5, // copy 5 bytes from offset 0
+		3, ' ', 'm', 'y', // insert 3 bytes
+		0x80 | 0x01 | 0x10, 6, 6, // copy 6 bytes from offset 6
+	}
+
+	got, err := applyDelta(base, delta)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := "hello my world"; string(got) != exp {
+		t.Errorf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestApplyDelta_Invalid(t *testing.T) {
+	tests := map[string][]byte{
+		"base_size":    {3, 1, 1, 'x'},
+		"result_size":  {12, 5, 1, 'x'},
+		"out_of_range": {12, 5, 0x80 | 0x01 | 0x10, 10, 5},
+		"truncated":    {12, 5, 5, 'x'},
+		"reserved":     {12, 0, 0},
+	}
+	for name, delta := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := applyDelta([]byte("hello, world"), delta); !errors.Is(err, errInvalidDelta) {
+				t.Errorf("expected invalid delta error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadPktLine(t *testing.T) {
+	r := bytes.NewReader([]byte("000ahello\n00000004"))
+
+	line, err := readPktLine(r)
+	if err != nil || string(line) != "hello\n" {
+		t.Errorf("expected %q, got %q (%v)", "hello\n", line, err)
+	}
+	line, err = readPktLine(r)
+	if err != nil || line != nil {
+		t.Errorf("expected flush, got %q (%v)", line, err)
+	}
+	line, err = readPktLine(r)
+	if err != nil || line == nil || len(line) != 0 {
+		t.Errorf("expected empty line, got %q (%v)", line, err)
+	}
+}
+
+func TestReadPktLine_Invalid(t *testing.T) {
+	for _, s := range []string{"zzzz", "0002", "0009abc"} {
+		if _, err := readPktLine(bytes.NewReader([]byte(s))); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
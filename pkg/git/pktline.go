@@ -0,0 +1,53 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const maxPktLen = 65520
+
+// readPktLine reads a single pkt-line from the reader, and returns its
+// payload. A flush packet is returned as a nil slice, whereas an empty packet
+// is returned as an empty, non-nil, slice.
+//
+// https://git-scm.com/docs/protocol-common#_pkt_line_format
+func readPktLine(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", hdr)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n < 4 || n > maxPktLen {
+		return nil, fmt.Errorf("invalid pkt-line length %d", n)
+	}
+
+	b := make([]byte, n-4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("reading pkt-line: %w", err)
+	}
+	return b, nil
+}
+
+// writePktLine writes the string as a pkt-line to the buffer.
+func writePktLine(b *bytes.Buffer, s string) {
+	fmt.Fprintf(b, "%04x%s", len(s)+4, s)
+}
+
+// writeFlush writes a flush packet to the buffer.
+func writeFlush(b *bytes.Buffer) {
+	b.WriteString("0000")
+}
@@ -0,0 +1,291 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+var errPackTooLarge = errors.New("pack too large")
+
+const (
+	advertisementType = "application/x-git-upload-pack-advertisement"
+	requestType       = "application/x-git-upload-pack-request"
+	resultType        = "application/x-git-upload-pack-result"
+)
+
+// remote speaks the (stateless) smart HTTP protocol, version 0, with a git
+// server, which is the lowest common denominator of what's supported.
+//
+// https://git-scm.com/docs/http-protocol
+type remote struct {
+	client   HTTPClient
+	url      string
+	username string
+	token    string
+	maxSize  int64
+
+	caps []string
+}
+
+// refs lists all the refs advertised by the remote, including the peeled
+// `^{}` refs of annotated tags.
+func (r *remote) refs(ctx context.Context) (map[string]hash, error) {
+	url := r.url + "/info/refs?service=git-upload-pack"
+	body, err := r.do(ctx, http.MethodGet, url, "", nil, advertisementType)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			slog.Warn("error closing response body", "err", err)
+		}
+	}()
+
+	// The advertisement starts with a `# service=...` line, followed by a
+	// flush packet, before we get the actual refs.
+	line, err := readPktLine(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading advertisement: %w", err)
+	}
+	if !strings.HasPrefix(string(line), "# service=git-upload-pack") {
+		return nil, fmt.Errorf("unexpected advertisement: %q", line)
+	}
+	if line, err = readPktLine(body); err != nil || line != nil {
+		return nil, fmt.Errorf("unexpected advertisement: %q: %v", line, err)
+	}
+
+	refs := make(map[string]hash)
+	for first := true; ; first = false {
+		line, err := readPktLine(body)
+		if err != nil {
+			return nil, fmt.Errorf("reading advertisement: %w", err)
+		}
+		if line == nil {
+			break
+		}
+
+		s := strings.TrimSuffix(string(line), "\n")
+		if first {
+			// The capabilities are hidden behind a NUL byte of the first ref.
+			var caps string
+			s, caps, _ = strings.Cut(s, "\x00")
+			r.caps = strings.Fields(caps)
+		}
+
+		id, name, ok := strings.Cut(s, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid ref advertisement: %q", s)
+		}
+		if name == "capabilities^{}" {
+			// An empty repository only advertises its capabilities.
+			continue
+		}
+		h, err := parseHash(id)
+		if err != nil {
+			return nil, err
+		}
+		refs[name] = h
+	}
+	return refs, nil
+}
+
+// objects fetches a shallow pack containing the wanted object, and everything
+// reachable from it at depth one, i.e. the entire tree of the commit. Since
+// the remote doesn't support fetching a single directory, this will download
+// the content of the entire repository at that commit.
+func (r *remote) objects(ctx context.Context, want hash) (objectStore, error) {
+	var caps []string
+	for _, c := range []string{"ofs-delta", "side-band-64k", "no-progress"} {
+		if slices.Contains(r.caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	shallow := slices.Contains(r.caps, "shallow")
+
+	var req bytes.Buffer
+	writePktLine(&req, fmt.Sprintf("want %s %s\n", want, strings.Join(caps, " ")))
+	if shallow {
+		writePktLine(&req, "deepen 1\n")
+	}
+	writeFlush(&req)
+	writePktLine(&req, "done\n")
+
+	url := r.url + "/git-upload-pack"
+	body, err := r.do(ctx, http.MethodPost, url, requestType, &req, resultType)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			slog.Warn("error closing response body", "err", err)
+		}
+	}()
+
+	if shallow {
+		// The shallow-update section is terminated by a flush packet.
+		for {
+			line, err := readPktLine(body)
+			if err != nil {
+				return nil, fmt.Errorf("reading shallow update: %w", err)
+			}
+			if line == nil {
+				break
+			}
+		}
+	}
+
+	line, err := readPktLine(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading acknowledgement: %w", err)
+	}
+	if s := string(line); s != "NAK\n" && !strings.HasPrefix(s, "ACK ") {
+		return nil, fmt.Errorf("unexpected acknowledgement: %q", s)
+	}
+
+	// The pack holds the entire repository, so rather than keeping it in
+	// memory, it's spooled to disk, from where the objects are read as needed.
+	f, err := os.CreateTemp("", "pack-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating pack file: %w", err)
+	}
+	store := packFile{f: f}
+	store.pack, err = readPack(body, f, slices.Contains(caps, "side-band-64k"), r.maxSize)
+	if err != nil {
+		if err := store.Close(); err != nil {
+			slog.Warn("error closing pack file", "err", err)
+		}
+		return nil, err
+	}
+	return store, nil
+}
+
+// readPack writes the pack received from the remote to the file, refusing to
+// write more than limit bytes, unless it's zero, and then scans it.
+func readPack(r io.Reader, f *os.File, sideband bool, limit int64) (*pack, error) {
+	var w io.Writer = f
+	if limit > 0 {
+		w = &limitedWriter{w: f, n: limit}
+	}
+
+	var err error
+	if sideband {
+		err = demux(r, w)
+	} else {
+		_, err = io.Copy(w, r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading pack: %w", err)
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("reading pack: %w", err)
+	}
+	return scanPack(f, size)
+}
+
+func (r *remote) do(ctx context.Context, method, url, contentType string, body io.Reader, accept string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	req.Header.Add("Accept", accept)
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+	if r.token != "" {
+		req.SetBasicAuth(r.username, r.token)
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &backend.Error{
+			Code: res.StatusCode,
+			Msg:  backend.Slurp(res.Body),
+		}
+	}
+
+	// Servers only speaking the dumb protocol will happily serve the refs as
+	// plain text, which we don't support.
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, accept) {
+		_ = backend.Slurp(res.Body)
+		return nil, fmt.Errorf("unexpected content type %q, smart HTTP not supported?", ct)
+	}
+
+	return res.Body, nil
+}
+
+// demux writes the side-band multiplexed pack data to w, until the
+// terminating flush packet.
+func demux(r io.Reader, w io.Writer) error {
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return err
+		}
+		if line == nil {
+			return nil
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		switch line[0] {
+		case 1:
+			if _, err := w.Write(line[1:]); err != nil {
+				return err
+			}
+		case 2:
+			// Progress messages, which we don't care about.
+		case 3:
+			return fmt.Errorf("remote error: %s", strings.TrimSpace(string(line[1:])))
+		default:
+			return fmt.Errorf("unknown side-band %d", line[0])
+		}
+	}
+}
+
+// limitedWriter fails with errPackTooLarge once more than n bytes have been
+// written to it.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errPackTooLarge
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
+
+// packFile is a store of objects fetched from a remote, which are spooled to
+// a temporary file that's removed once the store is closed.
+type packFile struct {
+	*pack
+	f *os.File
+}
+
+func (p packFile) Close() error {
+	return errors.Join(p.f.Close(), os.Remove(p.f.Name()))
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// jwtLifetime is how long the JWTs we sign are valid, where GitHub allows
+	// at most ten minutes.
+	jwtLifetime = 9 * time.Minute
+
+	// jwtClockSkew is how far back we date the JWTs, to allow for some drift
+	// between our clock and GitHub's.
+	jwtClockSkew = time.Minute
+
+	// tokenRefreshMargin is how long before the expiry of an installation
+	// token that we refresh it, so that no request uses a token that expires
+	// while in flight.
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+type AppConfig struct {
+	ID             int64  `envconfig:"ID"`
+	PrivateKey     string `envconfig:"PRIVATE_KEY"`
+	PrivateKeyFile string `envconfig:"PRIVATE_KEY_FILE"`
+}
+
+func (c AppConfig) enabled() bool {
+	return c.ID != 0
+}
+
+// app authenticates as a GitHub App, by exchanging a JWT signed with the app's
+// private key for installation tokens. Since an app is installed per owner,
+// i.e. organization or user, the tokens are cached per owner and host.
+//
+// https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/about-authentication-with-a-github-app
+type app struct {
+	id  int64
+	key *rsa.PrivateKey
+	err error
+	now func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]*installationToken
+}
+
+// installationToken is the token of an owner, whose lock is held while it's
+// requested.
+type installationToken struct {
+	mu      sync.Mutex
+	id      int64
+	token   string
+	expires time.Time
+}
+
+func newApp(cfg AppConfig) *app {
+	a := &app{
+		id:     cfg.ID,
+		now:    time.Now,
+		tokens: make(map[string]*installationToken),
+	}
+
+	// The key is checked by NewTransport on startup, but we hold on to any
+	// error, and report it whenever we fail to get a token, should it not be.
+	a.key, a.err = parsePrivateKey(cfg)
+	return a
+}
+
+// token returns a valid installation token for the owner, either from the
+// cache or by requesting a new one.
+func (a *app) token(ctx context.Context, s *Service, api, owner string) (string, error) {
+	if a.err != nil {
+		return "", a.err
+	}
+
+	// We hold the lock of the owner while requesting new tokens, which
+	// avoids requesting the same token over and over again when it's
+	// expired, without holding up the other owners.
+	cached := a.installationToken(api + "/" + owner)
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+
+	if a.now().Add(tokenRefreshMargin).Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	jwt, err := a.jwt()
+	if err != nil {
+		return "", err
+	}
+
+	id := cached.id
+	if id == 0 {
+		if id, err = a.installation(ctx, s, api, jwt, owner); err != nil {
+			return "", err
+		}
+	}
+
+	uri := fmt.Sprintf("app/installations/%d/access_tokens", id)
+	body, err := s.do(ctx, http.MethodPost, api, uri, jwt, http.StatusCreated)
+	if err != nil {
+		// The app may have been reinstalled, so look up the installation
+		// again next time.
+		cached.id = 0
+		return "", fmt.Errorf("creating installation token: %w", err)
+	}
+
+	var res struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	err = json.NewDecoder(body).Decode(&res)
+	if cerr := body.Close(); cerr != nil {
+		return "", fmt.Errorf("closing response: %w", cerr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("decoding installation token: %w", err)
+	}
+
+	cached.id, cached.token, cached.expires = id, res.Token, res.ExpiresAt
+	return res.Token, nil
+}
+
+// installationToken returns the token of the owner, at the key, which is yet
+// to be requested if it's new.
+func (a *app) installationToken(key string) *installationToken {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	t, ok := a.tokens[key]
+	if !ok {
+		t = &installationToken{}
+		a.tokens[key] = t
+	}
+	return t
+}
+
+// installation looks up the ID of the app's installation for the owner, which
+// may be either an organization or a user.
+func (a *app) installation(ctx context.Context, s *Service, api, jwt, owner string) (int64, error) {
+	var errs []error
+	for _, uri := range []string{"orgs/%s/installation", "users/%s/installation"} {
+		body, err := s.do(ctx, http.MethodGet, api, fmt.Sprintf(uri, owner), jwt, http.StatusOK)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var res struct {
+			ID int64 `json:"id"`
+		}
+		err = json.NewDecoder(body).Decode(&res)
+		if cerr := body.Close(); cerr != nil {
+			return 0, fmt.Errorf("closing response: %w", cerr)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("decoding installation: %w", err)
+		}
+		return res.ID, nil
+	}
+	return 0, fmt.Errorf("finding installation for %s: %w", owner, errors.Join(errs...))
+}
+
+// jwt creates a JSON Web Token, signed with the private key of the app, which
+// is used to authenticate as the app itself.
+func (a *app) jwt() (string, error) {
+	now := a.now()
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-jwtClockSkew).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": fmt.Sprint(a.id),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing JWT: %w", err)
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+func parsePrivateKey(cfg AppConfig) (*rsa.PrivateKey, error) {
+	b := []byte(cfg.PrivateKey)
+	if cfg.PrivateKeyFile != "" {
+		var err error
+		if b, err = os.ReadFile(cfg.PrivateKeyFile); err != nil {
+			return nil, fmt.Errorf("reading app private key: %w", err)
+		}
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("app private key: no PEM data found")
+	}
+
+	// GitHub hands out PKCS #1 keys, but they are easily converted to PKCS #8
+	// on the way, so we'll accept both.
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing app private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("app private key: not an RSA key")
+	}
+	return rsaKey, nil
+}
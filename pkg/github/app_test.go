@@ -0,0 +1,236 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_AppToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var tokensIssued, installationLookups int
+
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			respond := func(code int, body string) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: code,
+					Body:       io.NopCloser(strings.NewReader(body)),
+				}, nil
+			}
+
+			switch {
+			case req.Method == http.MethodGet && req.URL.Path == "/orgs/test-user/installation":
+				installationLookups++
+				return respond(http.StatusNotFound, `{"message":"Not Found"}`)
+			case req.Method == http.MethodGet && req.URL.Path == "/users/test-user/installation":
+				if err := verifyJWT(&key.PublicKey, req, now); err != nil {
+					return respond(http.StatusUnauthorized, err.Error())
+				}
+				installationLookups++
+				return respond(http.StatusOK, `{"id":42}`)
+			case req.Method == http.MethodPost && req.URL.Path == "/app/installations/42/access_tokens":
+				if err := verifyJWT(&key.PublicKey, req, now); err != nil {
+					return respond(http.StatusUnauthorized, err.Error())
+				}
+				tokensIssued++
+				expires := now.Add(time.Hour).Format(time.RFC3339)
+				return respond(http.StatusCreated, fmt.Sprintf(`{"token":"token-%d","expires_at":"%s"}`, tokensIssued, expires))
+			case req.Method == http.MethodGet && req.URL.Path == "/repos/test-user/test-repo/git/matching-refs/tags/module/":
+				return respond(http.StatusOK, fmt.Sprintf(`[{"ref":"refs/tags/module/v1-%s"}]`, strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")))
+			}
+			return nil, errors.New("unexpected request: " + req.URL.String())
+		},
+	}
+
+	cfg := Config{
+		App: AppConfig{
+			ID:         1234,
+			PrivateKey: string(pemKey),
+		},
+	}
+	service := New(cfg, mockClient)
+	service.app.now = func() time.Time { return now }
+
+	listVersion := func(ctx context.Context) string {
+		t.Helper()
+		versions, err := service.ListVersions(ctx, "test-user", "test-repo", "module")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(versions) != 1 {
+			t.Fatalf("expected a single version, got %q", versions)
+		}
+		return versions[0]
+	}
+
+	if v := listVersion(context.Background()); v != "v1-token-1" {
+		t.Errorf("expected installation token to be used, got %q", v)
+	}
+
+	// The token should be cached until it's about to expire.
+	now = now.Add(50 * time.Minute)
+	if v := listVersion(context.Background()); v != "v1-token-1" {
+		t.Errorf("expected cached installation token to be used, got %q", v)
+	}
+
+	now = now.Add(6 * time.Minute)
+	if v := listVersion(context.Background()); v != "v1-token-2" {
+		t.Errorf("expected installation token to be refreshed, got %q", v)
+	}
+	if installationLookups != 2 {
+		t.Errorf("expected the installation to be looked up once, got %d lookups", installationLookups)
+	}
+}
+
+func TestService_AppToken_InvalidKey(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		App: AppConfig{
+			ID:         1234,
+			PrivateKey: "not a key",
+		},
+	}
+	service := New(cfg, mockClient)
+
+	_, err := service.ListVersions(context.Background(), "test-user", "test-repo", "module")
+	if err == nil || !strings.Contains(err.Error(), "app private key") {
+		t.Errorf("expected private key error, got %v", err)
+	}
+
+	// Which is found on startup.
+	if _, err := NewTransport(cfg); err == nil || !strings.Contains(err.Error(), "app private key") {
+		t.Errorf("expected private key error, got %v", err)
+	}
+}
+
+func TestService_AppToken_Owners(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	// The installation of the slow owner isn't found until we say so.
+	started, release := make(chan struct{}), make(chan struct{})
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			respond := func(code int, body string) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: code,
+					Body:       io.NopCloser(strings.NewReader(body)),
+				}, nil
+			}
+
+			switch req.URL.Path {
+			case "/orgs/slow-org/installation":
+				close(started)
+				<-release
+				return respond(http.StatusOK, `{"id":1}`)
+			case "/orgs/test-org/installation":
+				return respond(http.StatusOK, `{"id":2}`)
+			case "/app/installations/2/access_tokens":
+				return respond(http.StatusCreated, `{"token":"token","expires_at":"2100-01-01T00:00:00Z"}`)
+			}
+			return respond(http.StatusNotFound, `{"message":"Not Found"}`)
+		},
+	}
+	service := New(Config{App: AppConfig{ID: 1234, PrivateKey: string(pemKey)}}, mockClient)
+
+	slow := make(chan error)
+	go func() {
+		_, err := service.app.token(context.Background(), service, "https://api.github.com", "slow-org")
+		slow <- err
+	}()
+	<-started
+
+	// The slow owner doesn't hold up the others.
+	done := make(chan error)
+	go func() {
+		_, err := service.app.token(context.Background(), service, "https://api.github.com", "test-org")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the token without waiting for the slow owner")
+	}
+
+	close(release)
+	<-slow
+}
+
+func verifyJWT(pub *rsa.PublicKey, req *http.Request, now time.Time) error {
+	jwt, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return errors.New("missing bearer token")
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed JWT")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return err
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&claims); err != nil {
+		return err
+	}
+	if claims.Iss != "1234" {
+		return fmt.Errorf("unexpected issuer %q", claims.Iss)
+	}
+	if n := now.Unix(); claims.Iat > n || claims.Exp < n || claims.Exp-claims.Iat > 600 {
+		return errors.New("invalid JWT lifetime")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+// KeyValueStore is where the validators of responses are kept, together with
+// their bodies, so that they can be revalidated with conditional requests.
+type KeyValueStore interface {
+	Get(key string) ([]string, bool)
+	Set(key string, value []string, d ...time.Duration)
+}
+
+// WithETagStore enables conditional requests for the tag listings, using the
+// store to remember the responses. Since GitHub doesn't count 304 responses
+// against the rate limit, this makes cache misses cheap when nothing changed.
+//
+// https://docs.github.com/en/rest/using-the-rest-api/best-practices-for-using-the-rest-api#use-conditional-requests-if-appropriate
+func (s *Service) WithETagStore(store KeyValueStore) *Service {
+	s.etags = store
+	return s
+}
+
+// makeConditionalRequest is like makeRequest, but revalidates any previous
+// response to the same request, and reuses it if it's not modified.
+func (s *Service) makeConditionalRequest(ctx context.Context, api, owner, uri string) (io.ReadCloser, error) {
+	if s.etags == nil {
+		return s.makeRequest(ctx, api, owner, uri)
+	}
+
+	token, err := s.token(ctx, api, owner)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, api, uri, token)
+	if err != nil {
+		return nil, err
+	}
+
+	key := etagKey(token, req.URL.String())
+	cached, ok := s.etags.Get(key)
+	ok = ok && len(cached) == 3
+	if ok {
+		if cached[0] != "" {
+			req.Header.Set("If-None-Match", cached[0])
+		}
+		if cached[1] != "" {
+			req.Header.Set("If-Modified-Since", cached[1])
+		}
+	}
+
+	res, err := s.send(req, http.StatusOK, http.StatusNotModified)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotModified {
+		_ = backend.Slurp(res.Body)
+		if !ok {
+			return nil, &backend.Error{
+				Code: http.StatusBadGateway,
+				Msg:  "unexpected not modified response",
+			}
+		}
+		slog.Debug("reusing not modified response", "uri", uri)
+		return io.NopCloser(strings.NewReader(cached[2])), nil
+	}
+
+	etag, modified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if etag == "" && modified == "" {
+		return res.Body, nil
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if cerr := res.Body.Close(); cerr != nil {
+		return nil, fmt.Errorf("closing response: %w", cerr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	if s.cfg.ETagExpiration > 0 {
+		s.etags.Set(key, []string{etag, modified, string(b)}, s.cfg.ETagExpiration)
+	} else {
+		s.etags.Set(key, []string{etag, modified, string(b)})
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// etagKey returns the key of the stored response. Since the response depends
+// on who's asking, e.g. for private repositories, the key includes a hash of
+// the token, which we'd rather not keep around in plain text.
+func etagKey(token, url string) string {
+	return "github-etag-" + tokenID(token) + "-" + url
+}
+
+// tokenID returns a short hash identifying the token, without revealing it.
+func tokenID(token string) string {
+	if token == "" {
+		return "anonymous"
+	}
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:8])
+}
@@ -0,0 +1,84 @@
+package github
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/auth"
+)
+
+type mockKeyValueStore struct {
+	data map[string][]string
+}
+
+func (m *mockKeyValueStore) Get(key string) ([]string, bool) {
+	v, ok := m.data[key]
+	return v, ok
+}
+
+func (m *mockKeyValueStore) Set(key string, value []string, d ...time.Duration) {
+	m.data[key] = value
+}
+
+func TestService_ListVersions_ETag(t *testing.T) {
+	var (
+		body     = `[{"ref": "refs/tags/module/v1.0.0"}]`
+		etag     = `"v1"`
+		requests int
+	)
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			requests++
+			if inm := req.Header.Get("If-None-Match"); inm == etag {
+				return &http.Response{
+					StatusCode: http.StatusNotModified,
+					Body:       io.NopCloser(strings.NewReader("")),
+				}, nil
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Etag": []string{etag}},
+				Body:       io.NopCloser(strings.NewReader(body)),
+			}, nil
+		},
+	}
+
+	store := &mockKeyValueStore{data: make(map[string][]string)}
+	service := New(Config{}, mockClient).WithETagStore(store)
+
+	listVersions := func(ctx context.Context) []string {
+		t.Helper()
+		versions, err := service.ListVersions(ctx, "test-org", "test-repo", "module")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return versions
+	}
+
+	if v := listVersions(context.Background()); !slices.Equal(v, []string{"v1.0.0"}) {
+		t.Errorf("unexpected versions %q", v)
+	}
+	if len(store.data) != 1 {
+		t.Fatalf("expected the response to be stored, got %d entries", len(store.data))
+	}
+
+	// The upstream no longer returns the body, so we must be reusing it.
+	body = ""
+	if v := listVersions(context.Background()); !slices.Equal(v, []string{"v1.0.0"}) {
+		t.Errorf("expected not modified versions to be reused, got %q", v)
+	}
+
+	// Another token shouldn't see responses meant for someone else.
+	body, etag = `[{"ref": "refs/tags/module/v2.0.0"}]`, `"v2"`
+	if v := listVersions(auth.WithToken(context.Background(), "other")); !slices.Equal(v, []string{"v2.0.0"}) {
+		t.Errorf("expected versions to be fetched for another token, got %q", v)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
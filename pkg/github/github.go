@@ -5,31 +5,51 @@
 package github
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"regexp"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/reMarkable/orbit/pkg/archive"
 	"github.com/reMarkable/orbit/pkg/auth"
+	"github.com/reMarkable/orbit/pkg/internal/backend"
 )
 
 const (
+	defaultURL  = "https://api.github.com"
 	apiVersion  = "2022-11-28"
 	contentType = "application/vnd.github+json"
 	tagsPerPage = 100
 )
 
+var shaRe = regexp.MustCompile("^([0-9a-f]{40}|[0-9a-f]{64})$")
+
 type Config struct {
-	Repositories map[string][]string `envconfig:"REPOSITORIES"`
-	OrgMappings  map[string]string   `envconfig:"ORG_MAPPINGS"`
-	Token        string              `envconfig:"TOKEN"`
+	URL            string              `envconfig:"URL" default:"https://api.github.com"`
+	Hosts          map[string]string   `envconfig:"HOSTS"`
+	HostTokens     map[string]string   `envconfig:"HOST_TOKENS"`
+	CABundle       string              `envconfig:"CA_BUNDLE"`
+	Repositories   map[string][]string `envconfig:"REPOSITORIES"`
+	OrgMappings    map[string]string   `envconfig:"ORG_MAPPINGS"`
+	Token          string              `envconfig:"TOKEN"`
+	Classic        []string            `envconfig:"CLASSIC"`
+	TagTemplates   map[string]string   `envconfig:"TAG_TEMPLATES"`
+	PathTemplates  map[string]string   `envconfig:"PATH_TEMPLATES"`
+	Ignore         []string            `envconfig:"IGNORE"`
+	MaxFileSize    int64               `envconfig:"MAX_FILE_SIZE"`
+	MaxArchiveSize int64               `envconfig:"MAX_ARCHIVE_SIZE"`
+	ETagExpiration time.Duration       `envconfig:"ETAG_EXPIRATION" default:"24h"`
+	AssetTimeout   time.Duration       `envconfig:"ASSET_TIMEOUT" default:"5m"`
+	App            AppConfig           `envconfig:"APP_"`
 }
 
 type HTTPClient interface {
@@ -37,32 +57,109 @@ type HTTPClient interface {
 }
 
 func New(cfg Config, c HTTPClient) *Service {
-	return &Service{
+	s := &Service{
 		cfg:    cfg,
 		client: c,
+		assets: c,
+		limits: newRateLimits(),
+	}
+	if cfg.App.enabled() {
+		s.app = newApp(cfg.App)
 	}
+	return s
 }
 
 type Service struct {
 	cfg    Config
 	client HTTPClient
+	assets HTTPClient
+	app    *app
+	etags  KeyValueStore
+	limits *rateLimits
+
+	// assetIDs holds the IDs of the provider assets, as listed, which they're
+	// downloaded by.
+	assetIDs sync.Map
 }
 
-// https://docs.github.com/en/rest/repos/repos?apiVersion=2022-11-28#list-repository-tags
 func (s *Service) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
-	owner := s.mapOrg(system)
-	if err := s.validRepo(owner, repo); err != nil {
+	t, err := s.resolve(system, repo, module)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := s.matchingRefs(ctx, t)
+	var herr *backend.Error
+	if errors.As(err, &herr) && herr.Code == http.StatusNotFound {
+		// Older GitHub Enterprise Servers lack the endpoint, but a missing
+		// repository ends up here as well, which the fallback reports again.
+		slog.Debug("matching refs not found, falling back to listing tags", "owner", t.owner, "repo", t.repo)
+		return s.listTags(ctx, t)
+	}
+	return versions, err
+}
+
+// matchingRefs only fetches the tags of the module, by prefix, which saves us
+// from paging through every tag of the repository.
+//
+// https://docs.github.com/en/rest/git/refs?apiVersion=2022-11-28#list-matching-references
+func (s *Service) matchingRefs(ctx context.Context, t target) ([]string, error) {
+	uri := fmt.Sprintf("repos/%s/%s/git/matching-refs/tags/%s", t.owner, t.repo, t.layout.tagPrefix(t.module))
+	res, err := s.makeConditionalRequest(ctx, t.api, t.owner, uri)
+	if err != nil {
 		return nil, err
 	}
 
+	var refs []struct {
+		Ref string `json:"ref"`
+	}
+	err = json.NewDecoder(res).Decode(&refs)
+	cerr := res.Close()
+	if cerr != nil {
+		return nil, fmt.Errorf("closing response: %w", cerr)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	versions := []string{}
+	for _, ref := range refs {
+		if v, ok := t.layout.version(t.module, strings.TrimPrefix(ref.Ref, "refs/tags/")); ok {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+// listTags pages through all the tags of the repository, filtering out the
+// ones of the module.
+func (s *Service) listTags(ctx context.Context, t target) ([]string, error) {
+	tags, err := s.tags(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []string{}
+	for _, tag := range tags {
+		if v, ok := t.layout.version(t.module, tag); ok {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+// tags pages through all the tags of the repository.
+//
+// https://docs.github.com/en/rest/repos/repos?apiVersion=2022-11-28#list-repository-tags
+func (s *Service) tags(ctx context.Context, t target) ([]string, error) {
 	var (
-		page     = 1
-		prefix   = module + "/"
-		versions = []string{}
+		page  = 1
+		names []string
 	)
 	for {
-		uri := fmt.Sprintf("repos/%s/%s/tags?per_page=%d&page=%d", owner, repo, tagsPerPage, page)
-		res, err := s.makeRequest(ctx, uri)
+		uri := fmt.Sprintf("repos/%s/%s/tags?per_page=%d&page=%d", t.owner, t.repo, tagsPerPage, page)
+		res, err := s.makeConditionalRequest(ctx, t.api, t.owner, uri)
 		if err != nil {
 			return nil, err
 		}
@@ -81,9 +178,7 @@ func (s *Service) ListVersions(ctx context.Context, system, repo, module string)
 		}
 
 		for _, tag := range tags {
-			if strings.HasPrefix(tag.Name, prefix) {
-				versions = append(versions, strings.TrimPrefix(tag.Name, prefix))
-			}
+			names = append(names, tag.Name)
 		}
 
 		if len(tags) < tagsPerPage {
@@ -91,162 +186,242 @@ func (s *Service) ListVersions(ctx context.Context, system, repo, module string)
 		}
 		page++
 	}
-	return versions, nil
+	return names, nil
 }
 
 func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
-	owner := s.mapOrg(system)
-	if err := s.validRepo(owner, repo); err != nil {
+	t, err := s.resolve(system, repo, module)
+	if err != nil {
 		return err
 	}
+	return s.download(ctx, t, "refs/tags/"+t.layout.tagName(t.module, version), w)
+}
 
-	uri := fmt.Sprintf("repos/%s/%s/tarball/refs/tags/%s/%s", owner, repo, module, version)
-	body, err := s.makeRequest(ctx, uri)
+// ResolveCommit returns the SHA of the commit tagged with the version, with
+// annotated tags peeled.
+//
+// https://docs.github.com/en/rest/commits/commits?apiVersion=2022-11-28#get-a-commit
+func (s *Service) ResolveCommit(ctx context.Context, system, repo, module, version string) (string, error) {
+	t, err := s.resolve(system, repo, module)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer func() {
-		if err := body.Close(); err != nil {
-			slog.Warn("error closing response body", "err", err)
-		}
-	}()
-
-	zr, err := gzip.NewReader(body)
+	token, err := s.token(ctx, t.api, t.owner)
 	if err != nil {
-		return fmt.Errorf("read gzip: %w", err)
+		return "", err
 	}
-	defer func() {
-		if err := zr.Close(); err != nil {
-			slog.Warn("error closing gzip reader", "err", err)
-		}
-	}()
-
-	zw := gzip.NewWriter(w)
-	defer func() {
-		if err := zw.Close(); err != nil {
-			slog.Warn("error closing gzip writer:", "err", err)
-		}
-	}()
 
-	tr := tar.NewReader(zr)
-	tw := tar.NewWriter(zw)
-	defer func() {
-		if err := tw.Close(); err != nil {
-			slog.Warn("error closing tar writer:", "err", err)
-		}
-	}()
+	uri := fmt.Sprintf("repos/%s/%s/commits/tags/%s", t.owner, t.repo, t.layout.tagName(t.module, version))
+	req, err := s.newRequest(ctx, http.MethodGet, t.api, uri, token)
+	if err != nil {
+		return "", err
+	}
+	// With the SHA media type, the body is nothing but the SHA.
+	req.Header.Set("Accept", "application/vnd.github.sha")
+	res, err := s.send(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
 
-	prefix := fmt.Sprintf("^%s-%s-[^/]+/%s/(.+)", owner, repo, module)
-	if err := copy(prefix, tw, tr); err != nil {
-		return err
+	sha := strings.TrimSpace(backend.Slurp(res.Body))
+	if !shaRe.MatchString(sha) {
+		return "", fmt.Errorf("unexpected commit SHA: %q", sha)
 	}
-	return nil
+	return sha, nil
 }
 
-func (s *Service) makeRequest(ctx context.Context, uri string) (io.ReadCloser, error) {
-	url := fmt.Sprintf("https://api.github.com/%s", uri)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// DescribeVersion returns the URL of the repository of the module, and the
+// SHA and time of the commit tagged with the version.
+//
+// https://docs.github.com/en/rest/commits/commits?apiVersion=2022-11-28#get-a-commit
+func (s *Service) DescribeVersion(ctx context.Context, system, repo, module, version string) (string, string, time.Time, error) {
+	t, err := s.resolve(system, repo, module)
 	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
+		return "", "", time.Time{}, err
 	}
 
-	req.Header.Add("Accept", contentType)
-	req.Header.Add("X-GitHub-Api-Version", apiVersion)
+	uri := fmt.Sprintf("repos/%s/%s/commits/%s", t.owner, t.repo, t.layout.tagName(t.module, version))
+	res, err := s.makeConditionalRequest(ctx, t.api, t.owner, uri)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
 
-	if token := auth.GetToken(ctx, s.cfg.Token); token != "" {
-		req.Header.Add("Authorization", "Bearer "+token)
+	var commit struct {
+		SHA     string `json:"sha"`
+		HTMLURL string `json:"html_url"`
+		Commit  struct {
+			Committer struct {
+				Date time.Time `json:"date"`
+			} `json:"committer"`
+		} `json:"commit"`
+	}
+	err = json.NewDecoder(res).Decode(&commit)
+	cerr := res.Close()
+	if cerr != nil {
+		return "", "", time.Time{}, fmt.Errorf("closing response: %w", cerr)
 	}
 
-	res, err := s.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("executing request: %w", err)
+		return "", "", time.Time{}, fmt.Errorf("decoding response: %w", err)
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, &httpErr{
-			code: res.StatusCode,
-			msg:  slurp(res.Body),
-		}
+	// The commit is shown below the repository, wherever it's hosted.
+	source, _, _ := strings.Cut(commit.HTMLURL, "/commit/")
+	return source, commit.SHA, commit.Commit.Committer.Date, nil
+}
+
+// DownloadCommit downloads the module at the commit, rather than the tag of
+// the version.
+func (s *Service) DownloadCommit(ctx context.Context, system, repo, module, version, commit string, w io.Writer) error {
+	t, err := s.resolve(system, repo, module)
+	if err != nil {
+		return err
 	}
+	return s.download(ctx, t, commit, w)
+}
 
-	return res.Body, nil
+// download fetches the tarball of the repository at the ref, repacking the
+// module.
+func (s *Service) download(ctx context.Context, t target, ref string, w io.Writer) error {
+	uri := fmt.Sprintf("repos/%s/%s/tarball/%s", t.owner, t.repo, ref)
+	body, err := s.makeRequest(ctx, t.api, t.owner, uri)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			slog.Warn("error closing response body", "err", err)
+		}
+	}()
+
+	return archive.Repack(w, body, t.layout.archivePattern(t.owner, t.repo, t.module), archive.Options{
+		Ignore:      s.cfg.Ignore,
+		MaxFileSize: s.cfg.MaxFileSize,
+		MaxSize:     s.cfg.MaxArchiveSize,
+	})
 }
 
-func (s *Service) mapOrg(system string) string {
-	if owner, ok := s.cfg.OrgMappings[system]; ok {
-		return owner
+// makeRequest issues a request to the API on behalf of the owner.
+func (s *Service) makeRequest(ctx context.Context, api, owner, uri string) (io.ReadCloser, error) {
+	token, err := s.token(ctx, api, owner)
+	if err != nil {
+		return nil, err
 	}
-	return system
+	return s.do(ctx, http.MethodGet, api, uri, token, http.StatusOK)
 }
 
-func (s *Service) validRepo(owner, repo string) error {
-	if len(s.cfg.Repositories) == 0 {
-		return nil
+// token returns the token to use for requests on behalf of the owner. The
+// token of the client takes precedence, and otherwise we fall back to either
+// the token of the GitHub App installation, or the configured one. Those are
+// only ever sent to the default API, while the other hosts get their own
+// tokens, so that no credentials leak between github.com and an enterprise
+// server.
+func (s *Service) token(ctx context.Context, api, owner string) (string, error) {
+	if token := auth.GetToken(ctx, ""); token != "" {
+		return token, nil
+	}
+	if api != s.defaultAPI() {
+		return s.hostToken(api), nil
+	}
+	if s.app == nil {
+		return s.cfg.Token, nil
 	}
 
-	if repos, ok := s.cfg.Repositories[owner]; ok {
-		if slices.Contains(repos, repo) {
-			return nil
-		}
+	token, err := s.app.token(ctx, s, api, owner)
+	if err != nil {
+		return "", fmt.Errorf("app token: %w", err)
 	}
+	return token, nil
+}
 
-	return &httpErr{
-		code: http.StatusForbidden,
-		msg:  "not a valid repository",
+func (s *Service) do(ctx context.Context, method, api, uri, token string, expStatus int) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, method, api, uri, token)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.send(req, expStatus)
+	if err != nil {
+		return nil, err
 	}
+	return res.Body, nil
 }
 
-func copy(prefix string, w *tar.Writer, r *tar.Reader) error {
-	re, err := regexp.Compile(prefix)
+func (s *Service) newRequest(ctx context.Context, method, api, uri, token string) (*http.Request, error) {
+	url := fmt.Sprintf("%s/%s", api, uri)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
-		return fmt.Errorf("compile prefix regexp: %w", err)
+		return nil, fmt.Errorf("new request: %w", err)
 	}
 
-	for {
-		hdr, err := r.Next()
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			return fmt.Errorf("reading tar: %w", err)
-		}
+	req.Header.Add("Accept", contentType)
+	req.Header.Add("X-GitHub-Api-Version", apiVersion)
 
-		match := re.FindStringSubmatch(hdr.Name)
-		if len(match) == 2 {
-			hdr.Name = match[1]
-			if err := w.WriteHeader(hdr); err != nil {
-				return fmt.Errorf("writing header: %w", err)
-			}
-			if _, err := io.Copy(w, r); err != nil {
-				slog.Error("error copying tar entry", "name", hdr.Name, "err", err)
-			}
-		}
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
 	}
+	return req, nil
 }
 
-func slurp(r io.ReadCloser) string {
-	defer func() {
-		if err := r.Close(); err != nil {
-			slog.Warn("error closing response body", "err", err)
-		}
-	}()
+// send executes the request, turning any response without one of the expected
+// status codes into an error. Requests are held back while the rate limit is
+// exhausted, in which case the error tells when to retry.
+func (s *Service) send(req *http.Request, expStatus ...int) (*http.Response, error) {
+	return s.sendWith(s.client, req, expStatus...)
+}
+
+// sendWith is like send, but with another client.
+func (s *Service) sendWith(c HTTPClient, req *http.Request, expStatus ...int) (*http.Response, error) {
+	if d := s.limits.wait(req); d > 0 {
+		return nil, rateLimited(d)
+	}
 
-	b, err := io.ReadAll(r)
+	res, err := c.Do(req)
 	if err != nil {
-		return err.Error()
+		return nil, fmt.Errorf("executing request: %w", err)
 	}
-	return string(b)
+
+	wait := s.limits.update(req, res)
+	if !slices.Contains(expStatus, res.StatusCode) {
+		if wait > 0 && (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests) {
+			_ = backend.Slurp(res.Body)
+			return nil, rateLimited(wait)
+		}
+		return nil, &backend.Error{
+			Code: res.StatusCode,
+			Msg:  backend.Slurp(res.Body),
+		}
+	}
+
+	return res, nil
 }
 
-type httpErr struct {
-	code int
-	msg  string
+// apiURL returns the base URL of the API serving the system, which allows for
+// mixing organizations on github.com with ones on GitHub Enterprise Server.
+func (s *Service) apiURL(system string) string {
+	if api, ok := s.cfg.Hosts[system]; ok {
+		return strings.TrimSuffix(api, "/")
+	}
+	return s.defaultAPI()
 }
 
-func (e *httpErr) Error() string {
-	return e.msg
+func (s *Service) defaultAPI() string {
+	if s.cfg.URL == "" {
+		return defaultURL
+	}
+	return strings.TrimSuffix(s.cfg.URL, "/")
 }
 
-func (e *httpErr) StatusCode() int {
-	return e.code
+// hostToken returns the token configured for the systems served by the API,
+// of the first one, in order, should they have different ones.
+func (s *Service) hostToken(api string) string {
+	systems := slices.Sorted(maps.Keys(s.cfg.Hosts))
+	for _, system := range systems {
+		if strings.TrimSuffix(s.cfg.Hosts[system], "/") != api {
+			continue
+		}
+		if token := s.cfg.HostTokens[system]; token != "" {
+			return token
+		}
+	}
+	return ""
 }
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"testing"
+	"time"
 )
 
 type mockHTTPClient struct {
@@ -22,6 +23,50 @@ func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
 func TestService_ListVersions(t *testing.T) {
 	mockClient := &mockHTTPClient{
 		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/repos/test-org/test-repo/git/matching-refs/tags/module/" {
+				body := `[
+					{"ref": "refs/tags/module/v1.0.0"},
+					{"ref": "refs/tags/module/v1.1.0"}
+				]`
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+				}, nil
+			}
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		OrgMappings: map[string]string{"test-system": "test-org"},
+	}
+	service := New(cfg, mockClient)
+
+	versions, err := service.ListVersions(context.Background(), "test-system", "test-repo", "module")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"v1.0.0", "v1.1.0"}
+	if len(versions) != len(expected) {
+		t.Fatalf("expected %d versions, got %d", len(expected), len(versions))
+	}
+	for i, v := range versions {
+		if v != expected[i] {
+			t.Errorf("expected version %q, got %q", expected[i], v)
+		}
+	}
+}
+
+func TestService_ListVersions_Fallback(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/repos/test-org/test-repo/git/matching-refs/tags/module/" {
+				return &http.Response{
+					StatusCode: http.StatusNotFound,
+					Body:       io.NopCloser(bytes.NewReader([]byte(`{"message": "Not Found"}`))),
+				}, nil
+			}
 			if req.URL.Path == "/repos/test-org/test-repo/tags" {
 				body := `[
 					{"name": "module/v1.0.0"},
@@ -126,3 +171,107 @@ func TestService_ProxyDownload(t *testing.T) {
 		t.Errorf("expected tarball to contain %q, but it was %q", expectedContent, tarBuf.Bytes())
 	}
 }
+
+func TestService_ResolveCommit(t *testing.T) {
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/repos/test-org/test-repo/commits/tags/module/v1.0.0" {
+				if accept := req.Header.Get("Accept"); accept != "application/vnd.github.sha" {
+					t.Errorf("unexpected Accept header: %s", accept)
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewReader([]byte(sha))),
+				}, nil
+			}
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		OrgMappings: map[string]string{"test-system": "test-org"},
+	}
+	service := New(cfg, mockClient)
+
+	got, err := service.ResolveCommit(context.Background(), "test-system", "test-repo", "module", "v1.0.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != sha {
+		t.Errorf("expected commit %q, got %q", sha, got)
+	}
+}
+
+func TestService_DownloadCommit(t *testing.T) {
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/repos/test-org/test-repo/tarball/"+sha {
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				tw := tar.NewWriter(gz)
+				_ = tw.WriteHeader(&tar.Header{Name: "test-org-test-repo-0123456/module/main.tf", Mode: 0644, Size: 11})
+				_, _ = tw.Write([]byte("resource {}"))
+				_ = tw.Close()
+				_ = gz.Close()
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(&buf),
+				}, nil
+			}
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		OrgMappings: map[string]string{"test-system": "test-org"},
+	}
+	service := New(cfg, mockClient)
+
+	var buf bytes.Buffer
+	if err := service.DownloadCommit(context.Background(), "test-system", "test-repo", "module", "v1.0.0", sha, &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.Len() == 0 {
+		t.Error("expected an archive")
+	}
+}
+
+func TestService_DescribeVersion(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/repos/test-org/test-repo/commits/module/v1.0.0" {
+				body := `{
+					"sha": "0123456789abcdef0123456789abcdef01234567",
+					"html_url": "https://github.com/test-org/test-repo/commit/0123456789abcdef0123456789abcdef01234567",
+					"commit": {"committer": {"date": "2024-01-02T03:04:05Z"}}
+				}`
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+				}, nil
+			}
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		OrgMappings: map[string]string{"test-system": "test-org"},
+	}
+	service := New(cfg, mockClient)
+
+	source, commit, published, err := service.DescribeVersion(context.Background(), "test-system", "test-repo", "module", "v1.0.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if source != "https://github.com/test-org/test-repo" {
+		t.Errorf("unexpected source %q", source)
+	}
+	if commit != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("unexpected commit %q", commit)
+	}
+	if exp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); !published.Equal(exp) {
+		t.Errorf("expected %s, got %s", exp, published)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+const (
+	defaultTagTemplate  = "{module}/{version}"
+	defaultPathTemplate = "{module}"
+
+	// The classic repositories have a single module at their root, released
+	// with plain version tags.
+	classicTagTemplate  = "{version}"
+	classicPathTemplate = ""
+)
+
+// versionRe is what the start of a version looks like, which keeps modules
+// sharing a prefix apart, e.g. the `foo-bar-v1.0.0` tag isn't a release of
+// `foo`, with the tag template `{module}-{version}`.
+var versionRe = regexp.MustCompile(`^v?[0-9]`)
+
+// target is what a request for a module resolves to: the repository on a
+// host, the module in it, and how the repository is laid out.
+type target struct {
+	api    string
+	owner  string
+	repo   string
+	module string
+	layout layout
+}
+
+// resolve returns the target of a request for a module. Usually, the system
+// is the owner, and the namespace is a mono-repo holding the module. For the
+// classic namespaces, however, the namespace is the owner, and each module
+// lives in its own repository, named `terraform-<system>-<name>` after the
+// convention of the public registry.
+func (s *Service) resolve(system, namespace, name string) (target, error) {
+	t := target{
+		api:    s.apiURL(system),
+		owner:  backend.MapOrg(s.cfg.OrgMappings, system),
+		repo:   namespace,
+		module: name,
+	}
+	classic := slices.Contains(s.cfg.Classic, namespace)
+	if classic {
+		t.api = s.apiURL(namespace)
+		t.owner = backend.MapOrg(s.cfg.OrgMappings, namespace)
+		t.repo = fmt.Sprintf("terraform-%s-%s", system, name)
+	}
+	if err := backend.ValidRepo(s.cfg.Repositories, t.owner, t.repo); err != nil {
+		return target{}, err
+	}
+
+	var err error
+	t.layout, err = s.layout(t.owner, t.repo, classic)
+	return t, err
+}
+
+// layout is how the modules of a repository are tagged and laid out, given by
+// templates where `{module}` is replaced by the name of the module, and
+// `{version}` by its version.
+type layout struct {
+	tag  string
+	path string
+}
+
+// layout returns the layout of the repository, configured either for the
+// repository itself, as `owner/repo`, or for all the repositories of the
+// owner. Anything not configured falls back to the defaults, i.e. tags like
+// `module/vX.Y.Z` of modules at the root of the repository, or the whole
+// repository being the module, for the classic ones.
+func (s *Service) layout(owner, repo string, classic bool) (layout, error) {
+	l := layout{
+		tag:  defaultTagTemplate,
+		path: defaultPathTemplate,
+	}
+	if classic {
+		l.tag, l.path = classicTagTemplate, classicPathTemplate
+	}
+	for _, key := range []string{owner, owner + "/" + repo} {
+		if t, ok := s.cfg.TagTemplates[key]; ok {
+			l.tag = t
+		}
+		if t, ok := s.cfg.PathTemplates[key]; ok {
+			l.path = t
+		}
+	}
+
+	if strings.Count(l.tag, "{version}") != 1 {
+		return layout{}, fmt.Errorf("tag template %q must contain {version} exactly once", l.tag)
+	}
+	return l, nil
+}
+
+// tagName returns the name of the tag of the module version.
+func (l layout) tagName(module, version string) string {
+	return strings.NewReplacer("{module}", module, "{version}", version).Replace(l.tag)
+}
+
+// tagPrefix returns the part of the tag names of the module that precede the
+// version, which is what we can search for.
+func (l layout) tagPrefix(module string) string {
+	prefix, _, _ := strings.Cut(l.tag, "{version}")
+	return strings.ReplaceAll(prefix, "{module}", module)
+}
+
+// version returns the version of the tag, if it's a tag of the module.
+func (l layout) version(module, tag string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(l.tag, "{version}")
+	prefix = strings.ReplaceAll(prefix, "{module}", module)
+	suffix = strings.ReplaceAll(suffix, "{module}", module)
+
+	if !strings.HasPrefix(tag, prefix) || !strings.HasSuffix(tag, suffix) || len(tag) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	version := tag[len(prefix) : len(tag)-len(suffix)]
+	if !versionRe.MatchString(version) {
+		return "", false
+	}
+	return version, true
+}
+
+// archivePattern returns the pattern of the files of the module in the
+// tarball of the repository, whose content is placed below a directory named
+// after the repository and the commit.
+func (l layout) archivePattern(owner, repo, module string) string {
+	dir := strings.Trim(strings.ReplaceAll(l.path, "{module}", module), "/")
+	if dir == "" {
+		return fmt.Sprintf("^%s-%s-[^/]+/(.+)", regexp.QuoteMeta(owner), regexp.QuoteMeta(repo))
+	}
+	return fmt.Sprintf("^%s-%s-[^/]+/%s/(.+)", regexp.QuoteMeta(owner), regexp.QuoteMeta(repo), regexp.QuoteMeta(dir))
+}
+
+// moduleNamePattern is what the names of modules look like, as given by the
+// registry protocol.
+const moduleNamePattern = "[0-9A-Za-z_-]+"
+
+// modules returns the versions of each of the modules found among the tags.
+// The tags are only told apart by the name of the module, so there are none
+// unless the tag template holds it.
+func (l layout) modules(tags []string) map[string][]string {
+	var (
+		quoted      = regexp.QuoteMeta(l.tag)
+		placeholder = regexp.QuoteMeta("{module}")
+	)
+	if !strings.Contains(quoted, placeholder) {
+		return nil
+	}
+	// Go regexps lack backreferences, so only the first name is captured, and
+	// the version tells whether the rest match.
+	pattern := strings.Replace(quoted, placeholder, "("+moduleNamePattern+")", 1)
+	pattern = strings.ReplaceAll(pattern, placeholder, moduleNamePattern)
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{version}"), "[^/]+")
+	re := regexp.MustCompile("^" + pattern + "$")
+
+	modules := map[string][]string{}
+	for _, tag := range tags {
+		m := re.FindStringSubmatch(tag)
+		if m == nil {
+			continue
+		}
+		if v, ok := l.version(m[1], tag); ok {
+			modules[m[1]] = append(modules[m[1]], v)
+		}
+	}
+	return modules
+}
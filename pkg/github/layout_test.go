@@ -0,0 +1,259 @@
+package github
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLayout_Version(t *testing.T) {
+	tests := []struct {
+		tag     string
+		tagName string
+		version string
+		ok      bool
+	}{
+		{"{module}/{version}", "foo/v1.0.0", "v1.0.0", true},
+		{"{module}/{version}", "bar/v1.0.0", "", false},
+		{"{module}-{version}", "foo-v1.2.3", "v1.2.3", true},
+		{"{module}-{version}", "foo-bar-v1.2.3", "", false},
+		{"{module}-v{version}", "foo-v1.2.3", "1.2.3", true},
+		{"release/{version}/{module}", "release/1.0.0/foo", "1.0.0", true},
+		{"release/{version}/{module}", "release/1.0.0/bar", "", false},
+		{"{module}/{version}", "foo/", "", false},
+	}
+	for _, tt := range tests {
+		l := layout{tag: tt.tag}
+		version, ok := l.version("foo", tt.tagName)
+		if version != tt.version || ok != tt.ok {
+			t.Errorf("%s: expected %q (%t) for %s, got %q (%t)", tt.tag, tt.version, tt.ok, tt.tagName, version, ok)
+		}
+		if ok && l.tagName("foo", version) != tt.tagName {
+			t.Errorf("%s: expected tag %s, got %s", tt.tag, tt.tagName, l.tagName("foo", version))
+		}
+	}
+}
+
+func TestService_Layout(t *testing.T) {
+	cfg := Config{
+		TagTemplates: map[string]string{
+			"test-org":           "{module}-{version}",
+			"test-org/test-repo": "{module}@{version}",
+			"bad-org":            "{module}",
+		},
+		PathTemplates: map[string]string{
+			"test-org": "modules/{module}",
+		},
+	}
+	service := New(cfg, nil)
+
+	tests := map[string]layout{
+		"test-org/test-repo":  {tag: "{module}@{version}", path: "modules/{module}"},
+		"test-org/other-repo": {tag: "{module}-{version}", path: "modules/{module}"},
+		"other-org/test-repo": {tag: defaultTagTemplate, path: defaultPathTemplate},
+	}
+	for name, expected := range tests {
+		owner, repo, _ := strings.Cut(name, "/")
+		l, err := service.layout(owner, repo, false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if l != expected {
+			t.Errorf("%s: expected %+v, got %+v", name, expected, l)
+		}
+	}
+
+	if _, err := service.layout("bad-org", "test-repo", false); err == nil {
+		t.Error("expected an error for a tag template without a version")
+	}
+}
+
+func TestService_Templates(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			switch req.URL.Path {
+			case "/repos/test-org/test-repo/git/matching-refs/tags/module-":
+				body := `[
+					{"ref": "refs/tags/module-v1.0.0"},
+					{"ref": "refs/tags/module-v1.1.0"},
+					{"ref": "refs/tags/module-extra-v2.0.0"}
+				]`
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(body)),
+				}, nil
+			case "/repos/test-org/test-repo/tarball/refs/tags/module-v1.0.0":
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				tw := tar.NewWriter(gz)
+				for name, content := range map[string]string{
+					"test-org-test-repo-abc123/modules/module/main.tf": "# module",
+					"test-org-test-repo-abc123/module/main.tf":         "# elsewhere",
+				} {
+					hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}
+					if err := tw.WriteHeader(hdr); err != nil {
+						return nil, err
+					}
+					if _, err := tw.Write([]byte(content)); err != nil {
+						return nil, err
+					}
+				}
+				_ = tw.Close()
+				_ = gz.Close()
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(&buf),
+				}, nil
+			}
+			return nil, errors.New("unexpected request: " + req.URL.Path)
+		},
+	}
+
+	cfg := Config{
+		TagTemplates:  map[string]string{"test-org/test-repo": "{module}-{version}"},
+		PathTemplates: map[string]string{"test-org/test-repo": "modules/{module}"},
+	}
+	service := New(cfg, mockClient)
+
+	versions, err := service.ListVersions(context.Background(), "test-org", "test-repo", "module")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"v1.0.0", "v1.1.0"}; !slices.Equal(versions, expected) {
+		t.Errorf("expected versions %q, got %q", expected, versions)
+	}
+
+	var buf bytes.Buffer
+	if err := service.ProxyDownload(context.Background(), "test-org", "test-repo", "module", "v1.0.0", &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("reading gzip: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if expected := []string{"main.tf"}; !slices.Equal(names, expected) {
+		t.Errorf("expected entries %q, got %q", expected, names)
+	}
+}
+
+func TestService_Classic(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			switch req.URL.Path {
+			case "/repos/test-org/terraform-aws-vpc/git/matching-refs/tags/":
+				body := `[
+					{"ref": "refs/tags/v1.0.0"},
+					{"ref": "refs/tags/v1.1.0"},
+					{"ref": "refs/tags/latest"}
+				]`
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(body)),
+				}, nil
+			case "/repos/test-org/terraform-aws-vpc/tarball/refs/tags/v1.0.0":
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				tw := tar.NewWriter(gz)
+				for _, hdr := range []*tar.Header{
+					{Name: "test-org-terraform-aws-vpc-abc123/", Typeflag: tar.TypeDir, Mode: 0o755},
+					{Name: "test-org-terraform-aws-vpc-abc123/main.tf", Mode: 0o644},
+					{Name: "test-org-terraform-aws-vpc-abc123/modules/subnet/main.tf", Mode: 0o644},
+				} {
+					if err := tw.WriteHeader(hdr); err != nil {
+						return nil, err
+					}
+				}
+				_ = tw.Close()
+				_ = gz.Close()
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(&buf),
+				}, nil
+			}
+			return nil, errors.New("unexpected request: " + req.URL.Path)
+		},
+	}
+
+	cfg := Config{
+		Classic:     []string{"test-namespace"},
+		OrgMappings: map[string]string{"test-namespace": "test-org"},
+	}
+	service := New(cfg, mockClient)
+
+	versions, err := service.ListVersions(context.Background(), "aws", "test-namespace", "vpc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"v1.0.0", "v1.1.0"}; !slices.Equal(versions, expected) {
+		t.Errorf("expected versions %q, got %q", expected, versions)
+	}
+
+	var buf bytes.Buffer
+	if err := service.ProxyDownload(context.Background(), "aws", "test-namespace", "vpc", "v1.0.0", &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("reading gzip: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if expected := []string{"main.tf", "modules/subnet/main.tf"}; !slices.Equal(names, expected) {
+		t.Errorf("expected entries %q, got %q", expected, names)
+	}
+}
+
+func TestLayout_Modules(t *testing.T) {
+	tags := []string{"foo/v1.0.0", "foo/v1.1.0", "foo-bar/v0.1.0", "latest", "foo/", "release/1.0.0/foo"}
+	tests := []struct {
+		tag      string
+		expected map[string][]string
+	}{
+		{"{module}/{version}", map[string][]string{"foo": {"v1.0.0", "v1.1.0"}, "foo-bar": {"v0.1.0"}}},
+		{"release/{version}/{module}", map[string][]string{"foo": {"1.0.0"}}},
+		{"{version}", nil},
+	}
+	for _, tt := range tests {
+		got := layout{tag: tt.tag}.modules(tags)
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.tag, tt.expected, got)
+			continue
+		}
+		for module, versions := range tt.expected {
+			if !slices.Equal(got[module], versions) {
+				t.Errorf("%s: expected %v for %s, got %v", tt.tag, versions, module, got[module])
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+// classicRepoRe matches the names of the classic repositories, after the
+// convention of the public registry.
+var classicRepoRe = regexp.MustCompile("^terraform-([0-9a-z]+)-(" + moduleNamePattern + ")$")
+
+// ListModules returns every version of the modules of the allowed
+// repositories, as `namespace/name/system/version`. The modules of the
+// mono-repos are found by their tags, while the classic repositories are
+// modules of their own.
+func (s *Service) ListModules(ctx context.Context) ([]string, error) {
+	if len(s.cfg.Repositories) == 0 {
+		return nil, &backend.Error{
+			Code: http.StatusNotImplemented,
+			Msg:  "listing modules requires allowed repositories",
+		}
+	}
+
+	modules := []string{}
+	for _, owner := range slices.Sorted(maps.Keys(s.cfg.Repositories)) {
+		for _, repo := range s.cfg.Repositories[owner] {
+			found, err := s.repoModules(ctx, owner, repo)
+			var herr *backend.Error
+			if errors.As(err, &herr) && herr.Code == http.StatusNotFound {
+				// A repository that's gone shouldn't hide all the others.
+				slog.Warn("allowed repository not found", "owner", owner, "repo", repo)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("listing modules of %s/%s: %w", owner, repo, err)
+			}
+			modules = append(modules, found...)
+		}
+	}
+	return modules, nil
+}
+
+// repoModules returns every version of the modules of the repository.
+func (s *Service) repoModules(ctx context.Context, owner, repo string) ([]string, error) {
+	if namespace, system, name, ok := s.classic(owner, repo); ok {
+		versions, err := s.ListVersions(ctx, system, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		return addresses(namespace, name, system, versions), nil
+	}
+
+	system, ok := s.system(owner)
+	if !ok {
+		return nil, nil
+	}
+	t, err := s.resolve(system, repo, "")
+	if err != nil {
+		return nil, err
+	}
+	tags, err := s.tags(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	for module, versions := range t.layout.modules(tags) {
+		found = append(found, addresses(repo, module, system, versions)...)
+	}
+	return found, nil
+}
+
+// classic returns the namespace, system and name of the module, if the
+// repository is one of the classic ones.
+func (s *Service) classic(owner, repo string) (string, string, string, bool) {
+	m := classicRepoRe.FindStringSubmatch(repo)
+	if m == nil {
+		return "", "", "", false
+	}
+	for _, namespace := range s.cfg.Classic {
+		if backend.MapOrg(s.cfg.OrgMappings, namespace) == owner {
+			return namespace, m[1], m[2], true
+		}
+	}
+	return "", "", "", false
+}
+
+// system returns the system of the owner, which is the owner itself unless
+// it's mapped to another one, in which case it's the first system mapped to
+// the owner, if any.
+func (s *Service) system(owner string) (string, bool) {
+	if backend.MapOrg(s.cfg.OrgMappings, owner) == owner {
+		return owner, true
+	}
+	for _, system := range slices.Sorted(maps.Keys(s.cfg.OrgMappings)) {
+		if s.cfg.OrgMappings[system] == owner {
+			return system, true
+		}
+	}
+	return "", false
+}
+
+func addresses(namespace, name, system string, versions []string) []string {
+	found := make([]string, len(versions))
+	for n, v := range versions {
+		found[n] = strings.Join([]string{namespace, name, system, v}, "/")
+	}
+	return found
+}
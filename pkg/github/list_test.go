@@ -0,0 +1,71 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestService_ListModules(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			var body string
+			switch req.URL.Path {
+			case "/repos/test-org/infra/tags":
+				body = `[
+					{"name": "vpc/v1.0.0"},
+					{"name": "vpc/v1.1.0"},
+					{"name": "dns/v0.1.0"},
+					{"name": "latest"}
+				]`
+			case "/repos/test-org/terraform-aws-bucket/git/matching-refs/tags/":
+				body = `[{"ref": "refs/tags/v2.0.0"}]`
+			case "/repos/test-org/gone/tags":
+				return &http.Response{
+					StatusCode: http.StatusNotFound,
+					Body:       io.NopCloser(bytes.NewReader([]byte(`{"message": "Not Found"}`))),
+				}, nil
+			default:
+				return nil, errors.New("unexpected request")
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+			}, nil
+		},
+	}
+
+	cfg := Config{
+		Repositories: map[string][]string{"test-org": {"infra", "terraform-aws-bucket", "gone"}},
+		OrgMappings:  map[string]string{"test-system": "test-org", "classic": "test-org"},
+		Classic:      []string{"classic"},
+	}
+	service := New(cfg, mockClient)
+
+	modules, err := service.ListModules(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	slices.Sort(modules)
+	expected := []string{
+		"classic/bucket/aws/v2.0.0",
+		"infra/dns/test-org/v0.1.0",
+		"infra/vpc/test-org/v1.0.0",
+		"infra/vpc/test-org/v1.1.0",
+	}
+	if !slices.Equal(modules, expected) {
+		t.Errorf("expected %v, got %v", expected, modules)
+	}
+}
+
+func TestService_ListModules_NoRepositories(t *testing.T) {
+	service := New(Config{}, &mockHTTPClient{})
+	if _, err := service.ListModules(context.Background()); err == nil {
+		t.Error("expected an error")
+	}
+}
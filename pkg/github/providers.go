@@ -0,0 +1,156 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+const releasesPerPage = 100
+
+type release struct {
+	TagName string `json:"tag_name"`
+	Draft   bool   `json:"draft"`
+	Assets  []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	} `json:"assets"`
+}
+
+// WithAssetClient has the provider assets downloaded by the client, which needs
+// a longer timeout than the rest, since the packages are much larger.
+func (s *Service) WithAssetClient(c HTTPClient) *Service {
+	s.assets = c
+	return s
+}
+
+// ProviderAssets returns the assets of the releases of the provider, as
+// `tag/asset`, leaving out the drafts. The providers are released in
+// repositories named `terraform-provider-<type>`, owned by the namespace,
+// after the convention of the public registry.
+//
+// https://docs.github.com/en/rest/releases/releases?apiVersion=2022-11-28#list-releases
+func (s *Service) ProviderAssets(ctx context.Context, namespace, typ string) ([]string, error) {
+	api, owner, repo, err := s.provider(namespace, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		page   = 1
+		assets = []string{}
+	)
+	for {
+		uri := fmt.Sprintf("repos/%s/%s/releases?per_page=%d&page=%d", owner, repo, releasesPerPage, page)
+		res, err := s.makeConditionalRequest(ctx, api, owner, uri)
+		if err != nil {
+			return nil, err
+		}
+
+		var releases []release
+		err = json.NewDecoder(res).Decode(&releases)
+		cerr := res.Close()
+		if cerr != nil {
+			return nil, fmt.Errorf("closing response: %w", cerr)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+
+		for _, r := range releases {
+			if r.Draft {
+				continue
+			}
+			for _, a := range r.Assets {
+				assets = append(assets, r.TagName+"/"+a.Name)
+				s.assetIDs.Store(assetKey(owner, repo, r.TagName, a.Name), a.ID)
+			}
+		}
+
+		if len(releases) < releasesPerPage {
+			break
+		}
+		page++
+	}
+	return assets, nil
+}
+
+// ProviderAsset downloads the asset of the release tagged with the version, by
+// the ID it was listed with by ProviderAssets.
+//
+// https://docs.github.com/en/rest/releases/assets?apiVersion=2022-11-28#get-a-release-asset
+func (s *Service) ProviderAsset(ctx context.Context, namespace, typ, version, asset string, w io.Writer) error {
+	api, owner, repo, err := s.provider(namespace, typ)
+	if err != nil {
+		return err
+	}
+
+	key := assetKey(owner, repo, version, asset)
+	id, ok := s.assetIDs.Load(key)
+	if !ok {
+		// The assets may have been listed from a cache, or before a restart,
+		// so we list them again, which the ETags mostly answer.
+		if _, err := s.ProviderAssets(ctx, namespace, typ); err != nil {
+			return err
+		}
+		if id, ok = s.assetIDs.Load(key); !ok {
+			return &backend.Error{
+				Code: http.StatusNotFound,
+				Msg:  "no such asset",
+			}
+		}
+	}
+
+	token, err := s.token(ctx, api, owner)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, api, fmt.Sprintf("repos/%s/%s/releases/assets/%d", owner, repo, id.(int64)), token)
+	if err != nil {
+		return err
+	}
+	// Which has us redirected to the content of the asset, rather than
+	// describing it.
+	req.Header.Set("Accept", "application/octet-stream")
+	body, err := s.sendWith(s.assets, req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := body.Body.Close(); err != nil {
+			slog.Warn("error closing response body", "err", err)
+		}
+	}()
+
+	if _, err := io.Copy(w, body.Body); err != nil {
+		return fmt.Errorf("copying %s: %w", asset, err)
+	}
+	return nil
+}
+
+// provider returns the API, owner and repository of the provider.
+func (s *Service) provider(namespace, typ string) (string, string, string, error) {
+	var (
+		owner = backend.MapOrg(s.cfg.OrgMappings, namespace)
+		repo  = "terraform-provider-" + typ
+	)
+	if err := backend.ValidRepo(s.cfg.Repositories, owner, repo); err != nil {
+		return "", "", "", err
+	}
+	return s.apiURL(namespace), owner, repo, nil
+}
+
+// assetKey is what the IDs of the assets are kept by.
+func assetKey(owner, repo, tag, asset string) string {
+	return owner + "/" + repo + "/" + tag + "/" + asset
+}
@@ -0,0 +1,104 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+func TestService_ProviderAssets(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/repos/test-org/terraform-provider-thing/releases" {
+				body := `[
+					{"tag_name": "v1.1.0", "draft": true, "assets": [{"id": 3, "name": "draft.zip"}]},
+					{"tag_name": "v1.0.0", "assets": [{"id": 1, "name": "a.zip"}, {"id": 2, "name": "b.zip"}]}
+				]`
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+				}, nil
+			}
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		OrgMappings: map[string]string{"test-ns": "test-org"},
+	}
+	service := New(cfg, mockClient)
+
+	assets, err := service.ProviderAssets(context.Background(), "test-ns", "thing")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := []string{"v1.0.0/a.zip", "v1.0.0/b.zip"}; !slices.Equal(assets, exp) {
+		t.Errorf("expected %v, got %v", exp, assets)
+	}
+}
+
+func TestService_ProviderAsset(t *testing.T) {
+	var listed int
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			switch req.URL.Path {
+			case "/repos/test-org/terraform-provider-thing/releases":
+				listed++
+				body := `[{"tag_name": "v1.0.0", "assets": [{"id": 1, "name": "a.zip"}, {"id": 2, "name": "b.zip"}]}]`
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+				}, nil
+			}
+			return nil, errors.New("unexpected request")
+		},
+	}
+	// The assets themselves are downloaded by a client of their own.
+	assetClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/repos/test-org/terraform-provider-thing/releases/assets/2" {
+				if accept := req.Header.Get("Accept"); accept != "application/octet-stream" {
+					t.Errorf("unexpected Accept header: %s", accept)
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewReader([]byte("zip content"))),
+				}, nil
+			}
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		OrgMappings: map[string]string{"test-ns": "test-org"},
+	}
+	service := New(cfg, mockClient).WithAssetClient(assetClient)
+
+	// The assets are listed for their IDs once, and not again for those
+	// already known.
+	for range 2 {
+		var buf bytes.Buffer
+		if err := service.ProviderAsset(context.Background(), "test-ns", "thing", "v1.0.0", "b.zip", &buf); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != "zip content" {
+			t.Errorf("unexpected content %q", buf.String())
+		}
+	}
+	if listed != 1 {
+		t.Errorf("expected the assets listed once, got %d", listed)
+	}
+
+	var buf bytes.Buffer
+	err := service.ProviderAsset(context.Background(), "test-ns", "thing", "v1.0.0", "c.zip", &buf)
+	var herr *backend.Error
+	if !errors.As(err, &herr) || herr.Code != http.StatusNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
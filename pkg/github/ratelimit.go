@@ -0,0 +1,158 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+// RateLimit is the remaining quota of requests to the API of a host, for a
+// token, which is identified by a short hash rather than in plain text.
+type RateLimit struct {
+	Host      string
+	Token     string
+	Remaining int
+}
+
+// rateLimits keeps track of the rate limits of the API, per host and token,
+// from the headers of the responses. Once exhausted, we stop making requests
+// until the limit resets, rather than keep hammering the API.
+//
+// https://docs.github.com/en/rest/using-the-rest-api/rate-limits-for-the-rest-api
+type rateLimits struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	limits map[rateLimitKey]rateLimit
+}
+
+type rateLimitKey struct {
+	host  string
+	token string
+}
+
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+	blocked   time.Time
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{
+		now:    time.Now,
+		limits: make(map[rateLimitKey]rateLimit),
+	}
+}
+
+// wait returns how long we have to wait before making the request, if the
+// rate limit is exhausted.
+func (r *rateLimits) wait(req *http.Request) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.limits[limitKey(req)]
+	if !ok {
+		return 0
+	}
+	return max(l.blocked.Sub(r.now()), 0)
+}
+
+// update tracks the rate limit from the headers of the response, and returns
+// how long we have to wait before making any more requests, if exhausted.
+func (r *rateLimits) update(req *http.Request, res *http.Response) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var (
+		key = limitKey(req)
+		now = r.now()
+		l   = r.limits[key]
+	)
+
+	remaining, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	if err == nil {
+		l.remaining = remaining
+		if reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			l.reset = time.Unix(reset, 0)
+		}
+		if remaining == 0 {
+			l.blocked = l.reset
+		}
+	}
+
+	// The secondary rate limits come with a Retry-After header instead, but
+	// we only trust it on responses that are actually rate limited.
+	if res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests {
+		if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			l.blocked = now.Add(time.Duration(secs) * time.Second)
+		}
+	}
+
+	if err != nil && l.blocked.IsZero() {
+		// No rate limit headers at all, e.g. on GitHub Enterprise Servers
+		// where rate limiting is disabled.
+		return 0
+	}
+
+	// Forget about the limits of tokens that haven't been used since the
+	// reset, which is how the JWTs of the app come and go.
+	for k, v := range r.limits {
+		if k != key && v.reset.Before(now) && v.blocked.Before(now) {
+			delete(r.limits, k)
+		}
+	}
+	r.limits[key] = l
+
+	d := l.blocked.Sub(now)
+	if d > 0 {
+		slog.Warn("rate limit exhausted", "host", key.host, "token", key.token, "reset", l.blocked)
+	}
+	return max(d, 0)
+}
+
+// remaining returns the remaining quota of all the tracked rate limits.
+func (r *rateLimits) remaining() []RateLimit {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limits := make([]RateLimit, 0, len(r.limits))
+	for k, v := range r.limits {
+		limits = append(limits, RateLimit{
+			Host:      k.host,
+			Token:     k.token,
+			Remaining: v.remaining,
+		})
+	}
+	return limits
+}
+
+func limitKey(req *http.Request) rateLimitKey {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return rateLimitKey{
+		host:  req.URL.Host,
+		token: tokenID(token),
+	}
+}
+
+// RateLimits returns the remaining quota of requests to the API, for every
+// host and token in use.
+func (s *Service) RateLimits() []RateLimit {
+	return s.limits.remaining()
+}
+
+func rateLimited(d time.Duration) error {
+	return &backend.Error{
+		Code:  http.StatusServiceUnavailable,
+		Msg:   "rate limit exceeded",
+		Retry: d,
+	}
+}
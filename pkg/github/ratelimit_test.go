@@ -0,0 +1,124 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+func TestService_RateLimit(t *testing.T) {
+	var (
+		now       = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		reset     = now.Add(10 * time.Minute)
+		remaining = 2
+		requests  int
+	)
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			requests++
+			header := http.Header{}
+			header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			header.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			if remaining < 0 {
+				header.Set("X-RateLimit-Remaining", "0")
+				return &http.Response{
+					StatusCode: http.StatusForbidden,
+					Header:     header,
+					Body:       io.NopCloser(strings.NewReader(`{"message": "API rate limit exceeded"}`)),
+				}, nil
+			}
+			remaining--
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader(`[]`)),
+			}, nil
+		},
+	}
+
+	service := New(Config{}, mockClient)
+	service.limits.now = func() time.Time { return now }
+
+	for range 2 {
+		if _, err := service.ListVersions(context.Background(), "test-org", "test-repo", "module"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if limits := service.RateLimits(); len(limits) != 1 || limits[0].Remaining != 1 {
+		t.Errorf("expected 1 remaining request, got %+v", limits)
+	}
+
+	// Once the rate limit is exceeded, we should stop making requests until
+	// the reset.
+	remaining = -1
+	for range 3 {
+		_, err := service.ListVersions(context.Background(), "test-org", "test-repo", "module")
+		var herr *backend.Error
+		if !errors.As(err, &herr) || herr.StatusCode() != http.StatusServiceUnavailable {
+			t.Fatalf("expected service unavailable error, got %v", err)
+		}
+		if herr.RetryAfter() != 10*time.Minute {
+			t.Errorf("expected to retry after the reset, got %s", herr.RetryAfter())
+		}
+	}
+	if requests != 3 {
+		t.Errorf("expected no requests while rate limited, got %d", requests)
+	}
+
+	now, remaining = reset.Add(time.Second), 5000
+	reset = now.Add(time.Hour)
+	if _, err := service.ListVersions(context.Background(), "test-org", "test-repo", "module"); err != nil {
+		t.Fatalf("unexpected error after reset: %v", err)
+	}
+}
+
+func TestService_RateLimit_RetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{"Retry-After": []string{"60"}},
+				Body:       io.NopCloser(strings.NewReader(`{"message": "secondary rate limit"}`)),
+			}, nil
+		},
+	}
+
+	service := New(Config{}, mockClient)
+	service.limits.now = func() time.Time { return now }
+
+	_, err := service.ListVersions(context.Background(), "test-org", "test-repo", "module")
+	var herr *backend.Error
+	if !errors.As(err, &herr) || herr.StatusCode() != http.StatusServiceUnavailable || herr.RetryAfter() != time.Minute {
+		t.Fatalf("expected service unavailable error, retrying after a minute, got %v", err)
+	}
+}
+
+func TestService_Forbidden(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Set("X-RateLimit-Remaining", "4999")
+			return &http.Response{
+				StatusCode: http.StatusForbidden,
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader(`{"message": "Resource not accessible"}`)),
+			}, nil
+		},
+	}
+
+	service := New(Config{}, mockClient)
+
+	_, err := service.ListVersions(context.Background(), "test-org", "test-repo", "module")
+	var herr *backend.Error
+	if !errors.As(err, &herr) || herr.StatusCode() != http.StatusForbidden {
+		t.Fatalf("expected forbidden error, got %v", err)
+	}
+}
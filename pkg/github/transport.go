@@ -0,0 +1,51 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// NewTransport returns an HTTP transport for talking to GitHub, which trusts
+// the certificates of the configured CA bundle, on top of the system ones.
+// This is typically needed for GitHub Enterprise Servers behind an internal CA.
+// The private key of the app, if configured, is checked as well, so that a
+// broken key fails on startup, rather than on every request.
+func NewTransport(cfg Config) (*http.Transport, error) {
+	if cfg.App.enabled() {
+		if _, err := parsePrivateKey(cfg.App); err != nil {
+			return nil, err
+		}
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CABundle == "" {
+		return t, nil
+	}
+
+	b, err := os.ReadFile(cfg.CABundle)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates found in CA bundle")
+	}
+
+	t.TLSClientConfig = &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	return t, nil
+}
@@ -0,0 +1,120 @@
+package github
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_Enterprise(t *testing.T) {
+	var paths []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path != "/api/v3/repos/test-org/test-repo/git/matching-refs/tags/module/" {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := w.Write([]byte(`[{"ref": "refs/tags/module/v1.0.0"}]`)); err != nil {
+			t.Errorf("writing response: %v", err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(bundle, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		// Anything not mapped to the enterprise server should stay off it.
+		URL:         "https://github.invalid",
+		Hosts:       map[string]string{"test-system": srv.URL + "/api/v3/"},
+		CABundle:    bundle,
+		OrgMappings: map[string]string{"test-system": "test-org"},
+	}
+
+	// Without the CA bundle, the certificate of the server isn't trusted.
+	service := New(cfg, &http.Client{Timeout: 5 * time.Second})
+	if _, err := service.ListVersions(context.Background(), "test-system", "test-repo", "module"); err == nil {
+		t.Error("expected certificate error without CA bundle")
+	}
+
+	transport, err := NewTransport(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service = New(cfg, &http.Client{Timeout: 5 * time.Second, Transport: transport})
+
+	versions, err := service.ListVersions(context.Background(), "test-system", "test-repo", "module")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"v1.0.0"}; !slices.Equal(versions, expected) {
+		t.Errorf("expected versions %q, got %q", expected, versions)
+	}
+
+	if _, err := service.ListVersions(context.Background(), "other-system", "test-repo", "module"); err == nil {
+		t.Error("expected other systems to use the default URL")
+	}
+	if expected := []string{"/api/v3/repos/test-org/test-repo/git/matching-refs/tags/module/"}; !slices.Equal(paths, expected) {
+		t.Errorf("expected requests %q, got %q", expected, paths)
+	}
+}
+
+func TestNewTransport_InvalidBundle(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewTransport(Config{CABundle: bundle}); err == nil {
+		t.Error("expected an error for an invalid CA bundle")
+	}
+}
+
+func TestService_HostTokens(t *testing.T) {
+	auths := map[string]string{}
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			auths[req.URL.Host] = req.Header.Get("Authorization")
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`[{"ref": "refs/tags/module/v1.0.0"}]`)),
+			}, nil
+		},
+	}
+
+	cfg := Config{
+		Token: "default-token",
+		Hosts: map[string]string{
+			"ghes":  "https://ghes.example.com/api/v3",
+			"other": "https://other.example.com/api/v3",
+		},
+		HostTokens: map[string]string{"ghes": "ghes-token"},
+	}
+	service := New(cfg, mockClient)
+	for _, system := range []string{"github", "ghes", "other"} {
+		if _, err := service.ListVersions(context.Background(), system, "test-repo", "module"); err != nil {
+			t.Fatalf("%s: unexpected error: %v", system, err)
+		}
+	}
+
+	expected := map[string]string{
+		"api.github.com":    "Bearer default-token",
+		"ghes.example.com":  "Bearer ghes-token",
+		"other.example.com": "",
+	}
+	if !maps.Equal(auths, expected) {
+		t.Errorf("expected authorizations %v, got %v", expected, auths)
+	}
+}
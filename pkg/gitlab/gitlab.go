@@ -0,0 +1,164 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/reMarkable/orbit/pkg/archive"
+	"github.com/reMarkable/orbit/pkg/auth"
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+const (
+	tagsPerPage = 100
+)
+
+type Config struct {
+	URL            string              `envconfig:"URL" default:"https://gitlab.com"`
+	Repositories   map[string][]string `envconfig:"REPOSITORIES"`
+	OrgMappings    map[string]string   `envconfig:"ORG_MAPPINGS"`
+	Token          string              `envconfig:"TOKEN"`
+	MaxFileSize    int64               `envconfig:"MAX_FILE_SIZE"`
+	MaxArchiveSize int64               `envconfig:"MAX_ARCHIVE_SIZE"`
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func New(cfg Config, c HTTPClient) *Service {
+	return &Service{
+		cfg:    cfg,
+		client: c,
+	}
+}
+
+// Service implements the modules repository on top of the GitLab REST API,
+// following the same conventions as the GitHub service: the system maps to a
+// group (or user), and each module is released with `module/vX.Y.Z` tags.
+type Service struct {
+	cfg    Config
+	client HTTPClient
+}
+
+// https://docs.gitlab.com/ee/api/tags.html#list-project-repository-tags
+func (s *Service) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
+	group := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, group, repo); err != nil {
+		return nil, err
+	}
+
+	var (
+		page     = 1
+		prefix   = module + "/"
+		versions = []string{}
+	)
+	for {
+		uri := fmt.Sprintf("projects/%s/repository/tags?search=%s&per_page=%d&page=%d",
+			projectID(group, repo), url.QueryEscape("^"+prefix), tagsPerPage, page)
+		res, err := s.makeRequest(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+
+		var tags []struct {
+			Name string `json:"name"`
+		}
+		err = json.NewDecoder(res).Decode(&tags)
+		cerr := res.Close()
+		if cerr != nil {
+			return nil, fmt.Errorf("closing response: %w", cerr)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+
+		// The search parameter should already have filtered the tags for us,
+		// but we don't want to rely on it, since the semantics of it differ
+		// between GitLab versions.
+		for _, tag := range tags {
+			if strings.HasPrefix(tag.Name, prefix) {
+				versions = append(versions, strings.TrimPrefix(tag.Name, prefix))
+			}
+		}
+
+		if len(tags) < tagsPerPage {
+			break
+		}
+		page++
+	}
+	return versions, nil
+}
+
+// https://docs.gitlab.com/ee/api/repositories.html#get-file-archive
+func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
+	group := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, group, repo); err != nil {
+		return err
+	}
+
+	uri := fmt.Sprintf("projects/%s/repository/archive.tar.gz?sha=%s&path=%s",
+		projectID(group, repo), url.QueryEscape(module+"/"+version), url.QueryEscape(module))
+	body, err := s.makeRequest(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			slog.Warn("error closing response body", "err", err)
+		}
+	}()
+
+	// The archive has a single top-level directory, named after the project,
+	// ref and path, which in turn contains the module directory.
+	prefix := fmt.Sprintf("^[^/]+/%s/(.+)", regexp.QuoteMeta(module))
+	return archive.Repack(w, body, prefix, archive.Options{
+		MaxFileSize: s.cfg.MaxFileSize,
+		MaxSize:     s.cfg.MaxArchiveSize,
+	})
+}
+
+func (s *Service) makeRequest(ctx context.Context, uri string) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%s/api/v4/%s", strings.TrimSuffix(s.cfg.URL, "/"), uri)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	if token := auth.GetToken(ctx, s.cfg.Token); token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &backend.Error{
+			Code: res.StatusCode,
+			Msg:  backend.Slurp(res.Body),
+		}
+	}
+
+	return res.Body, nil
+}
+
+// projectID returns the URL-encoded path of the project, which GitLab accepts
+// in place of the numeric project ID. Since groups may be nested, the group
+// itself may contain slashes.
+func projectID(group, repo string) string {
+	return url.PathEscape(group + "/" + repo)
+}
@@ -0,0 +1,147 @@
+package gitlab
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+type mockHTTPClient struct {
+	doFunc func(req *http.Request) (*http.Response, error)
+}
+
+func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return m.doFunc(req)
+}
+
+func TestService_ListVersions(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.EscapedPath() == "/api/v4/projects/test-group%2Ftest-repo/repository/tags" {
+				if search := req.URL.Query().Get("search"); search != "^module/" {
+					return nil, errors.New("unexpected search: " + search)
+				}
+				body := `[
+					{"name": "module/v1.0.0"},
+					{"name": "module/v1.1.0"},
+					{"name": "other/v2.0.0"}
+				]`
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+				}, nil
+			}
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		URL:         "https://gitlab.example.com",
+		OrgMappings: map[string]string{"test-system": "test-group"},
+	}
+	service := New(cfg, mockClient)
+
+	versions, err := service.ListVersions(context.Background(), "test-system", "test-repo", "module")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"v1.0.0", "v1.1.0"}
+	if len(versions) != len(expected) {
+		t.Fatalf("expected %d versions, got %d", len(expected), len(versions))
+	}
+	for i, v := range versions {
+		if v != expected[i] {
+			t.Errorf("expected version %q, got %q", expected[i], v)
+		}
+	}
+}
+
+func TestService_ListVersions_InvalidRepo(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		Repositories: map[string][]string{"test-group": {"other-repo"}},
+	}
+	service := New(cfg, mockClient)
+
+	_, err := service.ListVersions(context.Background(), "test-group", "test-repo", "module")
+	var herr *backend.Error
+	if !errors.As(err, &herr) || herr.StatusCode() != http.StatusForbidden {
+		t.Errorf("expected forbidden error, got %v", err)
+	}
+}
+
+func TestService_ProxyDownload(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.EscapedPath() == "/api/v4/projects/nested%2Fgroup%2Ftest-repo/repository/archive.tar.gz" {
+				q := req.URL.Query()
+				if q.Get("sha") != "module/v1.0.0" || q.Get("path") != "module" {
+					return nil, errors.New("unexpected query: " + req.URL.RawQuery)
+				}
+
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				tw := tar.NewWriter(gz)
+
+				header := &tar.Header{
+					Name: "test-repo-module-v1.0.0-abc123-module/module/testfile.txt",
+					Mode: 0600,
+					Size: int64(len("fake tarball content")),
+				}
+				if err := tw.WriteHeader(header); err != nil {
+					return nil, err
+				}
+				if _, err := tw.Write([]byte("fake tarball content")); err != nil {
+					return nil, err
+				}
+
+				_ = tw.Close()
+				_ = gz.Close()
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(&buf),
+				}, nil
+			}
+			return nil, errors.New("unexpected request")
+		},
+	}
+
+	cfg := Config{
+		URL:         "https://gitlab.example.com/",
+		OrgMappings: map[string]string{"test-system": "nested/group"},
+	}
+	service := New(cfg, mockClient)
+
+	var buf bytes.Buffer
+	err := service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v1.0.0", &buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("failed to create gzip reader: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("failed to read tar: %v", err)
+	}
+	if hdr.Name != "testfile.txt" {
+		t.Errorf("expected entry %q, got %q", "testfile.txt", hdr.Name)
+	}
+}
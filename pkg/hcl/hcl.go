@@ -0,0 +1,413 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package hcl is a minimal parser of the native syntax of the HashiCorp
+// Configuration Language, which is enough to tell the blocks and attributes
+// of Terraform files apart. Expressions aren't evaluated, but kept as they're
+// written, with literal strings and objects decoded on request.
+//
+// https://github.com/hashicorp/hcl/blob/main/hclsyntax/spec.md
+package hcl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrSyntax = errors.New("syntax error")
+
+// Body is the content of a file, or a block.
+type Body struct {
+	Attributes []Attribute
+	Blocks     []Block
+}
+
+// Attribute returns the attribute of the body with the name, if any.
+func (b Body) Attribute(name string) (Expression, bool) {
+	for _, a := range b.Attributes {
+		if a.Name == name {
+			return a.Expr, true
+		}
+	}
+	return "", false
+}
+
+type Attribute struct {
+	Name string
+	Expr Expression
+}
+
+type Block struct {
+	Type   string
+	Labels []string
+	Body   Body
+}
+
+// Expression is the source of an expression, as written.
+type Expression string
+
+// Literal returns the string of the expression, if it's nothing but a quoted
+// string or a heredoc, without any interpolations or directives.
+func (e Expression) Literal() (string, bool) {
+	p := newParser([]byte(e))
+	tok, err := p.next()
+	if err != nil {
+		return "", false
+	}
+	if end, err := p.next(); err != nil || end.kind != tokenEOF {
+		return "", false
+	}
+
+	src := string(e[tok.start:tok.end])
+	switch tok.kind {
+	case tokenString:
+		return unquote(src[1 : len(src)-1])
+	case tokenHeredoc:
+		return heredoc(src)
+	}
+	return "", false
+}
+
+// Bool returns the value of the expression, if it's a literal bool.
+func (e Expression) Bool() (bool, bool) {
+	switch strings.TrimSpace(string(e)) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+	return false, false
+}
+
+// Object returns the attributes of the expression, if it's an object
+// constructor with literal keys.
+func (e Expression) Object() ([]Attribute, bool) {
+	p := newParser([]byte(e))
+	if tok, err := p.next(); err != nil || tok.kind != tokenOpen || e[tok.start] != '{' {
+		return nil, false
+	}
+
+	var attrs []Attribute
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return nil, false
+		}
+
+		var name string
+		switch tok.kind {
+		case tokenNewline, tokenComma:
+			continue
+		case tokenClose:
+			end, err := p.next()
+			return attrs, err == nil && e[tok.start] == '}' && end.kind == tokenEOF
+		case tokenIdent:
+			name = string(e[tok.start:tok.end])
+		case tokenString:
+			var ok bool
+			if name, ok = unquote(string(e[tok.start+1 : tok.end-1])); !ok {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+
+		if tok, err := p.next(); err != nil || (tok.kind != tokenEquals && tok.kind != tokenColon) {
+			return nil, false
+		}
+		expr, err := p.expression()
+		if err != nil {
+			return nil, false
+		}
+		attrs = append(attrs, Attribute{Name: name, Expr: expr})
+	}
+}
+
+func (e Expression) String() string {
+	return string(e)
+}
+
+// Parse parses the source of a file.
+func Parse(src []byte) (Body, error) {
+	p := newParser(src)
+	return p.body(false)
+}
+
+type parser struct {
+	s      scanner
+	peeked *token
+}
+
+func newParser(src []byte) *parser {
+	return &parser{s: scanner{src: src}}
+}
+
+func (p *parser) next() (token, error) {
+	if p.peeked != nil {
+		tok := *p.peeked
+		p.peeked = nil
+		return tok, nil
+	}
+	return p.s.next()
+}
+
+func (p *parser) peek() (token, error) {
+	if p.peeked == nil {
+		tok, err := p.s.next()
+		if err != nil {
+			return token{}, err
+		}
+		p.peeked = &tok
+	}
+	return *p.peeked, nil
+}
+
+// body parses the attributes and blocks up to the end of the source, or else
+// the closing brace of the block.
+func (p *parser) body(block bool) (Body, error) {
+	var b Body
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return b, err
+		}
+
+		switch tok.kind {
+		case tokenNewline:
+			continue
+		case tokenEOF:
+			if block {
+				return b, syntaxErr(p.s.src, tok.start, "unclosed block")
+			}
+			return b, nil
+		case tokenClose:
+			if block && p.s.src[tok.start] == '}' {
+				return b, nil
+			}
+			return b, syntaxErr(p.s.src, tok.start, "unexpected "+p.text(tok))
+		case tokenIdent:
+		default:
+			return b, syntaxErr(p.s.src, tok.start, "expected attribute or block, got "+p.text(tok))
+		}
+
+		name := p.text(tok)
+		if next, err := p.peek(); err != nil {
+			return b, err
+		} else if next.kind == tokenEquals {
+			_, _ = p.next()
+			expr, err := p.expression()
+			if err != nil {
+				return b, err
+			}
+			b.Attributes = append(b.Attributes, Attribute{Name: name, Expr: expr})
+		} else {
+			blk, err := p.block(name)
+			if err != nil {
+				return b, err
+			}
+			b.Blocks = append(b.Blocks, blk)
+		}
+
+		if err := p.endOfItem(); err != nil {
+			return b, err
+		}
+	}
+}
+
+func (p *parser) block(typ string) (Block, error) {
+	blk := Block{Type: typ}
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return blk, err
+		}
+
+		switch tok.kind {
+		case tokenIdent:
+			blk.Labels = append(blk.Labels, p.text(tok))
+		case tokenString:
+			label, ok := unquote(p.text(tok)[1 : tok.end-tok.start-1])
+			if !ok {
+				return blk, syntaxErr(p.s.src, tok.start, "invalid block label")
+			}
+			blk.Labels = append(blk.Labels, label)
+		case tokenOpen:
+			if p.s.src[tok.start] != '{' {
+				return blk, syntaxErr(p.s.src, tok.start, "unexpected "+p.text(tok))
+			}
+			blk.Body, err = p.body(true)
+			return blk, err
+		default:
+			return blk, syntaxErr(p.s.src, tok.start, "expected block label or body, got "+p.text(tok))
+		}
+	}
+}
+
+// endOfItem makes sure the attribute or block is followed by a newline, or
+// the end of the enclosing body.
+func (p *parser) endOfItem() error {
+	tok, err := p.peek()
+	if err != nil {
+		return err
+	}
+	switch tok.kind {
+	case tokenNewline:
+		_, _ = p.next()
+		return nil
+	case tokenEOF, tokenClose:
+		return nil
+	}
+	return syntaxErr(p.s.src, tok.start, "expected newline, got "+p.text(tok))
+}
+
+// expression consumes the tokens of the expression, which ends with a newline,
+// comma or closing bracket outside of any brackets of its own.
+func (p *parser) expression() (Expression, error) {
+	var (
+		start = -1
+		end   int
+		depth int
+	)
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return "", err
+		}
+		if tok.kind == tokenEOF {
+			if depth > 0 {
+				return "", syntaxErr(p.s.src, tok.start, "unclosed bracket")
+			}
+			break
+		}
+		if depth == 0 && (tok.kind == tokenNewline || tok.kind == tokenComma || tok.kind == tokenClose) {
+			break
+		}
+		if depth == 0 && tok.kind == tokenEquals {
+			// Equals signs only belong in objects, within brackets.
+			return "", syntaxErr(p.s.src, tok.start, "unexpected =")
+		}
+
+		switch tok.kind {
+		case tokenOpen:
+			depth++
+		case tokenClose:
+			depth--
+		}
+		if start < 0 {
+			start = tok.start
+		}
+		end = tok.end
+		_, _ = p.next()
+	}
+
+	if start < 0 {
+		tok, _ := p.peek()
+		return "", syntaxErr(p.s.src, tok.start, "expected expression")
+	}
+	return Expression(p.s.src[start:end]), nil
+}
+
+func (p *parser) text(tok token) string {
+	if tok.kind == tokenEOF {
+		return "end of file"
+	}
+	if tok.kind == tokenNewline {
+		return "newline"
+	}
+	return string(p.s.src[tok.start:tok.end])
+}
+
+// unquote decodes the escape sequences of a quoted string, failing for
+// strings with interpolations or directives.
+func unquote(s string) (string, bool) {
+	var (
+		b   strings.Builder
+		esc = strings.NewReplacer(`\n`, "\n", `\r`, "\r", `\t`, "\t", `\"`, `"`, `\\`, `\`)
+	)
+	for len(s) > 0 {
+		switch {
+		case strings.HasPrefix(s, "$${"), strings.HasPrefix(s, "%%{"):
+			b.WriteString(s[1:3])
+			s = s[3:]
+		case strings.HasPrefix(s, "${"), strings.HasPrefix(s, "%{"):
+			return "", false
+		case strings.HasPrefix(s, `\u`), strings.HasPrefix(s, `\U`):
+			n := 4
+			if s[1] == 'U' {
+				n = 8
+			}
+			if len(s) < n+2 {
+				return "", false
+			}
+			r, err := strconv.ParseUint(s[2:n+2], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", false
+			}
+			b.WriteRune(rune(r))
+			s = s[n+2:]
+		case s[0] == '\\':
+			if len(s) < 2 {
+				return "", false
+			}
+			decoded := esc.Replace(s[:2])
+			if decoded == s[:2] {
+				return "", false
+			}
+			b.WriteString(decoded)
+			s = s[2:]
+		default:
+			b.WriteByte(s[0])
+			s = s[1:]
+		}
+	}
+	return b.String(), true
+}
+
+var (
+	dropEscaped = strings.NewReplacer("$${", "", "%%{", "")
+	unescape    = strings.NewReplacer("$${", "${", "%%{", "%{")
+)
+
+// heredoc returns the content of the heredoc, with the indentation of the
+// indented ones removed, failing for heredocs with interpolations.
+func heredoc(src string) (string, bool) {
+	header, rest, _ := strings.Cut(src, "\n")
+	lines := strings.Split(rest, "\n")
+	lines = lines[:len(lines)-1]
+
+	indent := -1
+	if strings.HasPrefix(header, "<<-") {
+		for _, l := range lines {
+			if strings.TrimSpace(l) == "" {
+				continue
+			}
+			n := len(l) - len(strings.TrimLeft(l, " \t"))
+			if indent < 0 || n < indent {
+				indent = n
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	for _, l := range lines {
+		if indent > 0 {
+			l = l[min(indent, len(l)-len(strings.TrimLeft(l, " \t"))):]
+		}
+		if unescaped := dropEscaped.Replace(l); strings.Contains(unescaped, "${") || strings.Contains(unescaped, "%{") {
+			return "", false
+		}
+		b.WriteString(unescape.Replace(strings.TrimSuffix(l, "\r")))
+		b.WriteByte('\n')
+	}
+	return b.String(), true
+}
+
+func syntaxErr(src []byte, pos int, msg string) error {
+	line := bytes.Count(src[:min(pos, len(src))], []byte("\n")) + 1
+	return fmt.Errorf("%w: line %d: %s", ErrSyntax, line, msg)
+}
@@ -0,0 +1,246 @@
+package hcl
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+const src = `# Inputs
+variable "region" {
+  type        = string
+  description = "The region to deploy to."
+  default     = "eu-west-1"
+}
+
+variable "tags" {
+  type = map(string)
+  description = <<-EOT
+    Tags for all the
+    resources.
+  EOT
+  default = {
+    team = "infra"
+  }
+}
+
+variable "name" { type = string }
+
+/* Outputs */
+output "id" {
+  description = "The ID of the ${var.name} VPC."
+  value       = aws_vpc.this.id
+  sensitive   = true
+}
+
+terraform {
+  required_version = ">= 1.5"
+  required_providers {
+    aws = {
+      source  = "hashicorp/aws"
+      version = "~> 5.0"
+    }
+    random = "~> 3.0"
+  }
+}
+
+locals {
+  list = [
+    "a", // the first
+    "b",
+  ]
+  cond = var.x == "}" ? 1 : 2
+}
+`
+
+func TestParse(t *testing.T) {
+	body, err := Parse([]byte(src))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var types []string
+	for _, b := range body.Blocks {
+		types = append(types, b.Type)
+	}
+	if exp := []string{"variable", "variable", "variable", "output", "terraform", "locals"}; !slices.Equal(types, exp) {
+		t.Fatalf("expected blocks %v, got %v", exp, types)
+	}
+
+	region := body.Blocks[0]
+	if !slices.Equal(region.Labels, []string{"region"}) {
+		t.Errorf("unexpected labels %v", region.Labels)
+	}
+	if typ, _ := region.Body.Attribute("type"); typ != "string" {
+		t.Errorf("unexpected type %q", typ)
+	}
+	if def, ok := region.Body.Attribute("default"); !ok || def != `"eu-west-1"` {
+		t.Errorf("unexpected default %q", def)
+	}
+	if desc, _ := region.Body.Attribute("description"); mustLiteral(t, desc) != "The region to deploy to." {
+		t.Errorf("unexpected description %q", desc)
+	}
+
+	tags := body.Blocks[1]
+	if desc, _ := tags.Body.Attribute("description"); mustLiteral(t, desc) != "Tags for all the\nresources.\n" {
+		t.Errorf("unexpected description %q", desc)
+	}
+	if def, _ := tags.Body.Attribute("default"); def != "{\n    team = \"infra\"\n  }" {
+		t.Errorf("unexpected default %q", def)
+	}
+
+	if typ, _ := body.Blocks[2].Body.Attribute("type"); typ != "string" {
+		t.Errorf("unexpected type %q of the single line block", typ)
+	}
+
+	output := body.Blocks[3]
+	if desc, _ := output.Body.Attribute("description"); desc.String() == "" {
+		t.Error("expected a description")
+	} else if _, ok := desc.Literal(); ok {
+		t.Error("expected no literal for an interpolation")
+	}
+	if sensitive, _ := output.Body.Attribute("sensitive"); !mustBool(t, sensitive) {
+		t.Error("expected the output to be sensitive")
+	}
+
+	tf := body.Blocks[4]
+	providers := tf.Body.Blocks[0].Body.Attributes
+	if len(providers) != 2 {
+		t.Fatalf("expected 2 providers, got %d", len(providers))
+	}
+	attrs, ok := providers[0].Expr.Object()
+	if !ok || len(attrs) != 2 {
+		t.Fatalf("expected an object, got %q", providers[0].Expr)
+	}
+	if mustLiteral(t, attrs[0].Expr) != "hashicorp/aws" || mustLiteral(t, attrs[1].Expr) != "~> 5.0" {
+		t.Errorf("unexpected provider %v", attrs)
+	}
+	if mustLiteral(t, providers[1].Expr) != "~> 3.0" {
+		t.Errorf("unexpected provider %q", providers[1].Expr)
+	}
+
+	locals := body.Blocks[5]
+	if len(locals.Body.Attributes) != 2 {
+		t.Errorf("expected 2 locals, got %v", locals.Body.Attributes)
+	}
+}
+
+func TestParse_Validation(t *testing.T) {
+	body, err := Parse([]byte(`
+variable "name" {
+  type     = string
+  nullable = var.min >= 1
+
+  validation {
+    condition     = var.name != "" && length(var.name) <= 32
+    error_message = "The name must be 1 to 32 characters."
+  }
+}
+
+variable "count" {
+  type = number
+
+  validation {
+    condition     = var.count > 0 && var.count < 10 || var.count == 42
+    error_message = "The count is out of range."
+  }
+}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(body.Blocks) != 2 {
+		t.Fatalf("expected 2 variables, got %d", len(body.Blocks))
+	}
+
+	name := body.Blocks[0]
+	if nullable, _ := name.Body.Attribute("nullable"); nullable != "var.min >= 1" {
+		t.Errorf("unexpected nullable %q", nullable)
+	}
+	if len(name.Body.Blocks) != 1 || name.Body.Blocks[0].Type != "validation" {
+		t.Fatalf("expected a validation block, got %v", name.Body.Blocks)
+	}
+	if cond, _ := name.Body.Blocks[0].Body.Attribute("condition"); cond != `var.name != "" && length(var.name) <= 32` {
+		t.Errorf("unexpected condition %q", cond)
+	}
+	if cond, _ := body.Blocks[1].Body.Blocks[0].Body.Attribute("condition"); cond != "var.count > 0 && var.count < 10 || var.count == 42" {
+		t.Errorf("unexpected condition %q", cond)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, src := range []string{
+		`variable "x" {`,
+		`variable "x" { default = "unterminated }`,
+		`x = `,
+		`x = [1, 2`,
+		`x = 1 y = 2`,
+		"x = <<EOT\nfoo\n",
+		`}`,
+	} {
+		if _, err := Parse([]byte(src)); !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s: expected a syntax error, got %v", src, err)
+		}
+	}
+}
+
+func TestExpression_Literal(t *testing.T) {
+	tests := []struct {
+		expr Expression
+		exp  string
+		ok   bool
+	}{
+		{`"foo"`, "foo", true},
+		{`"a\"b\\c\ndé"`, "a\"b\\c\ndé", true},
+		{`"$${foo} %%{bar}"`, "${foo} %{bar}", true},
+		{`"${foo}"`, "", false},
+		{`"%{ if x }y%{ endif }"`, "", false},
+		{`"foo" + 1`, "", false},
+		{`foo`, "", false},
+		{"<<EOT\n  foo\nEOT", "  foo\n", true},
+		{"<<-EOT\n    foo\n      bar\n    EOT", "foo\n  bar\n", true},
+		{"<<EOT\n${foo}\nEOT", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.expr.Literal()
+		if got != tt.exp || ok != tt.ok {
+			t.Errorf("%s: expected %q (%t), got %q (%t)", tt.expr, tt.exp, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestExpression_Object(t *testing.T) {
+	attrs, ok := Expression(`{ a = 1, "b" : [1, 2], c = { d = 3 } }`).Object()
+	if !ok || len(attrs) != 3 {
+		t.Fatalf("expected 3 attributes, got %v (%t)", attrs, ok)
+	}
+	for n, exp := range []Attribute{{"a", "1"}, {"b", "[1, 2]"}, {"c", "{ d = 3 }"}} {
+		if attrs[n] != exp {
+			t.Errorf("expected %v, got %v", exp, attrs[n])
+		}
+	}
+
+	for _, expr := range []Expression{`[1]`, `{ a = 1 } + 1`, `{ (a) = 1 }`} {
+		if _, ok := expr.Object(); ok {
+			t.Errorf("%s: expected no object", expr)
+		}
+	}
+}
+
+func mustLiteral(t *testing.T, e Expression) string {
+	t.Helper()
+	s, ok := e.Literal()
+	if !ok {
+		t.Errorf("expected a literal, got %q", e)
+	}
+	return s
+}
+
+func mustBool(t *testing.T, e Expression) bool {
+	t.Helper()
+	b, ok := e.Bool()
+	if !ok {
+		t.Errorf("expected a bool, got %q", e)
+	}
+	return b
+}
@@ -0,0 +1,224 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package hcl
+
+import (
+	"bytes"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNewline
+	tokenIdent
+	tokenString
+	tokenHeredoc
+	tokenOpen
+	tokenClose
+	tokenEquals
+	tokenColon
+	tokenComma
+	// tokenOther is anything else an expression is made of, like numbers and
+	// operators, which we have no need to tell apart.
+	tokenOther
+)
+
+type token struct {
+	kind  tokenKind
+	start int
+	end   int
+}
+
+// scanner splits the source into tokens, skipping whitespace and comments.
+type scanner struct {
+	src []byte
+	pos int
+}
+
+func (s *scanner) next() (token, error) {
+	s.skip()
+	if s.pos >= len(s.src) {
+		return token{kind: tokenEOF, start: s.pos, end: s.pos}, nil
+	}
+
+	start := s.pos
+	tok := func(kind tokenKind, end int) (token, error) {
+		s.pos = end
+		return token{kind: kind, start: start, end: end}, nil
+	}
+	switch c := s.src[s.pos]; {
+	case c == '\n':
+		return tok(tokenNewline, s.pos+1)
+	case isLetter(c):
+		end := s.pos + 1
+		for end < len(s.src) && (isLetter(s.src[end]) || isDigit(s.src[end]) || s.src[end] == '-') {
+			end++
+		}
+		return tok(tokenIdent, end)
+	case isDigit(c):
+		end := s.pos + 1
+		for end < len(s.src) && (isLetter(s.src[end]) || isDigit(s.src[end]) || s.src[end] == '.') {
+			end++
+		}
+		return tok(tokenOther, end)
+	case c == '"':
+		end, err := s.quoted(s.pos)
+		if err != nil {
+			return token{}, err
+		}
+		return tok(tokenString, end)
+	case c == '<' && s.heredocStart():
+		end, err := s.heredoc(s.pos)
+		if err != nil {
+			return token{}, err
+		}
+		return tok(tokenHeredoc, end)
+	case c == '{' || c == '[' || c == '(':
+		return tok(tokenOpen, s.pos+1)
+	case c == '}' || c == ']' || c == ')':
+		return tok(tokenClose, s.pos+1)
+	case c == '=':
+		if s.pos+1 < len(s.src) && (s.src[s.pos+1] == '=' || s.src[s.pos+1] == '>') {
+			return tok(tokenOther, s.pos+2)
+		}
+		return tok(tokenEquals, s.pos+1)
+	case (c == '!' || c == '<' || c == '>') && s.pos+1 < len(s.src) && s.src[s.pos+1] == '=':
+		// The comparison operators, which aren't assignments.
+		return tok(tokenOther, s.pos+2)
+	case c == ':':
+		return tok(tokenColon, s.pos+1)
+	case c == ',':
+		return tok(tokenComma, s.pos+1)
+	}
+	return tok(tokenOther, s.pos+1)
+}
+
+// skip skips whitespace and comments, but not newlines, which end attributes.
+func (s *scanner) skip() {
+	for s.pos < len(s.src) {
+		switch {
+		case s.src[s.pos] == ' ' || s.src[s.pos] == '\t' || s.src[s.pos] == '\r':
+			s.pos++
+		case s.src[s.pos] == '#' || s.hasPrefix("//"):
+			if n := bytes.IndexByte(s.src[s.pos:], '\n'); n >= 0 {
+				s.pos += n
+			} else {
+				s.pos = len(s.src)
+			}
+		case s.hasPrefix("/*"):
+			if n := bytes.Index(s.src[s.pos+2:], []byte("*/")); n >= 0 {
+				s.pos += n + 4
+			} else {
+				s.pos = len(s.src)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// quoted returns the end of the quoted template starting at pos, which may
+// hold interpolations with quoted templates of their own.
+func (s *scanner) quoted(pos int) (int, error) {
+	for i := pos + 1; i < len(s.src); i++ {
+		switch c := s.src[i]; c {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		case '\n':
+			return 0, syntaxErr(s.src, pos, "unterminated string")
+		case '$', '%':
+			if i+2 < len(s.src) && s.src[i+1] == c && s.src[i+2] == '{' {
+				// An escaped interpolation.
+				i += 2
+			} else if i+1 < len(s.src) && s.src[i+1] == '{' {
+				end, err := s.interpolation(i + 2)
+				if err != nil {
+					return 0, err
+				}
+				i = end - 1
+			}
+		}
+	}
+	return 0, syntaxErr(s.src, pos, "unterminated string")
+}
+
+// interpolation returns the end of the interpolation whose content starts at
+// pos, just after the opening brace.
+func (s *scanner) interpolation(pos int) (int, error) {
+	sub := scanner{src: s.src, pos: pos}
+	for depth := 0; ; {
+		tok, err := sub.next()
+		if err != nil {
+			return 0, err
+		}
+		switch tok.kind {
+		case tokenEOF:
+			return 0, syntaxErr(s.src, pos, "unterminated interpolation")
+		case tokenOpen:
+			depth++
+		case tokenClose:
+			if depth == 0 {
+				return tok.end, nil
+			}
+			depth--
+		}
+	}
+}
+
+func (s *scanner) heredocStart() bool {
+	i := s.pos + 2
+	if !s.hasPrefix("<<") {
+		return false
+	}
+	if i < len(s.src) && s.src[i] == '-' {
+		i++
+	}
+	return i < len(s.src) && isLetter(s.src[i])
+}
+
+// heredoc returns the end of the heredoc starting at pos, which is the end of
+// the line with its delimiter.
+func (s *scanner) heredoc(pos int) (int, error) {
+	i := pos + 2
+	if s.src[i] == '-' {
+		i++
+	}
+	start := i
+	for i < len(s.src) && (isLetter(s.src[i]) || isDigit(s.src[i]) || s.src[i] == '-') {
+		i++
+	}
+	delim := string(s.src[start:i])
+
+	nl := bytes.IndexByte(s.src[i:], '\n')
+	if nl < 0 || len(bytes.TrimSpace(s.src[i:i+nl])) > 0 {
+		return 0, syntaxErr(s.src, pos, "heredoc must be followed by a newline")
+	}
+	for i += nl + 1; i < len(s.src); {
+		end := len(s.src)
+		if n := bytes.IndexByte(s.src[i:], '\n'); n >= 0 {
+			end = i + n
+		}
+		if string(bytes.TrimSpace(s.src[i:end])) == delim {
+			return end, nil
+		}
+		i = end + 1
+	}
+	return 0, syntaxErr(s.src, pos, "unterminated heredoc "+delim)
+}
+
+func (s *scanner) hasPrefix(prefix string) bool {
+	return bytes.HasPrefix(s.src[s.pos:], []byte(prefix))
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,49 @@
+package hcl
+
+import (
+	"testing"
+)
+
+func TestScanner(t *testing.T) {
+	src := "a-b = \"x${ \"}\" }y\" # comment\n<<-EOT\n  z\n  EOT\n{[(1.5 == 2)]}, : /* c */ => != <= >= < >"
+	exp := []struct {
+		kind tokenKind
+		text string
+	}{
+		{tokenIdent, "a-b"},
+		{tokenEquals, "="},
+		{tokenString, "\"x${ \"}\" }y\""},
+		{tokenNewline, "\n"},
+		{tokenHeredoc, "<<-EOT\n  z\n  EOT"},
+		{tokenNewline, "\n"},
+		{tokenOpen, "{"},
+		{tokenOpen, "["},
+		{tokenOpen, "("},
+		{tokenOther, "1.5"},
+		{tokenOther, "=="},
+		{tokenOther, "2"},
+		{tokenClose, ")"},
+		{tokenClose, "]"},
+		{tokenClose, "}"},
+		{tokenComma, ","},
+		{tokenColon, ":"},
+		{tokenOther, "=>"},
+		{tokenOther, "!="},
+		{tokenOther, "<="},
+		{tokenOther, ">="},
+		{tokenOther, "<"},
+		{tokenOther, ">"},
+		{tokenEOF, ""},
+	}
+
+	s := scanner{src: []byte(src)}
+	for _, e := range exp {
+		tok, err := s.next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if text := src[tok.start:tok.end]; tok.kind != e.kind || text != e.text {
+			t.Fatalf("expected %q (%d), got %q (%d)", e.text, e.kind, text, tok.kind)
+		}
+	}
+}
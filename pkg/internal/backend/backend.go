@@ -0,0 +1,80 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package backend holds what the repository backends have in common: how
+// systems map to owners, which repositories are allowed, and the errors that
+// tell the handlers what to respond with.
+package backend
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// MapOrg returns the owner that the system is mapped to, or the system itself
+// if it isn't mapped.
+func MapOrg(mappings map[string]string, system string) string {
+	if owner, ok := mappings[system]; ok {
+		return owner
+	}
+	return system
+}
+
+// ValidRepo returns a forbidden error unless the repository is among those
+// allowed for the owner. All of them are allowed if none are configured.
+func ValidRepo(repositories map[string][]string, owner, repo string) error {
+	if len(repositories) == 0 {
+		return nil
+	}
+
+	if repos, ok := repositories[owner]; ok {
+		if slices.Contains(repos, repo) {
+			return nil
+		}
+	}
+
+	return &Error{
+		Code: http.StatusForbidden,
+		Msg:  "not a valid repository",
+	}
+}
+
+// Slurp reads and closes the body of a response, returning what it holds, or
+// why it couldn't be read.
+func Slurp(r io.ReadCloser) string {
+	defer func() {
+		if err := r.Close(); err != nil {
+			slog.Warn("error closing response body", "err", err)
+		}
+	}()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// Error is an error with the status code to respond with, and, if known, how
+// long to wait before retrying.
+type Error struct {
+	Code  int
+	Msg   string
+	Retry time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) StatusCode() int {
+	return e.Code
+}
+
+func (e *Error) RetryAfter() time.Duration {
+	return e.Retry
+}
@@ -0,0 +1,42 @@
+package backend
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMapOrg(t *testing.T) {
+	mappings := map[string]string{"aws": "infra"}
+	if owner := MapOrg(mappings, "aws"); owner != "infra" {
+		t.Errorf("expected the mapped owner, got %q", owner)
+	}
+	if owner := MapOrg(mappings, "gcp"); owner != "gcp" {
+		t.Errorf("expected the system itself, got %q", owner)
+	}
+}
+
+func TestValidRepo(t *testing.T) {
+	if err := ValidRepo(nil, "infra", "anything"); err != nil {
+		t.Errorf("expected all repositories to be valid, got %v", err)
+	}
+
+	repos := map[string][]string{"infra": {"modules"}}
+	if err := ValidRepo(repos, "infra", "modules"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, owner := range []string{"infra", "other"} {
+		var herr *Error
+		if err := ValidRepo(repos, owner, "secrets"); !errors.As(err, &herr) || herr.StatusCode() != http.StatusForbidden {
+			t.Errorf("%s: expected forbidden, got %v", owner, err)
+		}
+	}
+}
+
+func TestSlurp(t *testing.T) {
+	if s := Slurp(io.NopCloser(strings.NewReader("not found"))); s != "not found" {
+		t.Errorf("unexpected body %q", s)
+	}
+}
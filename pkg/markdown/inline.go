@@ -0,0 +1,114 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// The inline patterns apply to text that's already escaped, which is why the
+// quotes of link titles are entities.
+var (
+	imageRe    = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)(?:\s+&#34;[^)]*?&#34;)?\)`)
+	linkRe     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)(?:\s+&#34;[^)]*?&#34;)?\)`)
+	autolinkRe = regexp.MustCompile(`&lt;((?:https?://|mailto:)[^\s&]+)&gt;`)
+	strongRe   = regexp.MustCompile(`\*\*([^*\s](?:.*?[^*\s])?)\*\*|\b__([^_\s](?:.*?[^_\s])?)__\b`)
+	emRe       = regexp.MustCompile(`\*([^*\s](?:[^*]*?[^*\s])?)\*|\b_([^_\s](?:[^_]*?[^_\s])?)_\b`)
+	strikeRe   = regexp.MustCompile(`~~([^~\s](?:.*?[^~\s])?)~~`)
+	breakRe    = regexp.MustCompile(`(?: {2,}|\\)\n`)
+)
+
+// inline renders the code spans, links and emphasis of the text.
+func inline(s string) string {
+	var b strings.Builder
+	for s != "" {
+		start := strings.IndexByte(s, '`')
+		if start < 0 {
+			b.WriteString(spans(s))
+			break
+		}
+		n := len(s[start:]) - len(strings.TrimLeft(s[start:], "`"))
+		ticks := s[start : start+n]
+		end := strings.Index(s[start+n:], ticks)
+		if end < 0 {
+			// Unmatched backticks are just backticks.
+			b.WriteString(spans(s[:start+n]))
+			s = s[start+n:]
+			continue
+		}
+
+		b.WriteString(spans(s[:start]))
+		code := strings.ReplaceAll(s[start+n:start+n+end], "\n", " ")
+		if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+			code = code[1 : len(code)-1]
+		}
+		fmt.Fprintf(&b, "<code>%s</code>", html.EscapeString(code))
+		s = s[start+n+end+n:]
+	}
+	return b.String()
+}
+
+// spans renders the links and emphasis of the text, which has no code.
+func spans(s string) string {
+	s = html.EscapeString(s)
+
+	// The links are set aside while rendering the emphasis, so it doesn't
+	// apply to the URLs.
+	var links []string
+	hold := func(link string) string {
+		links = append(links, link)
+		return fmt.Sprintf("\x00%d\x00", len(links)-1)
+	}
+	s = imageRe.ReplaceAllStringFunc(s, func(m string) string {
+		sm := imageRe.FindStringSubmatch(m)
+		url, ok := safeURL(sm[2])
+		if !ok || !strings.Contains(url, "://") {
+			// Relative images are relative to the repository, which we
+			// don't serve.
+			return hold(sm[1])
+		}
+		return hold(fmt.Sprintf(`<img src="%s" alt="%s">`, url, sm[1]))
+	})
+	s = linkRe.ReplaceAllStringFunc(s, func(m string) string {
+		sm := linkRe.FindStringSubmatch(m)
+		url, ok := safeURL(sm[2])
+		if !ok {
+			return sm[1]
+		}
+		return fmt.Sprintf(`<a href="%s">%s</a>`, hold(url), sm[1])
+	})
+	s = autolinkRe.ReplaceAllStringFunc(s, func(m string) string {
+		url := autolinkRe.FindStringSubmatch(m)[1]
+		return hold(fmt.Sprintf(`<a href="%s">%s</a>`, url, url))
+	})
+
+	s = strongRe.ReplaceAllString(s, "<strong>$1$2</strong>")
+	s = emRe.ReplaceAllString(s, "<em>$1$2</em>")
+	s = strikeRe.ReplaceAllString(s, "<del>$1</del>")
+	s = breakRe.ReplaceAllString(s, "<br>\n")
+
+	for n, link := range links {
+		s = strings.Replace(s, fmt.Sprintf("\x00%d\x00", n), link, 1)
+	}
+	return s
+}
+
+// safeURL returns the escaped URL, unless it's got a scheme that could run
+// scripts, e.g. `javascript:`.
+func safeURL(escaped string) (string, bool) {
+	url := strings.ToLower(html.UnescapeString(escaped))
+	scheme, _, ok := strings.Cut(url, ":")
+	if !ok || strings.ContainsAny(scheme, "/?#") {
+		return escaped, true
+	}
+	switch scheme {
+	case "http", "https", "mailto":
+		return escaped, true
+	}
+	return "", false
+}
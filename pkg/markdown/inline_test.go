@@ -0,0 +1,29 @@
+package markdown
+
+import (
+	"testing"
+)
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		src string
+		exp string
+	}{
+		{"**bold** and *em* and _em_ and ~~del~~", "<strong>bold</strong> and <em>em</em> and <em>em</em> and <del>del</del>"},
+		{"snake_case_name", "snake_case_name"},
+		{"`**code**` <b>", "<code>**code**</code> &lt;b&gt;"},
+		{"`` a ` b ``", "<code>a ` b</code>"},
+		{"unmatched ` tick", "unmatched ` tick"},
+		{"[a *b*](https://x.io/_c_/?d=1&e=2)", `<a href="https://x.io/_c_/?d=1&amp;e=2">a <em>b</em></a>`},
+		{"[x](javascript:alert%281%29)", "x"},
+		{"[rel](./docs/USAGE.md)", `<a href="./docs/USAGE.md">rel</a>`},
+		{"![logo](https://x.io/l.png) ![rel](l.png)", `<img src="https://x.io/l.png" alt="logo"> rel`},
+		{"<https://x.io>", `<a href="https://x.io">https://x.io</a>`},
+		{"line  \nbreak", "line<br>\nbreak"},
+	}
+	for _, tt := range tests {
+		if got := inline(tt.src); got != tt.exp {
+			t.Errorf("%s: expected %q, got %q", tt.src, tt.exp, got)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package markdown renders the subset of GitHub Flavored Markdown commonly
+// found in the READMEs of modules as HTML: headings, paragraphs, lists, code,
+// quotes and tables, along with emphasis and links. Any HTML of the source is
+// escaped, rather than passed through, so the output is safe to embed.
+//
+// https://github.github.com/gfm/
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	commentRe   = regexp.MustCompile(`(?s)<!--.*?-->`)
+	headingRe   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	fenceRe     = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^`\\s]*)")
+	ruleRe      = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	quoteRe     = regexp.MustCompile(`^ {0,3}> ?`)
+	itemRe      = regexp.MustCompile(`^( *)([-*+]|\d{1,9}[.)])(?:[ \t]+(.*))?$`)
+	setextRe    = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	delimiterRe = regexp.MustCompile(`^ *\|? *:?-+:? *(?:\| *:?-+:? *)*\|? *$`)
+)
+
+// Render renders the Markdown source as HTML.
+func Render(src string) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = commentRe.ReplaceAllString(src, "")
+	var b strings.Builder
+	render(&b, strings.Split(src, "\n"))
+	return b.String()
+}
+
+func render(b *strings.Builder, lines []string) {
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			fmt.Fprintf(b, "<p>%s</p>\n", inline(strings.Join(para, "\n")))
+			para = nil
+		}
+	}
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+			i++
+		case fenceRe.MatchString(line):
+			flush()
+			i = fence(b, lines, i)
+		case headingRe.MatchString(line):
+			flush()
+			m := headingRe.FindStringSubmatch(line)
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", len(m[1]), inline(m[2]), len(m[1]))
+			i++
+		case len(para) > 0 && setextRe.MatchString(line):
+			level := 2
+			if strings.HasPrefix(strings.TrimSpace(line), "=") {
+				level = 1
+			}
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", level, inline(strings.Join(para, "\n")), level)
+			para = nil
+			i++
+		case ruleRe.MatchString(line):
+			flush()
+			b.WriteString("<hr>\n")
+			i++
+		case quoteRe.MatchString(line):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && quoteRe.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quoteRe.ReplaceAllString(lines[i], ""))
+			}
+			b.WriteString("<blockquote>\n")
+			render(b, quoted)
+			b.WriteString("</blockquote>\n")
+		case itemRe.MatchString(line) && (len(para) == 0 || itemStartsList(line)):
+			flush()
+			i = list(b, lines, i)
+		case len(para) == 0 && strings.Contains(line, "|") && i+1 < len(lines) && delimiterRe.MatchString(lines[i+1]):
+			i = table(b, lines, i)
+		default:
+			para = append(para, strings.TrimSpace(line))
+			i++
+		}
+	}
+	flush()
+}
+
+// itemStartsList tells whether the list item may interrupt a paragraph, which
+// ordered lists only may when starting with 1.
+func itemStartsList(line string) bool {
+	m := itemRe.FindStringSubmatch(line)
+	if m[3] == "" {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimRight(m[2], ".)"))
+	return err != nil || n == 1
+}
+
+func fence(b *strings.Builder, lines []string, i int) int {
+	m := fenceRe.FindStringSubmatch(lines[i])
+	var code []string
+	for i++; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]) && strings.TrimSpace(strings.Trim(lines[i], m[1][:1])) == "" {
+			i++
+			break
+		}
+		code = append(code, lines[i])
+	}
+
+	b.WriteString("<pre><code")
+	if m[2] != "" {
+		fmt.Fprintf(b, ` class="language-%s"`, html.EscapeString(m[2]))
+	}
+	b.WriteString(">")
+	for _, l := range code {
+		b.WriteString(html.EscapeString(l))
+		b.WriteString("\n")
+	}
+	b.WriteString("</code></pre>\n")
+	return i
+}
+
+// list renders the list starting at the line, with the lines indented past
+// the markers of the items, or continuing them, being part of the items.
+func list(b *strings.Builder, lines []string, i int) int {
+	first := itemRe.FindStringSubmatch(lines[i])
+	var (
+		indent  = len(first[1])
+		ordered = first[2][0] >= '0' && first[2][0] <= '9'
+		items   [][]string
+		blank   bool
+	)
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" {
+			blank = true
+			continue
+		}
+
+		m := itemRe.FindStringSubmatch(line)
+		lineIndent := len(line) - len(strings.TrimLeft(line, " "))
+		switch {
+		case m != nil && len(m[1]) == indent && isOrdered(m[2]) == ordered:
+			items = append(items, []string{m[3]})
+		case lineIndent > indent:
+			// Indented lines belong to the item, keeping the indentation
+			// relative to it, for nested lists and code.
+			items[len(items)-1] = append(items[len(items)-1], strings.Repeat(" ", max(lineIndent-indent-2, 0))+strings.TrimLeft(line, " "))
+		case !blank && m == nil && !startsBlock(line):
+			// A lazy continuation of the paragraph of the item.
+			items[len(items)-1] = append(items[len(items)-1], strings.TrimSpace(line))
+		default:
+			return writeList(b, ordered, first[2], items, i)
+		}
+		blank = false
+	}
+	return writeList(b, ordered, first[2], items, i)
+}
+
+func writeList(b *strings.Builder, ordered bool, marker string, items [][]string, i int) int {
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if n, err := strconv.Atoi(strings.TrimRight(marker, ".)")); err == nil && n != 1 {
+			fmt.Fprintf(b, "<ol start=\"%d\">\n", n)
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+
+	for _, item := range items {
+		b.WriteString("<li>")
+		// The leading text of the item is rendered without a paragraph, as in
+		// tight lists, followed by any blocks of its own.
+		n := 0
+		for n < len(item) && strings.TrimSpace(item[n]) != "" && (n == 0 || !startsBlock(item[n])) {
+			n++
+		}
+		b.WriteString(inline(strings.TrimSpace(strings.Join(item[:n], "\n"))))
+		if n < len(item) {
+			b.WriteString("\n")
+			render(b, item[n:])
+		}
+		b.WriteString("</li>\n")
+	}
+	fmt.Fprintf(b, "</%s>\n", tag)
+	return i
+}
+
+func isOrdered(marker string) bool {
+	return marker[0] >= '0' && marker[0] <= '9'
+}
+
+func startsBlock(line string) bool {
+	return fenceRe.MatchString(line) || headingRe.MatchString(line) || ruleRe.MatchString(line) ||
+		quoteRe.MatchString(line) || itemRe.MatchString(line)
+}
+
+func table(b *strings.Builder, lines []string, i int) int {
+	header := cells(lines[i])
+	var align []string
+	for _, c := range cells(lines[i+1]) {
+		switch {
+		case strings.HasPrefix(c, ":") && strings.HasSuffix(c, ":"):
+			align = append(align, ` style="text-align:center"`)
+		case strings.HasSuffix(c, ":"):
+			align = append(align, ` style="text-align:right"`)
+		case strings.HasPrefix(c, ":"):
+			align = append(align, ` style="text-align:left"`)
+		default:
+			align = append(align, "")
+		}
+	}
+
+	row := func(tag string, cs []string) {
+		b.WriteString("<tr>")
+		for n := range header {
+			var c, a string
+			if n < len(cs) {
+				c = cs[n]
+			}
+			if n < len(align) {
+				a = align[n]
+			}
+			fmt.Fprintf(b, "<%s%s>%s</%s>", tag, a, inline(c), tag)
+		}
+		b.WriteString("</tr>\n")
+	}
+
+	b.WriteString("<table>\n<thead>\n")
+	row("th", header)
+	b.WriteString("</thead>\n<tbody>\n")
+	for i += 2; i < len(lines) && strings.TrimSpace(lines[i]) != "" && strings.Contains(lines[i], "|") && !startsBlock(lines[i]); i++ {
+		row("td", cells(lines[i]))
+	}
+	b.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+// cells splits the row of a table into its cells, on the pipes that aren't
+// escaped.
+func cells(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+
+	var (
+		cs   []string
+		cell strings.Builder
+		code bool
+	)
+	for n := 0; n < len(line); n++ {
+		switch c := line[n]; {
+		case c == '\\' && n+1 < len(line) && line[n+1] == '|':
+			cell.WriteByte('|')
+			n++
+		case c == '`':
+			code = !code
+			cell.WriteByte(c)
+		case c == '|' && !code:
+			cs = append(cs, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(c)
+		}
+	}
+	return append(cs, strings.TrimSpace(cell.String()))
+}
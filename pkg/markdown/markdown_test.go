@@ -0,0 +1,45 @@
+package markdown
+
+import (
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		exp  string
+	}{
+		{"heading", "# Title #\n## Sub", "<h1>Title</h1>\n<h2>Sub</h2>\n"},
+		{"setext", "Title\n=====\nSub\n---", "<h1>Title</h1>\n<h2>Sub</h2>\n"},
+		{"paragraphs", "one\ntwo\n\nthree", "<p>one\ntwo</p>\n<p>three</p>\n"},
+		{"html", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"comments", "<!-- BEGIN_TF_DOCS -->\ntext\n<!-- END_TF_DOCS -->", "<p>text</p>\n"},
+		{"rule", "a\n\n***\n\nb", "<p>a</p>\n<hr>\n<p>b</p>\n"},
+		{
+			"fence",
+			"```hcl\nmodule \"x\" {\n  a = \"<b>\"\n}\n```\nafter",
+			"<pre><code class=\"language-hcl\">module &#34;x&#34; {\n  a = &#34;&lt;b&gt;&#34;\n}\n</code></pre>\n<p>after</p>\n",
+		},
+		{"quote", "> quoted\n> text", "<blockquote>\n<p>quoted\ntext</p>\n</blockquote>\n"},
+		{"list", "- one\n- two\n  more\n- three", "<ul>\n<li>one</li>\n<li>two\nmore</li>\n<li>three</li>\n</ul>\n"},
+		{"ordered", "3. three\n4. four", "<ol start=\"3\">\n<li>three</li>\n<li>four</li>\n</ol>\n"},
+		{
+			"nested",
+			"- one\n  - nested\n- two",
+			"<ul>\n<li>one\n<ul>\n<li>nested</li>\n</ul>\n</li>\n<li>two</li>\n</ul>\n",
+		},
+		{
+			"table",
+			"| Name | Default |\n|------|:-------:|\n| `a\\|b` | `null` |\n| c | |",
+			"<table>\n<thead>\n<tr><th>Name</th><th style=\"text-align:center\">Default</th></tr>\n</thead>\n<tbody>\n" +
+				"<tr><td><code>a|b</code></td><td style=\"text-align:center\"><code>null</code></td></tr>\n" +
+				"<tr><td>c</td><td style=\"text-align:center\"></td></tr>\n</tbody>\n</table>\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := Render(tt.src); got != tt.exp {
+			t.Errorf("%s: expected\n%q\ngot\n%q", tt.name, tt.exp, got)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+// defaultTokenExpiry is used for tokens that don't specify their expiry, as
+// suggested by the token authentication specification.
+const defaultTokenExpiry = 60 * time.Second
+
+// challenge is a parsed `WWW-Authenticate` header.
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenge parses an authentication challenge, such as
+// `Bearer realm="https://auth.example.com/token",service="registry"`. We only
+// care about the first challenge, since that's all registries ever send.
+func parseChallenge(header string) (challenge, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if scheme == "" {
+		return challenge{}, false
+	}
+
+	c := challenge{
+		scheme: strings.ToLower(scheme),
+		params: make(map[string]string),
+	}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			// Quoted values may contain commas, so find the closing quote,
+			// taking any escaped characters into account.
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			c.params[key] = b.String()
+			rest = value[min(i+1, len(value)):]
+		} else {
+			v, r, _ := strings.Cut(value, ",")
+			c.params[key] = strings.TrimSpace(v)
+			rest = r
+		}
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return c, true
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// tokens caches bearer tokens per repository.
+type tokens struct {
+	mu    sync.Mutex
+	items map[string]token
+}
+
+func (t *tokens) get(repository string, now time.Time) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tok, ok := t.items[repository]; ok && now.Before(tok.expires) {
+		return tok.value, true
+	}
+	return "", false
+}
+
+func (t *tokens) set(repository string, tok token) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.items == nil {
+		t.items = make(map[string]token)
+	}
+	t.items[repository] = tok
+}
+
+// fetchToken retrieves a bearer token from the realm of the challenge.
+//
+// https://distribution.github.io/distribution/spec/auth/token/
+func (s *Service) fetchToken(ctx context.Context, c challenge, repository string) (token, error) {
+	realm := c.params["realm"]
+	if realm == "" {
+		return token{}, fmt.Errorf("challenge without realm")
+	}
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return token{}, fmt.Errorf("parsing realm: %w", err)
+	}
+	q := u.Query()
+	if service := c.params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := c.params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repository)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return token{}, fmt.Errorf("new request: %w", err)
+	}
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return token{}, fmt.Errorf("executing token request: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return token{}, &backend.Error{
+			Code: res.StatusCode,
+			Msg:  backend.Slurp(res.Body),
+		}
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if cerr := res.Body.Close(); cerr != nil {
+		return token{}, fmt.Errorf("closing response: %w", cerr)
+	}
+	if err != nil {
+		return token{}, fmt.Errorf("decoding token response: %w", err)
+	}
+
+	tok := token{
+		value:   body.Token,
+		expires: s.now().Add(defaultTokenExpiry),
+	}
+	if tok.value == "" {
+		tok.value = body.AccessToken
+	}
+	if tok.value == "" {
+		return token{}, fmt.Errorf("empty token in response")
+	}
+	if body.ExpiresIn > 0 {
+		tok.expires = s.now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return tok, nil
+}
@@ -0,0 +1,305 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+const (
+	manifestTypes = "application/vnd.oci.image.manifest.v1+json, " +
+		"application/vnd.docker.distribution.manifest.v2+json"
+	tagsPerPage = 100
+)
+
+// repositoryName matches a valid path component of an OCI repository name,
+// and tagName a valid tag.
+//
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pulling-manifests
+var (
+	repositoryName = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*$`)
+	tagName        = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+type Config struct {
+	URL          string              `envconfig:"URL"`
+	Prefix       string              `envconfig:"PREFIX"`
+	MediaType    string              `envconfig:"MEDIA_TYPE"`
+	Username     string              `envconfig:"USERNAME"`
+	Password     string              `envconfig:"PASSWORD"`
+	Repositories map[string][]string `envconfig:"REPOSITORIES"`
+	OrgMappings  map[string]string   `envconfig:"ORG_MAPPINGS"`
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func New(cfg Config, c HTTPClient) *Service {
+	return &Service{
+		cfg:    cfg,
+		client: c,
+		now:    time.Now,
+	}
+}
+
+// Service implements the modules repository on top of an OCI registry, where
+// each module is stored in a repository named `<prefix>/<owner>/<repo>/<module>`,
+// with the versions as tags. The module archive is expected to be a single
+// layer of the image, or the one with the configured media type.
+//
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md
+type Service struct {
+	cfg    Config
+	client HTTPClient
+	now    func() time.Time
+	tokens tokens
+}
+
+func (s *Service) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
+	owner := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, owner, repo); err != nil {
+		return nil, err
+	}
+
+	name, err := s.repository(owner, repo, module)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []string{}
+	uri := fmt.Sprintf("/v2/%s/tags/list?n=%d", name, tagsPerPage)
+	for uri != "" {
+		res, err := s.makeRequest(ctx, name, uri, "application/json")
+		if err != nil {
+			return nil, err
+		}
+
+		var tags struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&tags)
+		cerr := res.Body.Close()
+		if cerr != nil {
+			return nil, fmt.Errorf("closing response: %w", cerr)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+
+		versions = append(versions, tags.Tags...)
+		uri = nextLink(res.Header.Get("Link"))
+	}
+	return versions, nil
+}
+
+func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
+	owner := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, owner, repo); err != nil {
+		return err
+	}
+
+	name, err := s.repository(owner, repo, module)
+	if err != nil {
+		return err
+	}
+
+	layer, err := s.layer(ctx, name, version)
+	if err != nil {
+		return err
+	}
+
+	algo, digest, ok := strings.Cut(layer.Digest, ":")
+	if !ok || algo != "sha256" {
+		return fmt.Errorf("unsupported layer digest %q", layer.Digest)
+	}
+
+	res, err := s.makeRequest(ctx, name, fmt.Sprintf("/v2/%s/blobs/%s", name, layer.Digest), "*/*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			slog.Warn("error closing response body", "err", err)
+		}
+	}()
+
+	// Blobs are content addressable, so we verify that we actually got what
+	// we asked for. By the time we know, we've already streamed it, but at
+	// least we can make sure that the request fails, and that it isn't cached.
+	h := sha256.New()
+	if _, err := io.Copy(w, io.TeeReader(res.Body, h)); err != nil {
+		return fmt.Errorf("copying blob: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != digest {
+		return &backend.Error{
+			Code: http.StatusBadGateway,
+			Msg:  fmt.Sprintf("blob digest mismatch, expected %s, got %s", digest, got),
+		}
+	}
+	return nil
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// layer finds the layer of the manifest of the tag, which contains the module.
+func (s *Service) layer(ctx context.Context, name, tag string) (*descriptor, error) {
+	if !tagName.MatchString(tag) {
+		return nil, &backend.Error{
+			Code: http.StatusBadRequest,
+			Msg:  "invalid version",
+		}
+	}
+
+	res, err := s.makeRequest(ctx, name, fmt.Sprintf("/v2/%s/manifests/%s", name, tag), manifestTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest struct {
+		Layers []descriptor `json:"layers"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&manifest)
+	if cerr := res.Body.Close(); cerr != nil {
+		return nil, fmt.Errorf("closing response: %w", cerr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+
+	if s.cfg.MediaType != "" {
+		for _, l := range manifest.Layers {
+			if l.MediaType == s.cfg.MediaType {
+				return &l, nil
+			}
+		}
+		return nil, fmt.Errorf("no layer with media type %s", s.cfg.MediaType)
+	}
+	if len(manifest.Layers) != 1 {
+		return nil, fmt.Errorf("expected a single layer, got %d", len(manifest.Layers))
+	}
+	return &manifest.Layers[0], nil
+}
+
+// repository returns the name of the OCI repository of the module.
+func (s *Service) repository(owner, repo, module string) (string, error) {
+	var elems []string
+	if prefix := strings.Trim(s.cfg.Prefix, "/"); prefix != "" {
+		elems = append(elems, prefix)
+	}
+	for _, e := range append(strings.Split(owner, "/"), repo, module) {
+		if !repositoryName.MatchString(e) {
+			return "", &backend.Error{
+				Code: http.StatusBadRequest,
+				Msg:  "invalid repository name",
+			}
+		}
+		elems = append(elems, e)
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// makeRequest issues a request to the registry. If the registry challenges us
+// to authenticate, we do so, and retry the request once with the credentials.
+func (s *Service) makeRequest(ctx context.Context, repository, uri, accept string) (*http.Response, error) {
+	do := func(auth string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(s.cfg.URL, "/")+uri, nil)
+		if err != nil {
+			return nil, fmt.Errorf("new request: %w", err)
+		}
+		req.Header.Add("Accept", accept)
+		if auth != "" {
+			req.Header.Add("Authorization", auth)
+		}
+
+		res, err := s.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("executing request: %w", err)
+		}
+		return res, nil
+	}
+
+	var auth string
+	if tok, ok := s.tokens.get(repository, s.now()); ok {
+		auth = "Bearer " + tok
+	}
+
+	res, err := do(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		c, ok := parseChallenge(res.Header.Get("WWW-Authenticate"))
+		if ok {
+			_ = backend.Slurp(res.Body)
+
+			switch c.scheme {
+			case "bearer":
+				tok, err := s.fetchToken(ctx, c, repository)
+				if err != nil {
+					return nil, fmt.Errorf("fetching token: %w", err)
+				}
+				s.tokens.set(repository, tok)
+				auth = "Bearer " + tok.value
+			case "basic":
+				auth = "Basic " + basicAuth(s.cfg.Username, s.cfg.Password)
+			default:
+				return nil, fmt.Errorf("unsupported authentication scheme %q", c.scheme)
+			}
+
+			if res, err = do(auth); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &backend.Error{
+			Code: res.StatusCode,
+			Msg:  backend.Slurp(res.Body),
+		}
+	}
+	return res, nil
+}
+
+// nextLink returns the URI of the next page from an RFC 5988 `Link` header,
+// if there is one.
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		target = strings.Trim(strings.TrimSpace(target), "<>")
+		if u, err := url.Parse(target); err == nil {
+			return u.RequestURI()
+		}
+	}
+	return ""
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
@@ -0,0 +1,211 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+type mockRegistry struct {
+	*httptest.Server
+	tokenRequests atomic.Int32
+}
+
+// newMockRegistry starts a minimal registry, mimicking `registry:2` with token
+// authentication, serving a single module repository.
+func newMockRegistry(t *testing.T, blob []byte) *mockRegistry {
+	t.Helper()
+
+	var (
+		m      = &mockRegistry{}
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+		tags   = []string{"v1.0.0", "v1.1.0", "v2.0.0"}
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /token", func(w http.ResponseWriter, r *http.Request) {
+		m.tokenRequests.Add(1)
+		user, pass, _ := r.BasicAuth()
+		if user != "test-user" || pass != "test-pass" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("scope") != "repository:test-org/test-repo/module:pull" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"token": "test-token", "expires_in": 300})
+	})
+
+	authenticated := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer test-token" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+					`Bearer realm="%s/token",service="registry",scope="repository:test-org/test-repo/module:pull"`, m.URL))
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+
+	mux.HandleFunc("GET /v2/test-org/test-repo/module/tags/list", authenticated(func(w http.ResponseWriter, r *http.Request) {
+		// Serve the tags two at a time, to exercise the pagination.
+		last := r.URL.Query().Get("last")
+		start := 0
+		if last != "" {
+			start = slices.Index(tags, last) + 1
+		}
+		end := min(start+2, len(tags))
+		if end < len(tags) {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/test-org/test-repo/module/tags/list?n=2&last=%s>; rel="next"`, tags[end-1]))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"name": "test-org/test-repo/module", "tags": tags[start:end]})
+	}))
+	mux.HandleFunc("GET /v2/test-org/test-repo/module/manifests/{tag}", authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(tags, r.PathValue("tag")) {
+			http.Error(w, "MANIFEST_UNKNOWN", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+			"layers": []map[string]any{
+				{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": digest, "size": len(blob)},
+			},
+		})
+	}))
+	mux.HandleFunc("GET /v2/test-org/test-repo/module/blobs/{digest}", authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("digest") != digest {
+			http.Error(w, "BLOB_UNKNOWN", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	}))
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func testConfig(url string) Config {
+	return Config{
+		URL:         url,
+		Username:    "test-user",
+		Password:    "test-pass",
+		OrgMappings: map[string]string{"test-system": "test-org"},
+	}
+}
+
+func TestService_ListVersions(t *testing.T) {
+	registry := newMockRegistry(t, nil)
+	service := New(testConfig(registry.URL), registry.Client())
+
+	versions, err := service.ListVersions(context.Background(), "test-system", "test-repo", "module")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"v1.0.0", "v1.1.0", "v2.0.0"}
+	if !slices.Equal(versions, expected) {
+		t.Errorf("expected versions %q, got %q", expected, versions)
+	}
+	if n := registry.tokenRequests.Load(); n != 1 {
+		t.Errorf("expected the token to be reused, got %d token requests", n)
+	}
+}
+
+func TestService_ProxyDownload(t *testing.T) {
+	blob := []byte("fake tarball content")
+	registry := newMockRegistry(t, blob)
+	service := New(testConfig(registry.URL), registry.Client())
+
+	var buf bytes.Buffer
+	err := service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v1.1.0", &buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), blob) {
+		t.Errorf("expected content %q, got %q", blob, buf.Bytes())
+	}
+
+	err = service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v9.9.9", io.Discard)
+	var herr *backend.Error
+	if !errors.As(err, &herr) || herr.StatusCode() != http.StatusNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestService_ProxyDownload_DigestMismatch(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			body := "tampered content"
+			if strings.Contains(req.URL.Path, "/manifests/") {
+				sum := sha256.Sum256([]byte("original content"))
+				body = fmt.Sprintf(`{"layers":[{"digest":"sha256:%s"}]}`, hex.EncodeToString(sum[:]))
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(body)),
+			}, nil
+		},
+	}
+	service := New(testConfig("https://registry.example.com"), mockClient)
+
+	err := service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v1.0.0", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("expected digest mismatch error, got %v", err)
+	}
+}
+
+func TestService_InvalidRepository(t *testing.T) {
+	service := New(testConfig("https://registry.example.com"), nil)
+
+	_, err := service.ListVersions(context.Background(), "test-system", "Test_Repo", "module")
+	var herr *backend.Error
+	if !errors.As(err, &herr) || herr.StatusCode() != http.StatusBadRequest {
+		t.Errorf("expected bad request error, got %v", err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	c, ok := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a/b:pull,push"`)
+	if !ok {
+		t.Fatal("expected a challenge")
+	}
+	if c.scheme != "bearer" {
+		t.Errorf("unexpected scheme %q", c.scheme)
+	}
+	expected := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:a/b:pull,push",
+	}
+	for k, v := range expected {
+		if c.params[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, c.params[k])
+		}
+	}
+}
+
+type mockHTTPClient struct {
+	doFunc func(req *http.Request) (*http.Response, error)
+}
+
+func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return m.doFunc(req)
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package openpgp reads just enough of ASCII armored OpenPGP public keys to
+// tell their key IDs, which the provider registry protocol serves along with
+// the keys.
+//
+// https://www.rfc-editor.org/rfc/rfc4880
+package openpgp
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	armorHeader = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	armorFooter = "-----END PGP PUBLIC KEY BLOCK-----"
+
+	tagPublicKey = 6
+)
+
+var ErrInvalid = errors.New("invalid public key")
+
+// KeyID returns the ID of the primary key of the ASCII armored public key, as
+// upper case hex.
+func KeyID(armored string) (string, error) {
+	packets, err := dearmor(armored)
+	if err != nil {
+		return "", err
+	}
+
+	tag, body, err := packet(packets)
+	if err != nil {
+		return "", err
+	}
+	if tag != tagPublicKey {
+		return "", fmt.Errorf("%w: expected a public key packet, got %d", ErrInvalid, tag)
+	}
+	if len(body) == 0 || body[0] != 4 {
+		return "", fmt.Errorf("%w: only version 4 keys are supported", ErrInvalid)
+	}
+
+	// The fingerprint of version 4 keys is the SHA-1 of the packet, with an
+	// old format header, and the key ID is the end of it.
+	h := sha1.New()
+	h.Write([]byte{0x99})
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(body))))
+	h.Write(body)
+	return fmt.Sprintf("%X", h.Sum(nil)[12:]), nil
+}
+
+// dearmor returns the packets of the armored key, leaving out the checksum.
+func dearmor(armored string) ([]byte, error) {
+	var (
+		s       = bufio.NewScanner(strings.NewReader(armored))
+		inBlock bool
+		inBody  bool
+		encoded strings.Builder
+	)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case !inBlock:
+			inBlock = line == armorHeader
+		case line == armorFooter:
+			b, err := base64.StdEncoding.DecodeString(encoded.String())
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+			}
+			return b, nil
+		case !inBody:
+			// The armor headers end with an empty line.
+			inBody = line == ""
+		case strings.HasPrefix(line, "="):
+			// The checksum.
+		default:
+			encoded.WriteString(line)
+		}
+	}
+	return nil, fmt.Errorf("%w: no armored public key block", ErrInvalid)
+}
+
+// packet returns the tag and body of the first packet.
+func packet(b []byte) (int, []byte, error) {
+	if len(b) == 0 || b[0]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("%w: not a packet", ErrInvalid)
+	}
+
+	var (
+		tag    int
+		length int
+		rest   []byte
+	)
+	if b[0]&0x40 != 0 {
+		// The new format, where the length takes one, two or five octets,
+		// unless it's a partial one, which public keys can't have.
+		tag = int(b[0] & 0x3f)
+		switch {
+		case len(b) < 2:
+			return 0, nil, fmt.Errorf("%w: truncated packet", ErrInvalid)
+		case b[1] < 192:
+			length, rest = int(b[1]), b[2:]
+		case b[1] < 224 && len(b) >= 3:
+			length, rest = (int(b[1])-192)<<8+int(b[2])+192, b[3:]
+		case b[1] == 255 && len(b) >= 6:
+			length, rest = int(binary.BigEndian.Uint32(b[2:6])), b[6:]
+		default:
+			return 0, nil, fmt.Errorf("%w: unsupported packet length", ErrInvalid)
+		}
+	} else {
+		// The old format, where the length takes one, two or four octets.
+		tag = int(b[0]>>2) & 0x0f
+		switch n := 1 << (b[0] & 0x03); {
+		case n > 4:
+			return 0, nil, fmt.Errorf("%w: indeterminate packet length", ErrInvalid)
+		case len(b) < 1+n:
+			return 0, nil, fmt.Errorf("%w: truncated packet", ErrInvalid)
+		default:
+			for _, o := range b[1 : 1+n] {
+				length = length<<8 | int(o)
+			}
+			rest = b[1+n:]
+		}
+	}
+
+	if length > len(rest) {
+		return 0, nil, fmt.Errorf("%w: truncated packet", ErrInvalid)
+	}
+	return tag, rest[:length], nil
+}
@@ -0,0 +1,46 @@
+package openpgp
+
+import (
+	"errors"
+	"testing"
+)
+
+// testKey was exported by `gpg --armor --export`, with the key ID below.
+const (
+	testKey = `
+-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEatLKLhYJKwYBBAHaRw8BAQdA58uethPRcpL+pMKek8ui2GtjGMhFNS00EirH
+mui9kc20HU9yYml0IFRlc3QgPHRlc3RAZXhhbXBsZS5jb20+iJAEExYIADgWIQS5
+fZPuUOWyUCXWy+xAg4gl/rw7tQUCatLKLgIbAwULCQgHAgYVCgkICwIEFgIDAQIe
+AQIXgAAKCRBAg4gl/rw7tQAHAQCEP1YAUdIi3BwPwGU1y9813fQyrPnzWQ33MeV+
+bLA6rwEAr4AxsuxEWoeeYpE/tNXGQnHwUQPt8ulb2gqK+AVVRws=
+=hOYh
+-----END PGP PUBLIC KEY BLOCK-----
+`
+	testKeyID = "40838825FEBC3BB5"
+)
+
+func TestKeyID(t *testing.T) {
+	id, err := KeyID(testKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != testKeyID {
+		t.Errorf("expected %s, got %s", testKeyID, id)
+	}
+}
+
+func TestKeyID_Invalid(t *testing.T) {
+	for name, armored := range map[string]string{
+		"empty":     "",
+		"no_block":  "not a key",
+		"truncated": "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nmDME\n-----END PGP PUBLIC KEY BLOCK-----",
+		"base64":    "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\n!!!\n-----END PGP PUBLIC KEY BLOCK-----",
+		"not_a_key": "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nAAAA\n-----END PGP PUBLIC KEY BLOCK-----",
+	} {
+		if _, err := KeyID(armored); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected ErrInvalid, got %v", name, err)
+		}
+	}
+}
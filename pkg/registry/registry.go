@@ -0,0 +1,236 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package registry is a client of the provider registry protocol, for
+// mirroring the providers of other registries, like the public one.
+//
+// https://developer.hashicorp.com/terraform/internals/provider-registry-protocol
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+// segmentRe matches the namespaces, types, versions and platforms making up
+// the paths of the protocol, which keeps them from leaving the service.
+var segmentRe = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z_.+-]*$`)
+
+type Config struct {
+	Hosts []string `envconfig:"HOSTS" default:"registry.terraform.io"`
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func New(cfg Config, c HTTPClient) *Client {
+	return &Client{
+		cfg:      cfg,
+		client:   c,
+		services: map[string]*url.URL{},
+	}
+}
+
+// Client requests the providers of the registries at the configured hosts,
+// which are found by the service discovery of each, over HTTPS.
+//
+// https://developer.hashicorp.com/terraform/internals/remote-service-discovery
+type Client struct {
+	cfg    Config
+	client HTTPClient
+
+	mu       sync.Mutex
+	services map[string]*url.URL
+}
+
+// Version is a version of a provider, and the platforms it's available for.
+type Version struct {
+	Version   string     `json:"version"`
+	Platforms []Platform `json:"platforms"`
+}
+
+type Platform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+// Package is the package of a version of a provider for a platform, with the
+// download URL resolved.
+type Package struct {
+	Filename    string `json:"filename"`
+	DownloadURL string `json:"download_url"`
+	Shasum      string `json:"shasum"`
+}
+
+// ProviderVersions returns the versions of the provider.
+func (c *Client) ProviderVersions(ctx context.Context, hostname, namespace, typ string) ([]Version, error) {
+	var res struct {
+		Versions []Version `json:"versions"`
+	}
+	if _, err := c.getJSON(ctx, hostname, []string{namespace, typ, "versions"}, &res); err != nil {
+		return nil, err
+	}
+	return res.Versions, nil
+}
+
+// ProviderPackage returns the package of the version of the provider for the
+// platform.
+func (c *Client) ProviderPackage(ctx context.Context, hostname, namespace, typ, version, os, arch string) (Package, error) {
+	var p Package
+	u, err := c.getJSON(ctx, hostname, []string{namespace, typ, version, "download", os, arch}, &p)
+	if err != nil {
+		return p, err
+	}
+
+	// The URL may be relative to the one it was given by.
+	download, err := u.Parse(p.DownloadURL)
+	if err != nil {
+		return p, fmt.Errorf("parsing download URL: %w", err)
+	}
+	p.DownloadURL = download.String()
+	return p, nil
+}
+
+// Download writes what's at the URL, typically the download URL of a package.
+func (c *Client) Download(ctx context.Context, rawURL string, w io.Writer) error {
+	res, err := c.get(ctx, rawURL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			slog.Warn("error closing response body", "err", err)
+		}
+	}()
+
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return fmt.Errorf("copying response: %w", err)
+	}
+	return nil
+}
+
+// getJSON decodes the response of the providers service of the registry at
+// the path, returning the URL of it.
+func (c *Client) getJSON(ctx context.Context, hostname string, path []string, v any) (*url.URL, error) {
+	for _, s := range path {
+		if !segmentRe.MatchString(s) {
+			return nil, &backend.Error{
+				Code: http.StatusBadRequest,
+				Msg:  fmt.Sprintf("invalid path segment %q", s),
+			}
+		}
+	}
+
+	base, err := c.discover(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	u, err := base.Parse(strings.Join(path, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing path: %w", err)
+	}
+
+	res, err := c.get(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(res.Body).Decode(v)
+	cerr := res.Body.Close()
+	if cerr != nil {
+		return nil, fmt.Errorf("closing response: %w", cerr)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return u, nil
+}
+
+// discover returns the base URL of the providers service of the registry,
+// which is looked up once per host.
+func (c *Client) discover(ctx context.Context, hostname string) (*url.URL, error) {
+	if !slices.Contains(c.cfg.Hosts, hostname) {
+		return nil, &backend.Error{
+			Code: http.StatusForbidden,
+			Msg:  "not a valid registry",
+		}
+	}
+
+	c.mu.Lock()
+	base, ok := c.services[hostname]
+	c.mu.Unlock()
+	if ok {
+		return base, nil
+	}
+
+	discovery := &url.URL{Scheme: "https", Host: hostname, Path: "/.well-known/terraform.json"}
+	res, err := c.get(ctx, discovery.String())
+	if err != nil {
+		return nil, err
+	}
+	var services struct {
+		Providers string `json:"providers.v1"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&services)
+	cerr := res.Body.Close()
+	if cerr != nil {
+		return nil, fmt.Errorf("closing response: %w", cerr)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	if services.Providers == "" {
+		return nil, &backend.Error{
+			Code: http.StatusNotFound,
+			Msg:  "registry doesn't serve providers",
+		}
+	}
+
+	// The base URL may be relative to the discovery document, and the paths
+	// are relative to it, so it must end with a slash.
+	base, err = discovery.Parse(services.Providers)
+	if err != nil {
+		return nil, fmt.Errorf("parsing providers URL: %w", err)
+	}
+	if base.Path == "" || base.Path[len(base.Path)-1] != '/' {
+		base.Path += "/"
+	}
+
+	c.mu.Lock()
+	c.services[hostname] = base
+	c.mu.Unlock()
+	return base, nil
+}
+
+func (c *Client) get(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &backend.Error{
+			Code: res.StatusCode,
+			Msg:  backend.Slurp(res.Body),
+		}
+	}
+	return res, nil
+}
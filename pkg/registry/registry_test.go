@@ -0,0 +1,106 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+func newMockRegistry(t *testing.T) (*httptest.Server, *Client) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/terraform.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"modules.v1":"/v1/modules/","providers.v1":"/v1/providers"}`))
+	})
+	mux.HandleFunc("GET /v1/providers/hashicorp/random/versions", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"versions":[{"version":"3.6.0","protocols":["5.0"],"platforms":[{"os":"linux","arch":"amd64"}]}]}`))
+	})
+	mux.HandleFunc("GET /v1/providers/hashicorp/random/3.6.0/download/linux/amd64", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"filename":"terraform-provider-random_3.6.0_linux_amd64.zip",` +
+			`"download_url":"/files/terraform-provider-random_3.6.0_linux_amd64.zip","shasum":"abc"}`))
+	})
+	mux.HandleFunc("GET /files/terraform-provider-random_3.6.0_linux_amd64.zip", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("zip content"))
+	})
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, New(Config{Hosts: []string{u.Host}}, srv.Client())
+}
+
+func TestClient(t *testing.T) {
+	srv, c := newMockRegistry(t)
+	host := srv.Listener.Addr().String()
+	ctx := context.Background()
+
+	versions, err := c.ProviderVersions(ctx, host, "hashicorp", "random")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := []Version{{Version: "3.6.0", Platforms: []Platform{{OS: "linux", Arch: "amd64"}}}}
+	if !slices.EqualFunc(versions, exp, func(a, b Version) bool {
+		return a.Version == b.Version && slices.Equal(a.Platforms, b.Platforms)
+	}) {
+		t.Errorf("expected %v, got %v", exp, versions)
+	}
+
+	p, err := c.ProviderPackage(ctx, host, "hashicorp", "random", "3.6.0", "linux", "amd64")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := srv.URL + "/files/terraform-provider-random_3.6.0_linux_amd64.zip"; p.DownloadURL != exp {
+		t.Errorf("expected the download URL %s, got %s", exp, p.DownloadURL)
+	}
+	if p.Filename != "terraform-provider-random_3.6.0_linux_amd64.zip" || p.Shasum != "abc" {
+		t.Errorf("unexpected package %+v", p)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Download(ctx, p.DownloadURL, &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != "zip content" {
+		t.Errorf("unexpected content %q", buf.String())
+	}
+
+	var herr *backend.Error
+	if _, err := c.ProviderVersions(ctx, host, "hashicorp", "missing"); !errors.As(err, &herr) || herr.Code != http.StatusNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestClient_Invalid(t *testing.T) {
+	srv, c := newMockRegistry(t)
+	host := srv.Listener.Addr().String()
+
+	tests := []struct {
+		name      string
+		host      string
+		namespace string
+		expStatus int
+	}{
+		{name: "host", host: "example.com", namespace: "hashicorp", expStatus: http.StatusForbidden},
+		{name: "segment", host: host, namespace: "..", expStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.ProviderVersions(context.Background(), tt.host, tt.namespace, "random")
+			var herr *backend.Error
+			if !errors.As(err, &herr) || herr.Code != tt.expStatus {
+				t.Errorf("expected status %d, got %v", tt.expStatus, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package resilient wraps the HTTP clients used for talking to the upstream
+// repositories, retrying failed requests with backoff, and failing fast with
+// a circuit breaker when an upstream keeps failing.
+package resilient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	MaxRetries       int           `envconfig:"MAX_RETRIES" default:"3"`
+	BaseDelay        time.Duration `envconfig:"BASE_DELAY" default:"100ms"`
+	MaxDelay         time.Duration `envconfig:"MAX_DELAY" default:"2s"`
+	BreakerThreshold int           `envconfig:"BREAKER_THRESHOLD" default:"5"`
+	BreakerTimeout   time.Duration `envconfig:"BREAKER_TIMEOUT" default:"30s"`
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func New(cfg Config, c HTTPClient) *Client {
+	return &Client{
+		cfg:      cfg,
+		client:   c,
+		now:      time.Now,
+		sleep:    sleep,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+// Client retries idempotent requests failing with network errors or server
+// errors, with jittered exponential backoff. Every host gets a circuit breaker
+// which opens after a number of consecutive failures, after which requests
+// fail immediately, until a trial request succeeds once the breaker timeout
+// has passed.
+type Client struct {
+	cfg    Config
+	client HTTPClient
+	now    func() time.Time
+	sleep  func(ctx context.Context, d time.Duration) error
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+var stateName = map[State]string{
+	StateClosed:   "closed",
+	StateOpen:     "open",
+	StateHalfOpen: "half-open",
+}
+
+func (s State) String() string {
+	return stateName[s]
+}
+
+// Stats are the retry and circuit breaker statistics of a host.
+type Stats struct {
+	Host     string
+	State    State
+	Retries  int
+	Failures int
+	Opened   int
+}
+
+type breaker struct {
+	state    State
+	failures int
+	openedAt time.Time
+	trial    bool
+
+	retries int
+	total   int
+	opened  int
+}
+
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	retries := c.cfg.MaxRetries
+	if !retryable(req) {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := c.allow(host); err != nil {
+			return nil, err
+		}
+
+		if attempt > 0 {
+			// The body of the previous attempt has been consumed, so we need
+			// a fresh copy of it.
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, fmt.Errorf("rewinding request body: %w", err)
+				}
+				req.Body = body
+			}
+		}
+
+		res, err := c.client.Do(req)
+		if err != nil && req.Context().Err() != nil {
+			// The caller giving up tells us nothing about the host, so the
+			// breaker is left as it was.
+			c.release(host)
+			return nil, err
+		}
+		failed := failure(res, err)
+		if open := c.record(host, failed); !failed || open || attempt >= retries {
+			return res, err
+		}
+
+		if res != nil {
+			// We won't be reading this response, but drain it to allow the
+			// connection to be reused.
+			_, _ = io.Copy(io.Discard, res.Body)
+			_ = res.Body.Close()
+		}
+
+		d := c.backoff(attempt)
+		slog.Warn("retrying upstream request", "host", host, "attempt", attempt+1, "delay", d, "err", err)
+		c.count(host)
+		if err := c.sleep(req.Context(), d); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Stats returns the retry and circuit breaker statistics of every host.
+func (c *Client) Stats() []Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := make([]Stats, 0, len(c.breakers))
+	for host, b := range c.breakers {
+		stats = append(stats, Stats{
+			Host:     host,
+			State:    c.state(b),
+			Retries:  b.retries,
+			Failures: b.total,
+			Opened:   b.opened,
+		})
+	}
+	return stats
+}
+
+// allow checks whether the breaker of the host lets the request through. Once
+// the timeout of an open breaker has passed, a single trial request is let
+// through, to see whether the host has recovered.
+func (c *Client) allow(host string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.breaker(host)
+	switch c.state(b) {
+	case StateOpen:
+		return &openErr{
+			host:       host,
+			retryAfter: b.openedAt.Add(c.cfg.BreakerTimeout).Sub(c.now()),
+		}
+	case StateHalfOpen:
+		if b.trial {
+			return &openErr{host: host, retryAfter: c.cfg.BaseDelay}
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// record the outcome of a request, opening the breaker once there are too
+// many consecutive failures, or if a trial request fails. It returns whether
+// the breaker is open, in which case there's no point in retrying.
+func (c *Client) record(host string, failed bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.breaker(host)
+	trial := b.trial
+	b.trial = false
+	if !failed {
+		b.state, b.failures = StateClosed, 0
+		return false
+	}
+
+	b.total++
+	b.failures++
+	if c.cfg.BreakerThreshold > 0 && (trial || b.failures >= c.cfg.BreakerThreshold) {
+		if b.state != StateOpen || trial {
+			slog.Warn("opening circuit breaker", "host", host, "failures", b.failures)
+			b.opened++
+		}
+		b.state, b.openedAt = StateOpen, c.now()
+	}
+	return b.state == StateOpen
+}
+
+// release lets another trial request through, without recording an outcome.
+func (c *Client) release(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.breaker(host).trial = false
+}
+
+func (c *Client) count(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.breaker(host).retries++
+}
+
+func (c *Client) breaker(host string) *breaker {
+	b, ok := c.breakers[host]
+	if !ok {
+		b = &breaker{}
+		c.breakers[host] = b
+	}
+	return b
+}
+
+// state returns the current state of the breaker, where an open breaker turns
+// half-open once its timeout has passed.
+func (c *Client) state(b *breaker) State {
+	if b.state == StateOpen && !c.now().Before(b.openedAt.Add(c.cfg.BreakerTimeout)) {
+		return StateHalfOpen
+	}
+	return b.state
+}
+
+// backoff returns the delay before the next attempt, using "full jitter", i.e.
+// a random delay up to the exponentially growing cap, which spreads out the
+// retries of many clients failing at the same time.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.cfg.BaseDelay << attempt
+	if d <= 0 || d > c.cfg.MaxDelay {
+		d = c.cfg.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// retryable returns whether the request is idempotent, and can be repeated.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// failure returns whether the outcome of the request is worth retrying. Any
+// error is, as is any server error except for the ones that won't go away by
+// trying again.
+func failure(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// ErrCircuitOpen is returned, wrapped, for requests to hosts whose circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type openErr struct {
+	host       string
+	retryAfter time.Duration
+}
+
+func (e *openErr) Error() string {
+	return fmt.Sprintf("%s: %s", e.host, ErrCircuitOpen)
+}
+
+func (e *openErr) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+func (e *openErr) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+func (e *openErr) RetryAfter() time.Duration {
+	return e.retryAfter
+}
@@ -0,0 +1,268 @@
+package resilient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockHTTPClient struct {
+	doFunc func(req *http.Request) (*http.Response, error)
+}
+
+func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return m.doFunc(req)
+}
+
+// statuses returns a mock client responding with the statuses in order, where
+// a zero status is a network error, and repeating the last one.
+func statuses(codes ...int) (*mockHTTPClient, *int) {
+	var n int
+	return &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			code := codes[min(n, len(codes)-1)]
+			n++
+			if code == 0 {
+				return nil, errors.New("connection reset")
+			}
+			return &http.Response{
+				StatusCode: code,
+				Body:       io.NopCloser(strings.NewReader(http.StatusText(code))),
+			}, nil
+		},
+	}, &n
+}
+
+func newClient(t *testing.T, c HTTPClient) (*Client, *time.Time) {
+	t.Helper()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	client := New(Config{
+		MaxRetries:       3,
+		BaseDelay:        100 * time.Millisecond,
+		MaxDelay:         time.Second,
+		BreakerThreshold: 5,
+		BreakerTimeout:   30 * time.Second,
+	}, c)
+	client.now = func() time.Time { return now }
+	client.sleep = func(ctx context.Context, d time.Duration) error {
+		if d < 0 || d > time.Second {
+			t.Errorf("unexpected backoff %s", d)
+		}
+		return ctx.Err()
+	}
+	return client, &now
+}
+
+func request(t *testing.T, method string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "https://example.com/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestClient_Retry(t *testing.T) {
+	mock, n := statuses(http.StatusBadGateway, 0, http.StatusOK)
+	client, _ := newClient(t, mock)
+
+	res, err := client.Do(request(t, http.MethodGet))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", res.StatusCode)
+	}
+	if *n != 3 {
+		t.Errorf("expected 3 attempts, got %d", *n)
+	}
+
+	stats := client.Stats()
+	if len(stats) != 1 || stats[0].Retries != 2 || stats[0].Failures != 2 || stats[0].State != StateClosed {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestClient_RetryExhausted(t *testing.T) {
+	mock, n := statuses(http.StatusServiceUnavailable)
+	client, _ := newClient(t, mock)
+
+	res, err := client.Do(request(t, http.MethodGet))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the last response, got %d", res.StatusCode)
+	}
+	if *n != 4 {
+		t.Errorf("expected 4 attempts, got %d", *n)
+	}
+}
+
+func TestClient_NoRetry(t *testing.T) {
+	tests := map[string]struct {
+		method string
+		code   int
+	}{
+		"post":        {http.MethodPost, http.StatusBadGateway},
+		"not_found":   {http.MethodGet, http.StatusNotFound},
+		"unsupported": {http.MethodGet, http.StatusNotImplemented},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			mock, n := statuses(tt.code, http.StatusOK)
+			client, _ := newClient(t, mock)
+
+			res, err := client.Do(request(t, tt.method))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.StatusCode != tt.code || *n != 1 {
+				t.Errorf("expected a single attempt, got %d attempts, status %d", *n, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestClient_Canceled(t *testing.T) {
+	mock, n := statuses(http.StatusBadGateway)
+	client, _ := newClient(t, mock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req := request(t, http.MethodGet).WithContext(ctx)
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled error, got %v", err)
+	}
+	if *n != 1 {
+		t.Errorf("expected a single attempt, got %d", *n)
+	}
+}
+
+func TestClient_CanceledBreaker(t *testing.T) {
+	mock, _ := statuses(0)
+	client, now := newClient(t, mock)
+	failing := mock.doFunc
+
+	fail := func() {
+		t.Helper()
+		mock.doFunc = failing
+		if _, err := client.Do(request(t, http.MethodGet)); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	cancel := func() {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		mock.doFunc = func(req *http.Request) (*http.Response, error) {
+			cancel()
+			return nil, req.Context().Err()
+		}
+		if _, err := client.Do(request(t, http.MethodGet).WithContext(ctx)); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected canceled error, got %v", err)
+		}
+	}
+
+	// A canceled request doesn't reset the failures, so the next failure
+	// still opens the breaker.
+	fail()
+	cancel()
+	if stats := client.Stats(); stats[0].State != StateClosed || stats[0].Failures != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	fail()
+	if stats := client.Stats(); stats[0].State != StateOpen {
+		t.Fatalf("expected open breaker, got %s", stats[0].State)
+	}
+
+	// Nor does it close a half-open breaker, which lets another trial through.
+	*now = now.Add(30 * time.Second)
+	cancel()
+	if stats := client.Stats(); stats[0].State != StateHalfOpen {
+		t.Fatalf("expected half-open breaker, got %s", stats[0].State)
+	}
+	mock.doFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}
+	if _, err := client.Do(request(t, http.MethodGet)); err != nil {
+		t.Fatalf("expected a trial request, got %v", err)
+	}
+}
+
+func TestClient_Breaker(t *testing.T) {
+	mock, n := statuses(0)
+	client, now := newClient(t, mock)
+
+	// The first request fails four times, and the fifth failure of the next
+	// request opens the breaker.
+	for range 2 {
+		if _, err := client.Do(request(t, http.MethodGet)); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if *n != 5 {
+		t.Errorf("expected 5 attempts before opening, got %d", *n)
+	}
+
+	_, err := client.Do(request(t, http.MethodGet))
+	var oerr *openErr
+	if !errors.As(err, &oerr) || !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected circuit open error, got %v", err)
+	}
+	if oerr.StatusCode() != http.StatusServiceUnavailable || oerr.RetryAfter() != 30*time.Second {
+		t.Errorf("unexpected status %d, retry after %s", oerr.StatusCode(), oerr.RetryAfter())
+	}
+	if *n != 5 {
+		t.Errorf("expected no attempts while open, got %d", *n)
+	}
+	if stats := client.Stats(); stats[0].State != StateOpen || stats[0].Opened != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Once the timeout has passed, a failed trial opens it again.
+	*now = now.Add(30 * time.Second)
+	if stats := client.Stats(); stats[0].State != StateHalfOpen {
+		t.Errorf("expected half-open breaker, got %s", stats[0].State)
+	}
+	if _, err := client.Do(request(t, http.MethodGet)); errors.Is(err, ErrCircuitOpen) || *n != 6 {
+		t.Fatalf("expected a trial request, got %d attempts: %v", *n, err)
+	}
+	if stats := client.Stats(); stats[0].State != StateOpen || stats[0].Opened != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// And a successful trial closes it.
+	mock.doFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}
+	*now = now.Add(30 * time.Second)
+	if _, err := client.Do(request(t, http.MethodGet)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := client.Stats(); stats[0].State != StateClosed {
+		t.Errorf("expected closed breaker, got %s", stats[0].State)
+	}
+}
+
+func TestClient_Backoff(t *testing.T) {
+	client := New(Config{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, nil)
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for range 100 {
+			if d := client.backoff(attempt); d < 0 || d >= max {
+				t.Fatalf("attempt %d: expected backoff below %s, got %s", attempt, max, d)
+			}
+		}
+	}
+	// Large enough attempts overflow the shift.
+	if d := client.backoff(100); d < 0 || d >= time.Second {
+		t.Errorf("expected backoff to be capped, got %s", d)
+	}
+}
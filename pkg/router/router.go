@@ -73,9 +73,13 @@ func (n *node) find(ctx context.Context, path []string) (context.Context, http.H
 		return ctx, n.handler
 	}
 
+	// Static segments take precedence, but when they lead nowhere, the
+	// segment may still be a parameter, e.g. a namespace named `search`.
 	segment := strings.ToLower(path[0])
 	if next, ok := n.next[segment]; ok {
-		return next.find(ctx, path[1:])
+		if ctx, h := next.find(ctx, path[1:]); h != nil {
+			return ctx, h
+		}
 	}
 	if n.param != nil {
 		return n.param.traverse(ctx, path)
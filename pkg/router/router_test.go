@@ -66,3 +66,35 @@ func TestRouter_NotFound(t *testing.T) {
 		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rec.Code)
 	}
 }
+
+func TestRouter_StaticFallback(t *testing.T) {
+	r := New()
+	r.Get("/modules/search", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("search"))
+	})
+	r.Get("/modules/:namespace/:name/versions", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("versions of " + GetParameter(r.Context(), "namespace") + "/" + GetParameter(r.Context(), "name")))
+	})
+
+	tests := []struct {
+		path      string
+		expStatus int
+		expBody   string
+	}{
+		{"/modules/search", http.StatusOK, "search"},
+		{"/modules/search/vpc/versions", http.StatusOK, "versions of search/vpc"},
+		{"/modules/infra/vpc/versions", http.StatusOK, "versions of infra/vpc"},
+		{"/modules/search/vpc", http.StatusNotFound, "Not Found\n"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if rec.Code != tt.expStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.expStatus, rec.Code)
+		}
+		if rec.Body.String() != tt.expBody {
+			t.Errorf("%s: expected body %q, got %q", tt.path, tt.expBody, rec.Body.String())
+		}
+	}
+}
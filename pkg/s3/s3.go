@@ -0,0 +1,218 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+const extension = ".tar.gz"
+
+type Config struct {
+	Endpoint        string              `envconfig:"ENDPOINT" default:"https://s3.amazonaws.com"`
+	Region          string              `envconfig:"REGION" default:"us-east-1"`
+	Bucket          string              `envconfig:"BUCKET"`
+	Prefix          string              `envconfig:"PREFIX"`
+	PathStyle       bool                `envconfig:"PATH_STYLE"`
+	AccessKeyID     string              `envconfig:"ACCESS_KEY_ID"`
+	SecretAccessKey string              `envconfig:"SECRET_ACCESS_KEY"`
+	SessionToken    string              `envconfig:"SESSION_TOKEN"`
+	Repositories    map[string][]string `envconfig:"REPOSITORIES"`
+	OrgMappings     map[string]string   `envconfig:"ORG_MAPPINGS"`
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func New(cfg Config, c HTTPClient) *Service {
+	return &Service{
+		cfg:    cfg,
+		client: c,
+		now:    time.Now,
+		signer: &signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			sessionToken:    cfg.SessionToken,
+			region:          cfg.Region,
+		},
+	}
+}
+
+// Service implements the modules repository on top of an S3 compatible object
+// storage, with the module archives stored as objects with keys on the form
+// `<prefix>/<owner>/<repo>/<module>/<version>.tar.gz`, i.e. the same layout as
+// used by the filesystem backend.
+type Service struct {
+	cfg    Config
+	client HTTPClient
+	now    func() time.Time
+	signer *signer
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
+func (s *Service) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
+	owner := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, owner, repo); err != nil {
+		return nil, err
+	}
+
+	prefix, err := s.key(owner, repo, module)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		token    string
+		versions = []string{}
+	)
+	prefix += "/"
+	for {
+		q := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		res, err := s.makeRequest(ctx, "", q)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(res).Decode(&result)
+		cerr := res.Close()
+		if cerr != nil {
+			return nil, fmt.Errorf("closing response: %w", cerr)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			if strings.HasSuffix(name, extension) && name != extension {
+				versions = append(versions, strings.TrimSuffix(name, extension))
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return versions, nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObject.html
+func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
+	owner := backend.MapOrg(s.cfg.OrgMappings, system)
+	if err := backend.ValidRepo(s.cfg.Repositories, owner, repo); err != nil {
+		return err
+	}
+
+	key, err := s.key(owner, repo, module, version+extension)
+	if err != nil {
+		return err
+	}
+
+	body, err := s.makeRequest(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			slog.Warn("error closing response body", "err", err)
+		}
+	}()
+
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("copying object: %w", err)
+	}
+	return nil
+}
+
+// key returns the object key of the elements, below the configured prefix.
+// Object keys aren't paths, but since plenty of S3 compatible services treat
+// them as such, we reject anything that may be interpreted as traversal.
+func (s *Service) key(elems ...string) (string, error) {
+	for _, e := range elems {
+		if e == "" || e == "." || e == ".." || strings.Contains(e, "/") {
+			return "", &backend.Error{
+				Code: http.StatusBadRequest,
+				Msg:  "invalid module path",
+			}
+		}
+	}
+	if prefix := strings.Trim(s.cfg.Prefix, "/"); prefix != "" {
+		elems = append([]string{prefix}, elems...)
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+func (s *Service) makeRequest(ctx context.Context, key string, q url.Values) (io.ReadCloser, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %w", err)
+	}
+
+	p := "/" + uriEncode(key, false)
+	if s.cfg.PathStyle {
+		p = "/" + uriEncode(s.cfg.Bucket, true) + p
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	// We set the raw path explicitly, to make sure that the path is encoded
+	// exactly the same way as when we sign it.
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + p
+	if u.Path, err = url.PathUnescape(u.RawPath); err != nil {
+		return nil, fmt.Errorf("parsing path: %w", err)
+	}
+	if q != nil {
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	if s.cfg.AccessKeyID != "" {
+		s.signer.sign(req, s.now())
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &backend.Error{
+			Code: res.StatusCode,
+			Msg:  backend.Slurp(res.Body),
+		}
+	}
+
+	return res.Body, nil
+}
@@ -0,0 +1,166 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/reMarkable/orbit/pkg/internal/backend"
+)
+
+// mockS3 is a minimal S3 compatible server, using path-style addressing,
+// which pages the object listings one object at a time.
+func mockS3(t *testing.T, objects map[string]string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=test-key/") {
+			http.Error(w, "AccessDenied", http.StatusForbidden)
+			return
+		}
+
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if bucket != "test-bucket" {
+			http.Error(w, "NoSuchBucket", http.StatusNotFound)
+			return
+		}
+
+		if key != "" {
+			content, ok := objects[key]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			_, _ = io.WriteString(w, content)
+			return
+		}
+
+		q := r.URL.Query()
+		var keys []string
+		for k := range objects {
+			rest, ok := strings.CutPrefix(k, q.Get("prefix"))
+			if ok && !strings.Contains(rest, q.Get("delimiter")) && k > q.Get("continuation-token") {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+
+		var b strings.Builder
+		b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><ListBucketResult>`)
+		if len(keys) > 0 {
+			fmt.Fprintf(&b, "<Contents><Key>%s</Key></Contents>", keys[0])
+		}
+		if len(keys) > 1 {
+			fmt.Fprintf(&b, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[0])
+		} else {
+			b.WriteString("<IsTruncated>false</IsTruncated>")
+		}
+		b.WriteString("</ListBucketResult>")
+		_, _ = io.WriteString(w, b.String())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testConfig(endpoint string) Config {
+	return Config{
+		Endpoint:        endpoint,
+		Region:          "us-east-1",
+		Bucket:          "test-bucket",
+		Prefix:          "modules/",
+		PathStyle:       true,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+		OrgMappings:     map[string]string{"test-system": "test-org"},
+	}
+}
+
+func TestService_ListVersions(t *testing.T) {
+	srv := mockS3(t, map[string]string{
+		"modules/test-org/test-repo/module/v1.0.0.tar.gz":        "",
+		"modules/test-org/test-repo/module/v1.1.0.tar.gz":        "",
+		"modules/test-org/test-repo/module/README.md":            "",
+		"modules/test-org/test-repo/module/nested/v3.0.0.tar.gz": "",
+		"modules/test-org/test-repo/other/v2.0.0.tar.gz":         "",
+	})
+	service := New(testConfig(srv.URL), srv.Client())
+
+	versions, err := service.ListVersions(context.Background(), "test-system", "test-repo", "module")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"v1.0.0", "v1.1.0"}
+	if !slices.Equal(versions, expected) {
+		t.Errorf("expected versions %q, got %q", expected, versions)
+	}
+}
+
+func TestService_ProxyDownload(t *testing.T) {
+	srv := mockS3(t, map[string]string{
+		"modules/test-org/test-repo/module/v1.0.0.tar.gz": "fake tarball content",
+	})
+	service := New(testConfig(srv.URL), srv.Client())
+
+	var buf bytes.Buffer
+	err := service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v1.0.0", &buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != "fake tarball content" {
+		t.Errorf("expected content %q, got %q", "fake tarball content", buf.String())
+	}
+
+	err = service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v9.9.9", io.Discard)
+	var herr *backend.Error
+	if !errors.As(err, &herr) || herr.StatusCode() != http.StatusNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestService_VirtualHostedStyle(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host != "test-bucket.s3.example.com" || req.URL.Path != "/modules/test-org/test-repo/module/v1.0.0.tar.gz" {
+				return nil, errors.New("unexpected request: " + req.URL.String())
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("fake tarball content")),
+			}, nil
+		},
+	}
+
+	cfg := testConfig("https://s3.example.com")
+	cfg.PathStyle = false
+	service := New(cfg, mockClient)
+
+	if err := service.ProxyDownload(context.Background(), "test-system", "test-repo", "module", "v1.0.0", io.Discard); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestService_InvalidKey(t *testing.T) {
+	service := New(testConfig("https://s3.example.com"), nil)
+
+	err := service.ProxyDownload(context.Background(), "test-system", "..", "module", "v1.0.0", io.Discard)
+	var herr *backend.Error
+	if !errors.As(err, &herr) || herr.StatusCode() != http.StatusBadRequest {
+		t.Errorf("expected bad request error, got %v", err)
+	}
+}
+
+type mockHTTPClient struct {
+	doFunc func(req *http.Request) (*http.Response, error)
+}
+
+func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return m.doFunc(req)
+}
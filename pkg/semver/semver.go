@@ -0,0 +1,159 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package semver parses and compares semantic versions, which is what the
+// Terraform registry protocol expects module versions to be.
+//
+// https://semver.org/spec/v2.0.0.html
+package semver
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalid = errors.New("invalid semantic version")
+
+type Version struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	Prerelease string
+	Build      string
+}
+
+// Parse parses a semantic version, optionally prefixed by a `v`, as is the
+// convention for tags.
+func Parse(s string) (Version, error) {
+	var (
+		v                Version
+		hasPre, hasBuild bool
+	)
+	rest := strings.TrimPrefix(s, "v")
+	rest, v.Build, hasBuild = strings.Cut(rest, "+")
+	// Hyphens are allowed within the pre-release, so only the first one
+	// separates it from the version core.
+	rest, v.Prerelease, hasPre = strings.Cut(rest, "-")
+
+	parts := strings.Split(rest, ".")
+	if len(parts) != 3 {
+		return Version{}, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+	for i, p := range []*uint64{&v.Major, &v.Minor, &v.Patch} {
+		if !numeric(parts[i]) {
+			return Version{}, fmt.Errorf("%w: %q", ErrInvalid, s)
+		}
+		n, err := strconv.ParseUint(parts[i], 10, 64)
+		if err != nil {
+			return Version{}, fmt.Errorf("%w: %q", ErrInvalid, s)
+		}
+		*p = n
+	}
+
+	if hasPre && !validIdentifiers(v.Prerelease, true) {
+		return Version{}, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+	if hasBuild && !validIdentifiers(v.Build, false) {
+		return Version{}, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+	return v, nil
+}
+
+// String returns the version without any `v` prefix.
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// IsPrerelease returns whether this is a pre-release version.
+func (v Version) IsPrerelease() bool {
+	return v.Prerelease != ""
+}
+
+// Compare returns -1, 0 or +1 depending on whether v precedes, equals or
+// follows w. The build metadata doesn't take part in the precedence.
+func Compare(v, w Version) int {
+	if c := cmp.Compare(v.Major, w.Major); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.Minor, w.Minor); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.Patch, w.Patch); c != 0 {
+		return c
+	}
+
+	// A pre-release precedes the release itself.
+	switch {
+	case v.Prerelease == w.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case w.Prerelease == "":
+		return -1
+	}
+
+	a, b := strings.Split(v.Prerelease, "."), strings.Split(w.Prerelease, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareIdentifier(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// compareIdentifier compares numeric identifiers numerically, which have lower
+// precedence than alphanumeric ones, that are compared lexically.
+func compareIdentifier(a, b string) int {
+	an, bn := numeric(a), numeric(b)
+	switch {
+	case an && bn:
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+	case an:
+		return -1
+	case bn:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// numeric returns whether the identifier is a number without leading zeroes.
+func numeric(s string) bool {
+	if s == "" || (len(s) > 1 && s[0] == '0') {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func validIdentifiers(s string, prerelease bool) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		for _, r := range id {
+			if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-') {
+				return false
+			}
+		}
+		// Numeric pre-release identifiers mustn't have leading zeroes.
+		if prerelease && len(id) > 1 && id[0] == '0' && strings.Trim(id, "0123456789") == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package semver
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]Version{
+		"1.2.3":                  {Major: 1, Minor: 2, Patch: 3},
+		"v1.2.3":                 {Major: 1, Minor: 2, Patch: 3},
+		"0.0.0":                  {},
+		"1.0.0-alpha":            {Major: 1, Prerelease: "alpha"},
+		"1.0.0-alpha-1.0":        {Major: 1, Prerelease: "alpha-1.0"},
+		"1.0.0+build.5":          {Major: 1, Build: "build.5"},
+		"v1.0.0-rc.1+sha.abc-12": {Major: 1, Prerelease: "rc.1", Build: "sha.abc-12"},
+	}
+	for s, expected := range tests {
+		v, err := Parse(s)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", s, err)
+			continue
+		}
+		if v != expected {
+			t.Errorf("%s: expected %+v, got %+v", s, expected, v)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, s := range []string{
+		"", "latest", "1", "1.2", "1.2.3.4", "01.2.3", "1.2.x", "-1.2.3",
+		"1.2.3-", "1.2.3+", "1.2.3-01", "1.2.3-a..b", "1.2.3-a_b", "vv1.2.3",
+	} {
+		if _, err := Parse(s); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%q: expected invalid version error, got %v", s, err)
+		}
+	}
+}
+
+func TestVersion_String(t *testing.T) {
+	for s, expected := range map[string]string{
+		"v1.2.3":           "1.2.3",
+		"1.0.0-rc.1+build": "1.0.0-rc.1+build",
+	} {
+		v, err := Parse(s)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", s, err)
+		}
+		if v.String() != expected {
+			t.Errorf("%s: expected %s, got %s", s, expected, v)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// The example of precedence from the specification, plus some.
+	ordered := []string{
+		"0.9.0",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.2.0",
+		"1.10.0",
+		"2.0.0",
+	}
+
+	var versions []Version
+	for _, s := range ordered {
+		v, err := Parse(s)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", s, err)
+		}
+		versions = append(versions, v)
+	}
+
+	shuffled := slices.Clone(versions)
+	slices.Reverse(shuffled)
+	slices.SortFunc(shuffled, Compare)
+	if !slices.Equal(shuffled, versions) {
+		t.Errorf("expected %v, got %v", versions, shuffled)
+	}
+
+	a, _ := Parse("1.0.0+a")
+	b, _ := Parse("1.0.0+b")
+	if Compare(a, b) != 0 {
+		t.Error("expected build metadata to be ignored")
+	}
+}
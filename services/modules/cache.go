@@ -6,13 +6,24 @@ package modules
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"os"
+	"strings"
 	"time"
 )
 
+var (
+	errNoCommits      = errors.New("repository doesn't support commits")
+	errNoDescriptions = errors.New("repository doesn't describe versions")
+	errNoChecksums    = errors.New("repository doesn't keep checksums")
+)
+
 type KeyValueStore interface {
 	Get(key string) ([]string, bool)
 	Set(key string, value []string, d ...time.Duration)
@@ -49,8 +60,137 @@ func (c *Cache) ListVersions(ctx context.Context, owner, repo, module string) ([
 	return v, nil
 }
 
+// ListModules is cached like the versions, under a key no module can have.
+func (c *Cache) ListModules(ctx context.Context) ([]string, error) {
+	lister, ok := c.repo.(ModuleLister)
+	if !ok {
+		return nil, errNoModules
+	}
+
+	key := "modules"
+	if v, ok := c.store.Get(key); ok {
+		return v, nil
+	}
+
+	v, err := lister.ListModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store.Set(key, v)
+	return v, nil
+}
+
+// DescribeVersion is cached like the versions, since the commit of a version
+// only changes if its tag is moved.
+func (c *Cache) DescribeVersion(ctx context.Context, owner, repo, module, version string) (string, string, time.Time, error) {
+	d, ok := c.repo.(VersionDescriber)
+	if !ok {
+		return "", "", time.Time{}, errNoDescriptions
+	}
+
+	key := strings.Join([]string{"describe", owner, repo, module, version}, "/")
+	if v, ok := c.store.Get(key); ok && len(v) == 3 {
+		published, err := time.Parse(time.RFC3339, v[2])
+		if err == nil {
+			return v[0], v[1], published, nil
+		}
+	}
+
+	source, commit, published, err := d.DescribeVersion(ctx, owner, repo, module, version)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	c.store.Set(key, []string{source, commit, published.Format(time.RFC3339)})
+	return source, commit, published, nil
+}
+
 func (c *Cache) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
-	filename := fmt.Sprintf("%s-%s-%s-%s.tar.gz", owner, repo, module, version)
+	return c.cachedArchive(archiveName(owner, repo, module, version), w, func(w io.Writer) error {
+		return c.repo.ProxyDownload(ctx, owner, repo, module, version, w)
+	})
+}
+
+// Checksum returns the SHA-256 of the archive of the version, which is kept
+// next to the archive when it's cached.
+func (c *Cache) Checksum(ctx context.Context, owner, repo, module, version string) (string, error) {
+	return c.checksum(archiveName(owner, repo, module, version), func(w io.Writer) error {
+		return c.repo.ProxyDownload(ctx, owner, repo, module, version, w)
+	})
+}
+
+// ResolveCommit is never cached, since it's how moved tags are detected.
+func (c *Cache) ResolveCommit(ctx context.Context, owner, repo, module, version string) (string, error) {
+	cr, ok := c.repo.(CommitRepository)
+	if !ok {
+		return "", errNoCommits
+	}
+	return cr.ResolveCommit(ctx, owner, repo, module, version)
+}
+
+// DownloadCommit caches the archives by commit, rather than version, so
+// they're never served for a tag that has moved.
+func (c *Cache) DownloadCommit(ctx context.Context, owner, repo, module, version, commit string, w io.Writer) error {
+	cr, ok := c.repo.(CommitRepository)
+	if !ok {
+		return errNoCommits
+	}
+	return c.cachedArchive(archiveName(owner, repo, module, commit), w, func(w io.Writer) error {
+		return cr.DownloadCommit(ctx, owner, repo, module, version, commit, w)
+	})
+}
+
+// ChecksumCommit is the checksum of the archive downloaded by commit.
+func (c *Cache) ChecksumCommit(ctx context.Context, owner, repo, module, version, commit string) (string, error) {
+	cr, ok := c.repo.(CommitRepository)
+	if !ok {
+		return "", errNoCommits
+	}
+	return c.checksum(archiveName(owner, repo, module, commit), func(w io.Writer) error {
+		return cr.DownloadCommit(ctx, owner, repo, module, version, commit, w)
+	})
+}
+
+func archiveName(owner, repo, module, ref string) string {
+	return fmt.Sprintf("%s-%s-%s-%s.tar.gz", owner, repo, module, ref)
+}
+
+// ProviderAssets is cached like the versions.
+func (c *Cache) ProviderAssets(ctx context.Context, namespace, typ string) ([]string, error) {
+	pr, ok := c.repo.(ProviderRepository)
+	if !ok {
+		return nil, errNoProviders
+	}
+
+	key := strings.Join([]string{"providers", namespace, typ}, "/")
+	if v, ok := c.store.Get(key); ok {
+		return v, nil
+	}
+
+	v, err := pr.ProviderAssets(ctx, namespace, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store.Set(key, v)
+	return v, nil
+}
+
+func (c *Cache) ProviderAsset(ctx context.Context, namespace, typ, version, asset string, w io.Writer) error {
+	pr, ok := c.repo.(ProviderRepository)
+	if !ok {
+		return errNoProviders
+	}
+	filename := fmt.Sprintf("provider-%s-%s-%s-%s", namespace, typ, version, asset)
+	return c.cached(filename, w, func(w io.Writer) error {
+		return pr.ProviderAsset(ctx, namespace, typ, version, asset, w)
+	})
+}
+
+// cached copies the cached file to w, if there's one, or else downloads it,
+// keeping it in the cache as well once the whole of it has been downloaded.
+func (c *Cache) cached(filename string, w io.Writer, download func(w io.Writer) error) error {
 	if r, err := c.files.Open(filename); err != nil {
 		// If we just fail to open the cached file, we'll just log the error and
 		// then re-download it from the repository as usual.
@@ -65,19 +205,94 @@ func (c *Cache) ProxyDownload(ctx context.Context, owner, repo, module, version
 		return nil
 	}
 
-	if cw, err := c.files.Create(filename); err != nil {
-		// If we fail to create a cache file, we'll just proxy download directly
-		// from the repository without caching.
-		c.log.Error("failed to create cached file", "err", err)
-	} else {
-		defer func() {
-			if err := cw.Close(); err != nil {
-				slog.Error("failed to close cached file", "err", err)
-			}
-		}()
-		w = io.MultiWriter(w, cw)
+	// The download is spooled, so that a failed one is never cached.
+	tmp, err := os.CreateTemp("", "orbit-cache-*")
+	if err != nil {
+		// If we fail to create a spool file, we'll just proxy download
+		// directly from the repository without caching.
+		c.log.Error("failed to create spool file", "err", err)
+		return download(w)
+	}
+	defer func() {
+		if err := tmp.Close(); err != nil {
+			slog.Error("failed to close spool file", "err", err)
+		}
+		if err := os.Remove(tmp.Name()); err != nil {
+			slog.Error("failed to remove spool file", "err", err)
+		}
+	}()
+
+	if err := download(io.MultiWriter(w, tmp)); err != nil {
+		return err
+	}
+	// Failing to keep the file only means it's downloaded again.
+	if err := keepFile(c.files, filename, tmp); err != nil {
+		c.log.Error("failed to cache file", "err", err)
+	}
+	return nil
+}
+
+// keepFile writes the content of r to the file, from the start, if r can be
+// rewound.
+func keepFile(files FileStorage, filename string, r io.Reader) error {
+	if s, ok := r.(io.Seeker); ok {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	f, err := files.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// cachedArchive is like cached, but also keeps the SHA-256 of the archive next
+// to it, computed as the archive is downloaded.
+func (c *Cache) cachedArchive(filename string, w io.Writer, download func(w io.Writer) error) error {
+	var sum hash.Hash
+	err := c.cached(filename, w, func(w io.Writer) error {
+		sum = sha256.New()
+		return download(io.MultiWriter(w, sum))
+	})
+	if err == nil && sum != nil {
+		c.keepChecksum(filename, hex.EncodeToString(sum.Sum(nil)))
+	}
+	return err
+}
+
+// checksum returns the SHA-256 kept next to the archive, or else computes it
+// from the archive, downloading it if it isn't cached either.
+func (c *Cache) checksum(filename string, download func(w io.Writer) error) (string, error) {
+	if r, err := c.files.Open(filename + ".sha256"); err == nil {
+		b, err := io.ReadAll(r)
+		if err := r.Close(); err != nil {
+			c.log.Error("failed to close cached checksum", "err", err)
+		}
+		if sum := strings.TrimSpace(string(b)); err == nil && len(sum) == sha256.Size*2 {
+			return sum, nil
+		}
+	}
+
+	sum := sha256.New()
+	if err := c.cached(filename, sum, download); err != nil {
+		return "", err
+	}
+	s := hex.EncodeToString(sum.Sum(nil))
+	c.keepChecksum(filename, s)
+	return s, nil
+}
+
+// keepChecksum writes the checksum next to the archive. Failing to do so
+// only means it's computed again.
+func (c *Cache) keepChecksum(filename, sum string) {
+	if err := keepFile(c.files, filename+".sha256", strings.NewReader(sum+"\n")); err != nil {
+		c.log.Error("failed to cache checksum", "err", err)
 	}
-	return c.repo.ProxyDownload(ctx, owner, repo, module, version, w)
 }
 
 // StoreInPath implements the FileStorage interface by storing files locally on
@@ -89,10 +304,40 @@ func (s StoreInPath) Open(filename string) (io.ReadCloser, error) {
 	return os.Open(s.path(filename))
 }
 
+// Create writes the file under a temporary name, which it's renamed from once
+// closed, unless writing it failed. The file is thereby never read while
+// half-written.
 func (s StoreInPath) Create(filename string) (io.WriteCloser, error) {
-	return os.Create(s.path(filename))
+	f, err := os.CreateTemp(string(s), filename+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &storedFile{f: f, path: s.path(filename)}, nil
 }
 
 func (s StoreInPath) path(filename string) string {
 	return fmt.Sprintf("%s/%s", s, filename)
 }
+
+// storedFile is a file being written under a temporary name. The file isn't
+// embedded, as its ReadFrom would have io.Copy bypass the tracking of errors.
+type storedFile struct {
+	f    *os.File
+	path string
+	err  error
+}
+
+func (f *storedFile) Write(b []byte) (int, error) {
+	n, err := f.f.Write(b)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *storedFile) Close() error {
+	if err := errors.Join(f.err, f.f.Close()); err != nil {
+		return errors.Join(err, os.Remove(f.f.Name()))
+	}
+	return os.Rename(f.f.Name(), f.path)
+}
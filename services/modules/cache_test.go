@@ -3,8 +3,11 @@ package modules
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
+	"os"
 	"testing"
 	"time"
 )
@@ -114,3 +117,186 @@ func TestCache_ProxyDownload(t *testing.T) {
 		t.Errorf("expected content %q, got %q", expectedContent, buf.String())
 	}
 }
+
+func TestCache_ProxyDownload_Failed(t *testing.T) {
+	files := &mockFileStorage{files: make(map[string][]byte)}
+	cache := NewCache(&failingRepository{}, nil, files, &mockLogger{})
+
+	// Neither the partial archive nor its checksum are kept, so nothing
+	// is served from the cache.
+	for range 2 {
+		if err := cache.ProxyDownload(context.Background(), "owner", "repo", "module", "v1.0.0", io.Discard); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if len(files.files) != 0 {
+		t.Errorf("expected nothing cached, got %v", files.files)
+	}
+	if _, err := cache.Checksum(context.Background(), "owner", "repo", "module", "v1.0.0"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestStoreInPath(t *testing.T) {
+	dir := t.TempDir()
+	store := StoreInPath(dir)
+
+	// The file only appears once it's been written and closed.
+	w, err := store.Create("archive.tar.gz")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := io.WriteString(w, "tarball"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := store.Open("archive.tar.gz"); err == nil {
+		t.Error("expected the file to be missing until closed")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, err := store.Open("archive.tar.gz")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = r.Close() }()
+	if b, _ := io.ReadAll(r); string(b) != "tarball" {
+		t.Errorf("unexpected content %q", b)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only the file, got %v", entries)
+	}
+}
+
+func TestCache_DownloadCommit(t *testing.T) {
+	store := &mockKeyValueStore{data: make(map[string][]string)}
+	files := &mockFileStorage{files: make(map[string][]byte)}
+	repo := &mockCommitRepository{}
+	cache := NewCache(repo, store, files, &mockLogger{})
+
+	for range 2 {
+		var buf bytes.Buffer
+		err := cache.DownloadCommit(context.Background(), "owner", "repo", "module", "v1.0.0", "aaa", &buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != "tarball at aaa" {
+			t.Errorf("unexpected content %q", buf.String())
+		}
+	}
+	if len(repo.downloaded) != 1 {
+		t.Errorf("expected a single download, got %d", len(repo.downloaded))
+	}
+	if _, ok := files.files["owner-repo-module-aaa.tar.gz"]; !ok {
+		t.Error("expected the archive cached by commit")
+	}
+}
+
+func TestCache_Checksum(t *testing.T) {
+	files := &mockFileStorage{files: make(map[string][]byte)}
+	repo := &mockCommitRepository{}
+	cache := NewCache(repo, nil, files, &mockLogger{})
+
+	// The checksum is kept along with the archive when it's downloaded, and
+	// only computed when it isn't.
+	if err := cache.DownloadCommit(context.Background(), "owner", "repo", "module", "v1.0.0", "aaa", io.Discard); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := fmt.Sprintf("%x", sha256.Sum256([]byte("tarball at aaa")))
+	if got := string(files.files["owner-repo-module-aaa.tar.gz.sha256"]); got != exp+"\n" {
+		t.Errorf("expected the checksum cached, got %q", got)
+	}
+	for range 2 {
+		sum, err := cache.ChecksumCommit(context.Background(), "owner", "repo", "module", "v1.0.0", "aaa")
+		if err != nil || sum != exp {
+			t.Errorf("expected checksum %q, got %q (%v)", exp, sum, err)
+		}
+	}
+	if len(repo.downloaded) != 1 {
+		t.Errorf("expected a single download, got %d", len(repo.downloaded))
+	}
+
+	sum, err := cache.Checksum(context.Background(), "owner", "repo", "module", "v1.0.0")
+	if exp := fmt.Sprintf("%x", sha256.Sum256([]byte("fake tarball content"))); err != nil || sum != exp {
+		t.Errorf("expected checksum %q, got %q (%v)", exp, sum, err)
+	}
+	if _, ok := files.files["owner-repo-module-v1.0.0.tar.gz"]; !ok {
+		t.Error("expected the archive cached along with the checksum")
+	}
+}
+
+func TestCache_DownloadCommit_Unsupported(t *testing.T) {
+	cache := NewCache(&mockCacheRepository{}, nil, nil, &mockLogger{})
+	if err := cache.DownloadCommit(context.Background(), "owner", "repo", "module", "v1.0.0", "aaa", io.Discard); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCache_ListModules(t *testing.T) {
+	store := &mockKeyValueStore{data: make(map[string][]string)}
+	repo := &mockModuleLister{modules: []string{"infra/vpc/aws/v1.0.0"}}
+	cache := NewCache(repo, store, nil, &mockLogger{})
+
+	if _, err := cache.ListModules(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	repo.modules = nil
+	modules, err := cache.ListModules(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(modules) != 1 || modules[0] != "infra/vpc/aws/v1.0.0" {
+		t.Errorf("expected the cached modules, got %v", modules)
+	}
+}
+
+func TestCache_DescribeVersion(t *testing.T) {
+	store := &mockKeyValueStore{data: make(map[string][]string)}
+	cache := NewCache(&mockDescriber{}, store, nil, &mockLogger{})
+
+	for range 2 {
+		source, commit, published, err := cache.DescribeVersion(context.Background(), "owner", "repo", "module", "v1.0.0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if source != "https://github.com/owner/repo" || commit != "abc123-v1.0.0" || published.Year() != 2024 {
+			t.Errorf("unexpected description %s %s %s", source, commit, published)
+		}
+	}
+	if _, ok := store.data["describe/owner/repo/module/v1.0.0"]; !ok {
+		t.Error("expected the description cached")
+	}
+
+	uncached := NewCache(&mockCacheRepository{}, store, nil, &mockLogger{})
+	if _, _, _, err := uncached.DescribeVersion(context.Background(), "owner", "repo", "module", "v1.0.0"); !errors.Is(err, errNoDescriptions) {
+		t.Errorf("expected errNoDescriptions, got %v", err)
+	}
+}
+
+func TestCache_Providers(t *testing.T) {
+	store := &mockKeyValueStore{data: make(map[string][]string)}
+	files := &mockFileStorage{files: make(map[string][]byte)}
+	repo := &mockProviderRepository{releases: mockProviderReleases()}
+	cache := NewCache(repo, store, files, &mockLogger{})
+
+	if _, err := cache.ProviderAssets(context.Background(), "infra", "thing"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := store.data["providers/infra/thing"]; !ok {
+		t.Error("expected the assets cached")
+	}
+
+	asset := "terraform-provider-thing_1.0.0_linux_amd64.zip"
+	if err := cache.ProviderAsset(context.Background(), "infra", "thing", "v1.0.0", asset, io.Discard); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := string(files.files["provider-infra-thing-v1.0.0-"+asset]); got != "linux" {
+		t.Errorf("expected the asset cached, got %q", got)
+	}
+
+	uncached := NewCache(&mockCacheRepository{}, store, files, &mockLogger{})
+	if _, err := uncached.ProviderAssets(context.Background(), "infra", "thing"); !errors.Is(err, errNoProviders) {
+		t.Errorf("expected errNoProviders, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/reMarkable/orbit/pkg/semver"
+)
+
+// Deprecation marks a version of a module as deprecated, which Terraform
+// warns about, or as withdrawn altogether, which hides it.
+type Deprecation struct {
+	Reason    string `json:"reason,omitempty"`
+	Link      string `json:"link,omitempty"`
+	Withdrawn bool   `json:"withdrawn,omitempty"`
+}
+
+// Deprecations are the deprecated versions of modules, keyed by the address
+// of the module, as `<namespace>/<name>/<system>`, and the version.
+type Deprecations map[string]map[string]Deprecation
+
+// LoadDeprecations reads the deprecations from a JSON file, like:
+//
+//	{
+//	  "infra/vpc/aws": {
+//	    "1.2.0": {"reason": "Breaks peering", "link": "https://example.com/vpc-1.2.0"},
+//	    "1.2.1": {"reason": "Deletes the VPC", "withdrawn": true}
+//	  }
+//	}
+func LoadDeprecations(path string) (Deprecations, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading deprecations: %w", err)
+	}
+
+	var raw Deprecations
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("decoding deprecations: %w", err)
+	}
+
+	// The versions are normalized, so that it doesn't matter whether they're
+	// written as tags or as served.
+	d := make(Deprecations, len(raw))
+	for module, versions := range raw {
+		if strings.Count(module, "/") != 2 {
+			return nil, fmt.Errorf("deprecations: invalid module address %q", module)
+		}
+		d[module] = make(map[string]Deprecation, len(versions))
+		for version, dep := range versions {
+			v, err := semver.Parse(version)
+			if err != nil {
+				return nil, fmt.Errorf("deprecations: %s: %w", module, err)
+			}
+			d[module][v.String()] = dep
+		}
+	}
+	return d, nil
+}
+
+func (d Deprecations) lookup(namespace, name, system string, v semver.Version) (Deprecation, bool) {
+	dep, ok := d[namespace+"/"+name+"/"+system][v.String()]
+	return dep, ok
+}
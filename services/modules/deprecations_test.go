@@ -0,0 +1,63 @@
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDeprecations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deprecations.json")
+	content := `{
+		"infra/vpc/aws": {
+			"v1.2.0": {"reason": "Breaks peering", "link": "https://example.com"},
+			"1.2.1": {"reason": "Deletes the VPC", "withdrawn": true}
+		}
+	}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := LoadDeprecations(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := Deprecations{
+		"infra/vpc/aws": {
+			"1.2.0": {Reason: "Breaks peering", Link: "https://example.com"},
+			"1.2.1": {Reason: "Deletes the VPC", Withdrawn: true},
+		},
+	}
+	if len(d) != len(expected) || len(d["infra/vpc/aws"]) != 2 {
+		t.Fatalf("expected %v, got %v", expected, d)
+	}
+	for version, dep := range expected["infra/vpc/aws"] {
+		if d["infra/vpc/aws"][version] != dep {
+			t.Errorf("%s: expected %+v, got %+v", version, dep, d["infra/vpc/aws"][version])
+		}
+	}
+}
+
+func TestLoadDeprecations_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"json":    `{`,
+		"address": `{"infra/vpc": {"1.0.0": {}}}`,
+		"version": `{"infra/vpc/aws": {"latest": {}}}`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "deprecations.json")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadDeprecations(path); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	if _, err := LoadDeprecations(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
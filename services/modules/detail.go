@@ -0,0 +1,322 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/hcl"
+	"github.com/reMarkable/orbit/pkg/router"
+	"github.com/reMarkable/orbit/pkg/semver"
+)
+
+// maxDocSize bounds the size of the files we read to describe a module.
+const maxDocSize = 1 << 20
+
+// VersionDescriber is implemented by the repositories that can tell where the
+// versions of the modules come from.
+type VersionDescriber interface {
+	// DescribeVersion returns the URL of the repository of the module, and
+	// the SHA and time of the commit of the version.
+	DescribeVersion(ctx context.Context, owner, repo, module, version string) (string, string, time.Time, error)
+}
+
+// ModuleDetail describes a version of a module, or the latest one, if none is
+// given, with the inputs, outputs and providers of the module parsed from its
+// archive.
+func (h *Handler) ModuleDetail(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("ModuleDetail")
+	}
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		name      = router.GetParameter(ctx, "name")
+		system    = router.GetParameter(ctx, "system")
+		version   = router.GetParameter(ctx, "version")
+	)
+
+	res, err := h.describe(ctx, system, namespace, name, version)
+	if err != nil {
+		h.log.Error("module detail", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	if err := encodeJSON(w, res); err != nil {
+		h.log.Error("encode response", "err", err)
+		return
+	}
+}
+
+func (h *Handler) describe(ctx context.Context, system, namespace, name, version string) (*moduleDetail, error) {
+	var (
+		requested semver.Version
+		err       error
+	)
+	if version != "" {
+		if requested, err = parseVersion(version); err != nil {
+			return nil, err
+		}
+	}
+
+	versions, err := h.listVersions(ctx, system, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	var v moduleVersion
+	switch {
+	case version != "":
+		if v, err = findVersion(versions, requested); err != nil {
+			return nil, err
+		}
+	case len(versions) > 0:
+		v = versions[len(versions)-1]
+	default:
+		return nil, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "no versions",
+		}
+	}
+
+	res := &moduleDetail{
+		ID:        strings.Join([]string{namespace, name, system, v.version.String()}, "/"),
+		Namespace: namespace,
+		Name:      name,
+		Provider:  system,
+		Version:   v.version.String(),
+		Versions:  make([]string, len(versions)),
+	}
+	for n, mv := range versions {
+		res.Versions[n] = mv.version.String()
+	}
+	if v.deprecation != nil {
+		res.Deprecation = &deprecation{
+			Reason: v.deprecation.Reason,
+			Link:   v.deprecation.Link,
+		}
+	}
+
+	if d, ok := h.repo.(VersionDescriber); ok {
+		source, commit, published, err := d.DescribeVersion(ctx, system, namespace, name, v.raw)
+		switch {
+		case errors.Is(err, errNoDescriptions):
+			// Wrapped repositories that can't describe versions.
+		case err != nil:
+			return nil, fmt.Errorf("describe version: %w", err)
+		default:
+			res.Source, res.Commit = source, commit
+			if !published.IsZero() {
+				res.PublishedAt = &published
+			}
+		}
+	}
+
+	if res.Root, err = h.moduleRoot(ctx, system, namespace, name, v.raw); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// moduleRoot reads the README, and the inputs, outputs and providers of the
+// Terraform files, at the root of the archive of the module.
+func (h *Handler) moduleRoot(ctx context.Context, system, namespace, name, version string) (moduleRoot, error) {
+	root := moduleRoot{
+		Inputs:               []moduleInput{},
+		Outputs:              []moduleOutput{},
+		ProviderDependencies: []providerDependency{},
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(h.repo.ProxyDownload(ctx, system, namespace, name, version, pw))
+	}()
+	files, err := readRootFiles(pr)
+	// Unblocks the repository, should we give up half way.
+	pr.CloseWithError(err)
+	if err != nil {
+		return root, err
+	}
+
+	var names []string
+	for name, content := range files {
+		switch {
+		case strings.EqualFold(name, "README.md"):
+			root.Readme = content
+		case strings.EqualFold(name, "README") && root.Readme == "":
+			root.Readme = content
+		case path.Ext(name) == ".tf":
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	root.Empty = len(names) == 0
+	for _, name := range names {
+		body, err := hcl.Parse([]byte(files[name]))
+		if err != nil {
+			// What we fail to parse is left out, rather than failing the
+			// whole module.
+			h.log.Error("parse module file", "file", name, "err", err)
+			continue
+		}
+		root.add(body)
+	}
+	return root, nil
+}
+
+// readRootFiles returns the content of the files at the root of the gzipped
+// tarball, leaving out the ones too large to describe the module.
+func readRootFiles(r io.Reader) (map[string]string, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("read gzip: %w", err)
+	}
+	tr := tar.NewReader(zr)
+
+	files := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar: %w", err)
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if hdr.Typeflag != tar.TypeReg || strings.Contains(name, "/") || hdr.Size > maxDocSize {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		files[name] = string(b)
+	}
+}
+
+func (m *moduleRoot) add(body hcl.Body) {
+	for _, b := range body.Blocks {
+		switch {
+		case b.Type == "variable" && len(b.Labels) == 1:
+			in := moduleInput{
+				Name:        b.Labels[0],
+				Type:        attribute(b.Body, "type"),
+				Description: literal(b.Body, "description"),
+				Default:     attribute(b.Body, "default"),
+			}
+			_, hasDefault := b.Body.Attribute("default")
+			in.Required = !hasDefault
+			m.Inputs = append(m.Inputs, in)
+		case b.Type == "output" && len(b.Labels) == 1:
+			m.Outputs = append(m.Outputs, moduleOutput{
+				Name:        b.Labels[0],
+				Description: literal(b.Body, "description"),
+			})
+		case b.Type == "terraform":
+			for _, rp := range b.Body.Blocks {
+				if rp.Type != "required_providers" {
+					continue
+				}
+				for _, a := range rp.Body.Attributes {
+					m.ProviderDependencies = append(m.ProviderDependencies, newProviderDependency(a))
+				}
+			}
+		}
+	}
+}
+
+// newProviderDependency returns the required provider, given either by an
+// object with the source and version, or by nothing but the version, as in
+// the days before sources.
+func newProviderDependency(a hcl.Attribute) providerDependency {
+	p := providerDependency{
+		Name:   a.Name,
+		Source: "hashicorp/" + a.Name,
+	}
+	if attrs, ok := a.Expr.Object(); ok {
+		for _, attr := range attrs {
+			switch attr.Name {
+			case "source":
+				p.Source, _ = attr.Expr.Literal()
+			case "version":
+				p.Version, _ = attr.Expr.Literal()
+			}
+		}
+	} else {
+		p.Version, _ = a.Expr.Literal()
+	}
+
+	// The source is `[hostname/]namespace/type`.
+	parts := strings.Split(p.Source, "/")
+	if len(parts) >= 2 {
+		p.Namespace = parts[len(parts)-2]
+	}
+	return p
+}
+
+func attribute(body hcl.Body, name string) string {
+	expr, _ := body.Attribute(name)
+	return expr.String()
+}
+
+func literal(body hcl.Body, name string) string {
+	expr, _ := body.Attribute(name)
+	s, _ := expr.Literal()
+	return strings.TrimSpace(s)
+}
+
+type moduleDetail struct {
+	ID          string       `json:"id"`
+	Namespace   string       `json:"namespace"`
+	Name        string       `json:"name"`
+	Provider    string       `json:"provider"`
+	Version     string       `json:"version"`
+	Source      string       `json:"source,omitempty"`
+	Commit      string       `json:"commit,omitempty"`
+	PublishedAt *time.Time   `json:"published_at,omitempty"`
+	Deprecation *deprecation `json:"deprecation,omitempty"`
+	Versions    []string     `json:"versions"`
+	Root        moduleRoot   `json:"root"`
+}
+
+type moduleRoot struct {
+	Readme               string               `json:"readme"`
+	Empty                bool                 `json:"empty"`
+	Inputs               []moduleInput        `json:"inputs"`
+	Outputs              []moduleOutput       `json:"outputs"`
+	ProviderDependencies []providerDependency `json:"provider_dependencies"`
+}
+
+type moduleInput struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Default     string `json:"default"`
+	Required    bool   `json:"required"`
+}
+
+type moduleOutput struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type providerDependency struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Source    string `json:"source"`
+	Version   string `json:"version"`
+}
@@ -0,0 +1,157 @@
+package modules
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockDescriber struct {
+	mockRepository
+}
+
+func (m *mockDescriber) DescribeVersion(ctx context.Context, owner, repo, module, version string) (string, string, time.Time, error) {
+	return "https://github.com/owner/repo", "abc123-" + version, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), nil
+}
+
+func mockArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatalf("writing header: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing gzip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestModuleDetail(t *testing.T) {
+	archive := mockArchive(t, map[string]string{
+		"README.md": "# VPC\n",
+		"variables.tf": `
+variable "cidr" {
+  type        = string
+  description = "The CIDR block."
+}
+
+variable "tags" {
+  type    = map(string)
+  default = {}
+}
+`,
+		"outputs.tf": `
+output "id" {
+  description = "The ID of the VPC."
+  value       = aws_vpc.this.id
+}
+`,
+		"versions.tf": `
+terraform {
+  required_providers {
+    aws = {
+      source  = "hashicorp/aws"
+      version = ">= 5.0"
+    }
+    random = "~> 3.0"
+  }
+}
+`,
+		"broken.tf":          `variable "x" {`,
+		"modules/sub/foo.tf": `variable "nested" {}`,
+	})
+
+	tests := []struct {
+		name      string
+		url       string
+		path      string
+		repo      Repository
+		expStatus int
+		expBody   string
+	}{
+		{
+			name:      "version",
+			url:       "/v1/modules/repo/vpc/owner/1.0.0",
+			path:      "/v1/modules/:namespace/:name/:system/:version",
+			repo:      &mockDescriber{mockRepository{versions: []string{"v1.0.0", "v1.1.0"}, archive: archive}},
+			expStatus: http.StatusOK,
+			expBody: `{"id":"repo/vpc/owner/1.0.0","namespace":"repo","name":"vpc","provider":"owner","version":"1.0.0",` +
+				`"source":"https://github.com/owner/repo","commit":"abc123-v1.0.0","published_at":"2024-01-02T03:04:05Z",` +
+				`"versions":["1.0.0","1.1.0"],"root":{"readme":"# VPC\n","empty":false,` +
+				`"inputs":[{"name":"cidr","type":"string","description":"The CIDR block.","default":"","required":true},` +
+				`{"name":"tags","type":"map(string)","description":"","default":"{}","required":false}],` +
+				`"outputs":[{"name":"id","description":"The ID of the VPC."}],` +
+				`"provider_dependencies":[{"name":"aws","namespace":"hashicorp","source":"hashicorp/aws","version":">= 5.0"},` +
+				`{"name":"random","namespace":"hashicorp","source":"hashicorp/random","version":"~> 3.0"}]}}`,
+		},
+		{
+			name:      "latest",
+			url:       "/v1/modules/repo/vpc/owner",
+			path:      "/v1/modules/:namespace/:name/:system",
+			repo:      &mockRepository{versions: []string{"v1.0.0", "v1.1.0"}, archive: mockArchive(t, nil)},
+			expStatus: http.StatusOK,
+			expBody: `{"id":"repo/vpc/owner/1.1.0","namespace":"repo","name":"vpc","provider":"owner","version":"1.1.0",` +
+				`"versions":["1.0.0","1.1.0"],"root":{"readme":"","empty":true,"inputs":[],"outputs":[],"provider_dependencies":[]}}`,
+		},
+		{
+			name:      "no_versions",
+			url:       "/v1/modules/repo/vpc/owner",
+			path:      "/v1/modules/:namespace/:name/:system",
+			repo:      &mockRepository{},
+			expStatus: http.StatusNotFound,
+			expBody:   `Not Found`,
+		},
+		{
+			name:      "unknown_version",
+			url:       "/v1/modules/repo/vpc/owner/2.0.0",
+			path:      "/v1/modules/:namespace/:name/:system/:version",
+			repo:      &mockRepository{versions: []string{"v1.0.0"}},
+			expStatus: http.StatusNotFound,
+			expBody:   `Not Found`,
+		},
+		{
+			name:      "invalid_version",
+			url:       "/v1/modules/repo/vpc/owner/latest",
+			path:      "/v1/modules/:namespace/:name/:system/:version",
+			repo:      &mockRepository{versions: []string{"v1.0.0"}},
+			expStatus: http.StatusBadRequest,
+			expBody:   `Bad Request`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &Handler{
+				log:  slog.Default(),
+				repo: tt.repo,
+			}
+
+			rr := httptest.NewRecorder()
+			route(tt.path, handler.ModuleDetail).ServeHTTP(rr, mockRequest(t, tt.url))
+
+			if rr.Code != tt.expStatus {
+				t.Errorf("unexpected status code, exp: %d, got: %d", tt.expStatus, rr.Code)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expBody {
+				t.Errorf("unexpected response body, exp: %s, got: %s", tt.expBody, body)
+			}
+		})
+	}
+}
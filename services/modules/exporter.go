@@ -13,6 +13,7 @@ type (
 	Metrics struct {
 		requestCount  map[string]int
 		downloadCount map[string]int
+		collectors    []collector
 	}
 	MetricsHandler struct {
 		logger  Logger
@@ -20,6 +21,21 @@ type (
 	}
 )
 
+// Sample is a single value of a metric, with its labels.
+type Sample struct {
+	Labels map[string]string
+	Value  int
+}
+
+// collector reports the values of a metric that is tracked elsewhere, which
+// are collected whenever the metrics are scraped.
+type collector struct {
+	metricType MetricType
+	name       string
+	help       string
+	collect    func() []Sample
+}
+
 type MetricType int
 
 const (
@@ -62,6 +78,12 @@ func (h *MetricsHandler) Metrics(w http.ResponseWriter, r *http.Request) {
 		meta := strings.Split(module, "/")
 		h.writeMetrics(w, "download_count", map[string]string{"module": meta[1], "namespace": meta[0], "version": meta[2]}, count)
 	}
+	for _, c := range h.metrics.collectors {
+		h.writeMeta(w, c.metricType, c.help, c.name)
+		for _, s := range c.collect() {
+			h.writeMetrics(w, c.name, s.Labels, s.Value)
+		}
+	}
 }
 
 func (h *MetricsHandler) writeMeta(w http.ResponseWriter, metricType MetricType, help string, metric string) {
@@ -72,11 +94,15 @@ func (h *MetricsHandler) writeMeta(w http.ResponseWriter, metricType MetricType,
 }
 
 func (h *MetricsHandler) writeMetrics(w http.ResponseWriter, metric string, labels map[string]string, value int) {
-	meta := fmt.Sprintf("%s{", metric)
-	for _, k := range slices.Sorted(maps.Keys(labels)) {
-		meta += fmt.Sprintf("%s=\"%s\",", k, labels[k])
+	meta := metric
+	if len(labels) > 0 {
+		meta += "{"
+		for _, k := range slices.Sorted(maps.Keys(labels)) {
+			meta += fmt.Sprintf("%s=\"%s\",", k, labels[k])
+		}
+		meta = meta[:len(meta)-1] + "}"
 	}
-	meta = meta[:len(meta)-1] + fmt.Sprintf("} %d\n", value)
+	meta += fmt.Sprintf(" %d\n", value)
 	_, err := w.Write([]byte(meta))
 	if err != nil {
 		slog.Error("write error", "err", err)
@@ -90,3 +116,16 @@ func (h *MetricsHandler) IncrementRequestCount(endpoint string) {
 func (h *MetricsHandler) IncrementDownloadCount(namespace string, name string, version string) {
 	h.metrics.downloadCount[namespace+"/"+name+"/"+version]++
 }
+
+// Register adds a metric whose values are collected from the function on every
+// scrape, for metrics tracked outside of the handler, e.g. by the repository.
+// It's not safe to call concurrently with scrapes, so register any metrics
+// before serving them.
+func (h *MetricsHandler) Register(metricType MetricType, name, help string, collect func() []Sample) {
+	h.metrics.collectors = append(h.metrics.collectors, collector{
+		metricType: metricType,
+		name:       name,
+		help:       help,
+		collect:    collect,
+	})
+}
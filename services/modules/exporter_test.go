@@ -84,3 +84,38 @@ func TestMetricsHandler_Metrics_Type(t *testing.T) {
 		t.Error("expected metric type 'counter' for download_count")
 	}
 }
+
+func TestMetricsHandler_Register(t *testing.T) {
+	logger := MockLogger{}
+	handler, _ := NewMetricsHandler(logger)
+
+	remaining := 42
+	handler.Register(MetricTypeGauge, "rate_limit_remaining", "Remaining requests", func() []Sample {
+		return []Sample{
+			{Labels: map[string]string{"host": "api.github.com"}, Value: remaining},
+		}
+	})
+	handler.Register(MetricTypeCounter, "unlabelled_count", "Something unlabelled", func() []Sample {
+		return []Sample{{Value: 7}}
+	})
+
+	for _, expected := range []int{42, 41} {
+		remaining = expected
+
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		w := httptest.NewRecorder()
+		handler.Metrics(w, req)
+
+		body := w.Body.String()
+		if !strings.Contains(body, "# TYPE rate_limit_remaining gauge") {
+			t.Error("expected metric type 'gauge' for rate_limit_remaining")
+		}
+		gaugeExpected := formatMetric("rate_limit_remaining", map[string]string{"host": "api.github.com"}, expected)
+		if !strings.Contains(body, gaugeExpected) {
+			t.Errorf("expected '%s' in response body, got: %s", gaugeExpected, body)
+		}
+		if !strings.Contains(body, "\nunlabelled_count 7\n") {
+			t.Errorf("expected unlabelled_count in response body, got: %s", body)
+		}
+	}
+}
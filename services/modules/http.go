@@ -9,14 +9,19 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/reMarkable/orbit/pkg/archive"
 	"github.com/reMarkable/orbit/pkg/auth"
 	"github.com/reMarkable/orbit/pkg/router"
 )
@@ -27,8 +32,16 @@ var (
 )
 
 type Config struct {
-	ProxySecret     []byte        `envconfig:"PROXY_SECRET" required:"true"`
-	TokenExpiration time.Duration `envconfig:"TOKEN_EXPIRATION" default:"60s"`
+	ProxySecret      []byte        `envconfig:"PROXY_SECRET" required:"true"`
+	TokenExpiration  time.Duration `envconfig:"TOKEN_EXPIRATION" default:"60s"`
+	RefExpiration    time.Duration `envconfig:"REF_EXPIRATION" default:"5m"`
+	Prereleases      bool          `envconfig:"PRERELEASES"`
+	Deprecations     string        `envconfig:"DEPRECATIONS"`
+	Archive          string        `envconfig:"ARCHIVE" default:"tar.gz"`
+	CompressionLevel int           `envconfig:"COMPRESSION_LEVEL"`
+	// ProviderKeys are the paths to the public keys the providers of the
+	// namespaces are signed with, by namespace.
+	ProviderKeys map[string]string `envconfig:"PROVIDER_KEYS"`
 }
 
 type Cipher interface {
@@ -57,23 +70,52 @@ func NewHTTP(cfg Config, log Logger, r Repository, mh *MetricsHandler) (*Handler
 		return nil, err
 	}
 
+	if cfg.Archive != "" {
+		if _, err := archive.ParseFormat(cfg.Archive); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.ValidLevel(cfg.CompressionLevel); err != nil {
+		return nil, err
+	}
+
+	var deprecations Deprecations
+	if cfg.Deprecations != "" {
+		if deprecations, err = LoadDeprecations(cfg.Deprecations); err != nil {
+			return nil, err
+		}
+	}
+
+	providerKeys, err := loadProviderKeys(cfg.ProviderKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Handler{
-		cfg:    cfg,
-		cipher: gcm,
-		log:    log,
-		now:    time.Now,
-		mh:     mh,
-		repo:   r,
+		cfg:          cfg,
+		cipher:       gcm,
+		deprecations: deprecations,
+		log:          log,
+		now:          time.Now,
+		mh:           mh,
+		providerKeys: providerKeys,
+		repo:         r,
 	}, nil
 }
 
 type Handler struct {
-	cfg    Config
-	cipher Cipher
-	log    Logger
-	mh     *MetricsHandler
-	now    func() time.Time
-	repo   Repository
+	cfg          Config
+	cipher       Cipher
+	deprecations Deprecations
+	log          Logger
+	mh           *MetricsHandler
+	now          func() time.Time
+	providerKeys map[string]gpgPublicKey
+	repo         Repository
+
+	// protocols holds the protocols of the provider releases, by namespace,
+	// type and version, once read from their manifests.
+	protocols sync.Map
 }
 
 func (h *Handler) ListVersions(w http.ResponseWriter, r *http.Request) {
@@ -87,7 +129,7 @@ func (h *Handler) ListVersions(w http.ResponseWriter, r *http.Request) {
 		system    = router.GetParameter(ctx, "system")
 	)
 
-	versions, err := h.repo.ListVersions(ctx, system, namespace, name)
+	versions, err := h.listVersions(ctx, system, namespace, name)
 	if err != nil {
 		h.log.Error("list versions", "err", err)
 		respErr(w, err)
@@ -106,7 +148,44 @@ func (h *Handler) DownloadURL(w http.ResponseWriter, r *http.Request) {
 	if h.mh != nil {
 		h.mh.IncrementRequestCount("DownloadURL")
 	}
-	downloadURL := "./proxy?archive=tar.gz"
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		name      = router.GetParameter(ctx, "name")
+		system    = router.GetParameter(ctx, "system")
+		version   = router.GetParameter(ctx, "version")
+	)
+	d := downloadRequest{
+		namespace: namespace,
+		name:      name,
+		system:    system,
+		version:   version,
+	}
+	var err error
+	if d.raw, err = h.resolveVersion(ctx, system, namespace, name, version); err != nil {
+		h.log.Error("resolve version", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	format, err := h.archiveFormat(r, "archive")
+	if err != nil {
+		respErr(w, err)
+		return
+	}
+
+	// The version as known by the repository is passed on to the proxy, so
+	// that it doesn't have to list the versions all over again.
+	ref, err := h.sealRef(d)
+	if err != nil {
+		h.log.Error("sealing ref", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	// go-getter drops the archive parameter once it knows how to unpack the
+	// download, so the format is passed on to the proxy in one of our own.
+	downloadURL := fmt.Sprintf("./proxy?archive=%s&format=%s&ref=%s", format, format, ref)
 	if token := auth.GetToken(r.Context(), ""); token != "" {
 		encoded, err := h.encodeToken(token)
 		if err != nil {
@@ -121,36 +200,234 @@ func (h *Handler) DownloadURL(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) ProxyDownload(w http.ResponseWriter, r *http.Request) {
-	var (
-		ctx       = r.Context()
-		namespace = router.GetParameter(ctx, "namespace")
-		name      = router.GetParameter(ctx, "name")
-		system    = router.GetParameter(ctx, "system")
-		version   = router.GetParameter(ctx, "version")
-		token     = r.URL.Query().Get("token")
-	)
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("ProxyDownload")
+	}
+	ctx, d, err := h.parseDownload(r)
+	if err != nil {
+		respErr(w, err)
+		return
+	}
+	if h.mh != nil {
+		h.mh.IncrementDownloadCount(d.namespace, d.name, d.version)
+	}
+
+	// w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s-%s-%s.tar.gz", owner, repo, module, version))
+	sw := &startedWriter{w: w}
+	if err := h.download(ctx, d, sw); err != nil {
+		h.log.Error("proxy download", "err", err)
+		if sw.started {
+			// It's too late to respond with an error, so the connection is
+			// aborted for the client not to take what it got as the archive.
+			panic(http.ErrAbortHandler)
+		}
+		respErr(w, err)
+		return
+	}
+}
 
-	h.mh.IncrementRequestCount("ProxyDownload")
-	if token != "" {
-		var err error
+// startedWriter tells whether anything has been written to the response.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startedWriter) Write(b []byte) (int, error) {
+	s.started = s.started || len(b) > 0
+	return s.w.Write(b)
+}
+
+// Checksum responds with the SHA-256 of the archive served by the proxy, for
+// pinning the modules. The archives are reproducible, so the checksum of a
+// version only changes if its tag is moved. The cache keeps the checksums of
+// the archives it serves as is, while transcoded ones are hashed as served.
+func (h *Handler) Checksum(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("Checksum")
+	}
+	ctx, d, err := h.parseDownload(r)
+	if err != nil {
+		respErr(w, err)
+		return
+	}
+
+	sum, err := h.checksum(ctx, d)
+	if err != nil {
+		h.log.Error("checksum", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := fmt.Fprintf(w, "%s\n", sum); err != nil {
+		h.log.Error("write checksum", "err", err)
+	}
+}
+
+// ChecksumRepository is implemented by the repositories keeping the checksums
+// of the archives they serve, so they're only computed once.
+type ChecksumRepository interface {
+	Checksum(ctx context.Context, owner, repo, module, version string) (string, error)
+	ChecksumCommit(ctx context.Context, owner, repo, module, version, commit string) (string, error)
+}
+
+// checksum returns the SHA-256 of the archive, as kept by the repository when
+// the archive is served as is, or else computed from the archive.
+func (h *Handler) checksum(ctx context.Context, d downloadRequest) (string, error) {
+	if cr, ok := h.repo.(ChecksumRepository); ok && d.format == archive.TarGzip && h.cfg.CompressionLevel == archive.DefaultLevel {
+		sum, err := cr.Checksum(ctx, d.system, d.namespace, d.name, d.raw)
+		if !errors.Is(err, errNoChecksums) {
+			return sum, err
+		}
+	}
+
+	sum := sha256.New()
+	if err := h.download(ctx, d, sum); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+type downloadRequest struct {
+	namespace string
+	name      string
+	system    string
+	version   string
+	raw       string
+	format    archive.Format
+}
+
+// module identifies the version of the module asked for.
+func (d downloadRequest) module() []byte {
+	return []byte(d.namespace + "/" + d.name + "/" + d.system + "/" + d.version)
+}
+
+// parseDownload parses the request for a module archive, and resolves the
+// version, unless the download URL already holds it, returning the context to
+// use upstream, with the token, if any.
+func (h *Handler) parseDownload(r *http.Request) (context.Context, downloadRequest, error) {
+	ctx := r.Context()
+	d := downloadRequest{
+		namespace: router.GetParameter(ctx, "namespace"),
+		name:      router.GetParameter(ctx, "name"),
+		system:    router.GetParameter(ctx, "system"),
+		version:   router.GetParameter(ctx, "version"),
+	}
+
+	var err error
+	if d.format, err = h.archiveFormat(r, "format", "archive"); err != nil {
+		return ctx, d, err
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" {
 		token, err = h.decodeToken(token)
 		if err != nil {
 			h.log.Error("decoding token", "err", err)
-			respErr(w, err)
-			return
+			return ctx, d, err
 		}
 		ctx = auth.WithToken(ctx, token)
 	}
-	if h.mh != nil {
-		h.mh.IncrementDownloadCount(namespace, name, version)
+
+	if ref := r.URL.Query().Get("ref"); ref != "" {
+		d.raw, err = h.openRef(d, ref)
+		return ctx, d, err
+	}
+	if d.raw, err = h.resolveVersion(ctx, d.system, d.namespace, d.name, d.version); err != nil {
+		h.log.Error("resolve version", "err", err)
+		return ctx, d, err
 	}
+	return ctx, d, nil
+}
 
-	// w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s-%s-%s.tar.gz", owner, repo, module, version))
-	if err := h.repo.ProxyDownload(ctx, system, namespace, name, version, w); err != nil {
-		h.log.Error("proxy download", "err", err)
-		respErr(w, err)
-		return
+// download writes the module archive in the format. The repositories all
+// serve gzipped tarballs, which are transcoded on the fly when needed.
+func (h *Handler) download(ctx context.Context, d downloadRequest, w io.Writer) error {
+	if d.format == archive.TarGzip && h.cfg.CompressionLevel == archive.DefaultLevel {
+		return h.repo.ProxyDownload(ctx, d.system, d.namespace, d.name, d.raw, w)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(h.repo.ProxyDownload(ctx, d.system, d.namespace, d.name, d.raw, pw))
+	}()
+	err := archive.Transcode(w, pr, d.format, h.cfg.CompressionLevel)
+	// Unblocks the repository, should we give up half way.
+	pr.CloseWithError(err)
+	return err
+}
+
+// archiveFormat returns the archive format asked for by the first of the
+// query parameters present, or the configured format.
+func (h *Handler) archiveFormat(r *http.Request, params ...string) (archive.Format, error) {
+	s := h.cfg.Archive
+	for _, p := range params {
+		if v := r.URL.Query().Get(p); v != "" {
+			s = v
+			break
+		}
+	}
+	if s == "" {
+		return archive.TarGzip, nil
+	}
+
+	format, err := archive.ParseFormat(s)
+	if err != nil {
+		return "", &httpErr{
+			code: http.StatusBadRequest,
+			msg:  err.Error(),
+		}
 	}
+	return format, nil
+}
+
+// sealRef seals the version as known by the repository, bound to the version
+// of the module it was resolved for. The refs expire, so that versions since
+// withdrawn can't be downloaded through old download URLs.
+func (h *Handler) sealRef(d downloadRequest) (string, error) {
+	b, err := json.Marshal(&sealedRef{
+		Raw:      d.raw,
+		SealedAt: h.now().Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshalling ref into JSON: %w", err)
+	}
+
+	nonce := make([]byte, h.cipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generating ref nonce: %w", err)
+	}
+
+	sealed := h.cipher.Seal(nonce, nonce, b, d.module())
+	return hex.EncodeToString(sealed), nil
+}
+
+func (h *Handler) openRef(d downloadRequest, sealed string) (string, error) {
+	invalid := &httpErr{
+		code: http.StatusBadRequest,
+		msg:  "invalid ref",
+	}
+
+	b, err := hex.DecodeString(sealed)
+	if err != nil || len(b) < h.cipher.NonceSize() {
+		return "", invalid
+	}
+	nonce, ciphertext := b[:h.cipher.NonceSize()], b[h.cipher.NonceSize():]
+	b, err = h.cipher.Open(nil, nonce, ciphertext, d.module())
+	if err != nil {
+		return "", invalid
+	}
+
+	var ref sealedRef
+	if err := json.Unmarshal(b, &ref); err != nil {
+		return "", invalid
+	}
+	if validUntil := time.Unix(ref.SealedAt, 0).Add(h.cfg.RefExpiration); !h.now().Before(validUntil) {
+		return "", &httpErr{
+			code: http.StatusBadRequest,
+			msg:  "expired ref",
+		}
+	}
+	return ref.Raw, nil
 }
 
 func (h *Handler) encodeToken(token string) (string, error) {
@@ -202,23 +479,59 @@ func (h *Handler) decodeToken(encoded string) (string, error) {
 	return token.Token, nil
 }
 
+type httpErr struct {
+	code int
+	msg  string
+}
+
+func (e *httpErr) Error() string {
+	return e.msg
+}
+
+func (e *httpErr) StatusCode() int {
+	return e.code
+}
+
 func respErr(w http.ResponseWriter, err error) {
-	var code int
-	switch x := err.(type) {
-	case interface{ StatusCode() int }:
-		code = x.StatusCode()
-	default:
-		code = http.StatusInternalServerError
+	code := http.StatusInternalServerError
+	var sc interface{ StatusCode() int }
+	if errors.As(err, &sc) {
+		code = sc.StatusCode()
+	}
+	// Let the clients know when it's worth trying again, e.g. when we're
+	// being rate limited by the upstream.
+	var ra interface{ RetryAfter() time.Duration }
+	if errors.As(err, &ra) && ra.RetryAfter() > 0 {
+		secs := int(math.Ceil(ra.RetryAfter().Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
 	}
 	http.Error(w, http.StatusText(code), code)
 }
 
-func newListVersionsResponse(versions []string) *listVersionsResponse {
+// encodeJSON writes the JSON response without escaping HTML, since the
+// responses are never embedded in any, which keeps URLs and version
+// constraints readable.
+func encodeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+func newListVersionsResponse(versions []moduleVersion) *listVersionsResponse {
 	m := module{
 		Versions: make([]version, len(versions)),
 	}
 	for n, v := range versions {
-		m.Versions[n] = version{v}
+		m.Versions[n] = version{
+			Version: v.version.String(),
+		}
+		if v.deprecation != nil {
+			m.Versions[n].Deprecation = &deprecation{
+				Reason: v.deprecation.Reason,
+				Link:   v.deprecation.Link,
+			}
+		}
 	}
 	return &listVersionsResponse{
 		Modules: []module{m},
@@ -234,10 +547,21 @@ type module struct {
 }
 
 type version struct {
-	Version string `json:"version"`
+	Version     string       `json:"version"`
+	Deprecation *deprecation `json:"deprecation,omitempty"`
+}
+
+type deprecation struct {
+	Reason string `json:"reason,omitempty"`
+	Link   string `json:"link,omitempty"`
 }
 
 type encodedToken struct {
 	Token     string `json:"token"`
 	EncodedAt int64  `json:"encoded_at"`
 }
+
+type sealedRef struct {
+	Raw      string `json:"raw"`
+	SealedAt int64  `json:"sealed_at"`
+}
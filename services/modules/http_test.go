@@ -1,7 +1,13 @@
 package modules
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,6 +15,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/reMarkable/orbit/pkg/expect"
 	"github.com/reMarkable/orbit/pkg/router"
@@ -16,23 +23,68 @@ import (
 
 func TestListVersions(t *testing.T) {
 	tests := []struct {
-		name      string
-		repo      *mockRepository
-		req       *http.Request
-		expStatus int
-		expBody   string
+		name         string
+		cfg          Config
+		deprecations Deprecations
+		repo         *mockRepository
+		req          *http.Request
+		expStatus    int
+		expBody      string
 	}{
 		{
 			name: "success",
 			req:  mockRequest(t, "/v1/modules/repo/module/owner/versions"),
 			repo: &mockRepository{
-				versions: []string{"666", "1349"},
+				versions: []string{"v1.10.0", "1.2.0", "v1.3.0-rc.1"},
 				owner:    expect.Value("owner"),
 				repo:     expect.Value("repo"),
 				module:   expect.Value("module"),
 			},
 			expStatus: http.StatusOK,
-			expBody:   `{"modules":[{"versions":[{"version":"666"},{"version":"1349"}]}]}`,
+			expBody:   `{"modules":[{"versions":[{"version":"1.2.0"},{"version":"1.10.0"}]}]}`,
+		},
+		{
+			name: "invalid_versions",
+			req:  mockRequest(t, "/v1/modules/repo/module/owner/versions"),
+			repo: &mockRepository{
+				versions: []string{"666", "latest", "v1.0.0", "1.0.0", "v01.0.0"},
+				owner:    expect.Value("owner"),
+				repo:     expect.Value("repo"),
+				module:   expect.Value("module"),
+			},
+			expStatus: http.StatusOK,
+			expBody:   `{"modules":[{"versions":[{"version":"1.0.0"}]}]}`,
+		},
+		{
+			name: "prereleases",
+			cfg:  Config{Prereleases: true},
+			req:  mockRequest(t, "/v1/modules/repo/module/owner/versions"),
+			repo: &mockRepository{
+				versions: []string{"v1.3.0", "v1.3.0-rc.1"},
+				owner:    expect.Value("owner"),
+				repo:     expect.Value("repo"),
+				module:   expect.Value("module"),
+			},
+			expStatus: http.StatusOK,
+			expBody:   `{"modules":[{"versions":[{"version":"1.3.0-rc.1"},{"version":"1.3.0"}]}]}`,
+		},
+		{
+			name: "deprecations",
+			deprecations: Deprecations{
+				"repo/module/owner": {
+					"1.1.0": {Reason: "broken", Link: "https://example.com"},
+					"1.2.0": {Withdrawn: true},
+				},
+			},
+			req: mockRequest(t, "/v1/modules/repo/module/owner/versions"),
+			repo: &mockRepository{
+				versions: []string{"v1.0.0", "v1.1.0", "v1.2.0"},
+				owner:    expect.Value("owner"),
+				repo:     expect.Value("repo"),
+				module:   expect.Value("module"),
+			},
+			expStatus: http.StatusOK,
+			expBody:   `{"modules":[{"versions":[{"version":"1.0.0"},{"version":"1.1.0","deprecation":{"reason":"broken","link":"https://example.com"}}]}]}`,
 		},
 		{
 			name: "empty_response",
@@ -62,8 +114,10 @@ func TestListVersions(t *testing.T) {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			handler := &Handler{
-				log:  slog.Default(),
-				repo: tt.repo,
+				cfg:          tt.cfg,
+				deprecations: tt.deprecations,
+				log:          slog.Default(),
+				repo:         tt.repo,
 			}
 
 			rr := httptest.NewRecorder()
@@ -95,6 +149,303 @@ func TestListVersions(t *testing.T) {
 	}
 }
 
+func TestProxyDownload(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       *http.Request
+		repo      *mockRepository
+		expStatus int
+	}{
+		{
+			name: "success",
+			req:  mockRequest(t, "/v1/modules/repo/module/owner/1.2.0/proxy"),
+			repo: &mockRepository{
+				versions: []string{"v1.1.0", "v1.2.0"},
+				owner:    expect.Value("owner"),
+				repo:     expect.Value("repo"),
+				module:   expect.Value("module"),
+				version:  expect.Value("v1.2.0"),
+			},
+			expStatus: http.StatusOK,
+		},
+		{
+			name: "unknown_version",
+			req:  mockRequest(t, "/v1/modules/repo/module/owner/1.3.0/proxy"),
+			repo: &mockRepository{
+				versions: []string{"v1.1.0", "v1.2.0"},
+				owner:    expect.Value("owner"),
+				repo:     expect.Value("repo"),
+				module:   expect.Value("module"),
+			},
+			expStatus: http.StatusNotFound,
+		},
+		{
+			name: "invalid_version",
+			req:  mockRequest(t, "/v1/modules/repo/module/owner/latest/proxy"),
+			repo: &mockRepository{
+				versions: []string{"latest"},
+			},
+			expStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mh, _ := NewMetricsHandler(MockLogger{})
+			handler := &Handler{
+				log:  slog.Default(),
+				mh:   mh,
+				repo: tt.repo,
+			}
+
+			rr := httptest.NewRecorder()
+			h := route("/v1/modules/:namespace/:name/:system/:version/proxy", handler.ProxyDownload)
+			h.ServeHTTP(rr, tt.req)
+
+			if rr.Code != tt.expStatus {
+				t.Errorf("unexpected status code, exp: %d, got: %d", tt.expStatus, rr.Code)
+			}
+
+			tt.repo.validate(t)
+		})
+	}
+}
+
+func TestDownloadURL_UnknownVersion(t *testing.T) {
+	repo := &mockRepository{
+		versions: []string{"v1.1.0"},
+		owner:    expect.Value("owner"),
+		repo:     expect.Value("repo"),
+		module:   expect.Value("module"),
+	}
+	handler := &Handler{
+		cipher: mockCipher(t),
+		log:    slog.Default(),
+		now:    time.Now,
+		repo:   repo,
+	}
+
+	for version, expStatus := range map[string]int{
+		"1.1.0": http.StatusNoContent,
+		"1.2.0": http.StatusNotFound,
+	} {
+		rr := httptest.NewRecorder()
+		h := route("/v1/modules/:namespace/:name/:system/:version/download", handler.DownloadURL)
+		h.ServeHTTP(rr, mockRequest(t, "/v1/modules/repo/module/owner/"+version+"/download"))
+
+		if rr.Code != expStatus {
+			t.Errorf("%s: unexpected status code, exp: %d, got: %d", version, expStatus, rr.Code)
+		}
+	}
+	repo.validate(t)
+}
+
+func TestDownloadURL_Archive(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       Config
+		url       string
+		expStatus int
+		expGet    string
+	}{
+		{
+			name:      "default",
+			url:       "/v1/modules/repo/module/owner/1.1.0/download",
+			expStatus: http.StatusNoContent,
+			expGet:    "./proxy?archive=tar.gz&format=tar.gz",
+		},
+		{
+			name:      "configured",
+			cfg:       Config{Archive: "tar.xz"},
+			url:       "/v1/modules/repo/module/owner/1.1.0/download",
+			expStatus: http.StatusNoContent,
+			expGet:    "./proxy?archive=tar.xz&format=tar.xz",
+		},
+		{
+			name:      "requested",
+			cfg:       Config{Archive: "tar.xz"},
+			url:       "/v1/modules/repo/module/owner/1.1.0/download?archive=zip",
+			expStatus: http.StatusNoContent,
+			expGet:    "./proxy?archive=zip&format=zip",
+		},
+		{
+			name:      "unsupported",
+			url:       "/v1/modules/repo/module/owner/1.1.0/download?archive=rar",
+			expStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &Handler{
+				cfg:    tt.cfg,
+				cipher: mockCipher(t),
+				log:    slog.Default(),
+				now:    time.Now,
+				repo:   &mockRepository{versions: []string{"v1.1.0"}},
+			}
+
+			rr := httptest.NewRecorder()
+			h := route("/v1/modules/:namespace/:name/:system/:version/download", handler.DownloadURL)
+			h.ServeHTTP(rr, mockRequest(t, tt.url))
+
+			if rr.Code != tt.expStatus {
+				t.Errorf("unexpected status code, exp: %d, got: %d", tt.expStatus, rr.Code)
+			}
+			got, ref, _ := strings.Cut(rr.Header().Get("X-Terraform-Get"), "&ref=")
+			if got != tt.expGet {
+				t.Errorf("unexpected download URL, exp: %q, got: %q", tt.expGet, got)
+			}
+			if tt.expGet != "" && ref == "" {
+				t.Error("expected a ref")
+			}
+		})
+	}
+}
+
+func TestProxyDownload_Archive(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	_ = tw.WriteHeader(&tar.Header{Name: "main.tf", Mode: 0644, Size: 11})
+	_, _ = tw.Write([]byte("resource {}"))
+	_ = tw.Close()
+	_ = zw.Close()
+
+	for query, expStatus := range map[string]int{
+		"?archive=zip&format=zip": http.StatusOK,
+		"?archive=zip":            http.StatusOK,
+		"?format=rar":             http.StatusBadRequest,
+	} {
+		mh, _ := NewMetricsHandler(MockLogger{})
+		handler := &Handler{
+			log:  slog.Default(),
+			mh:   mh,
+			repo: &mockRepository{versions: []string{"v1.1.0"}, archive: buf.Bytes()},
+		}
+
+		rr := httptest.NewRecorder()
+		h := route("/v1/modules/:namespace/:name/:system/:version/proxy", handler.ProxyDownload)
+		h.ServeHTTP(rr, mockRequest(t, "/v1/modules/repo/module/owner/1.1.0/proxy"+query))
+
+		if rr.Code != expStatus {
+			t.Errorf("%s: unexpected status code, exp: %d, got: %d", query, expStatus, rr.Code)
+		}
+		if expStatus != http.StatusOK {
+			continue
+		}
+		zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		if err != nil {
+			t.Fatalf("%s: reading zip: %v", query, err)
+		}
+		if len(zr.File) != 1 || zr.File[0].Name != "main.tf" {
+			t.Errorf("%s: unexpected zip entries: %v", query, zr.File)
+		}
+	}
+}
+
+func TestProxyDownload_Ref(t *testing.T) {
+	now := time.Now()
+	handler := &Handler{
+		cfg:    Config{RefExpiration: time.Minute},
+		cipher: mockCipher(t),
+		log:    slog.Default(),
+		now:    func() time.Time { return now },
+		repo:   &mockRepository{versions: []string{"v1.1.0"}},
+	}
+
+	rr := httptest.NewRecorder()
+	route("/v1/modules/:namespace/:name/:system/:version/download", handler.DownloadURL).
+		ServeHTTP(rr, mockRequest(t, "/v1/modules/repo/module/owner/1.1.0/download"))
+	_, ref, ok := strings.Cut(rr.Header().Get("X-Terraform-Get"), "&ref=")
+	if !ok {
+		t.Fatalf("expected a ref, got %q", rr.Header().Get("X-Terraform-Get"))
+	}
+
+	// The proxy gets the version from the ref, rather than from listing the
+	// versions again.
+	repo := &mockRepository{
+		owner:   expect.Value("owner"),
+		repo:    expect.Value("repo"),
+		module:  expect.Value("module"),
+		version: expect.Value("v1.1.0"),
+	}
+	handler.repo = repo
+	for path, expStatus := range map[string]int{
+		"/v1/modules/repo/module/owner/1.1.0/proxy?ref=" + ref: http.StatusOK,
+		"/v1/modules/repo/module/owner/1.2.0/proxy?ref=" + ref: http.StatusBadRequest,
+		"/v1/modules/repo/module/owner/1.1.0/proxy?ref=beef":   http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		route("/v1/modules/:namespace/:name/:system/:version/proxy", handler.ProxyDownload).
+			ServeHTTP(rr, mockRequest(t, path))
+
+		if rr.Code != expStatus {
+			t.Errorf("%s: unexpected status code, exp: %d, got: %d", path, expStatus, rr.Code)
+		}
+	}
+	repo.validate(t)
+
+	// Versions withdrawn since can't be downloaded through old refs.
+	now = now.Add(time.Minute)
+	rr = httptest.NewRecorder()
+	route("/v1/modules/:namespace/:name/:system/:version/proxy", handler.ProxyDownload).
+		ServeHTTP(rr, mockRequest(t, "/v1/modules/repo/module/owner/1.1.0/proxy?ref="+ref))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected the ref to have expired, got %d", rr.Code)
+	}
+}
+
+// failingRepository fails the downloads after writing some of the archive.
+type failingRepository struct {
+	mockRepository
+}
+
+func (m *failingRepository) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	if _, err := io.WriteString(w, "partial"); err != nil {
+		return err
+	}
+	return fmt.Errorf("oopsie")
+}
+
+func TestProxyDownload_Aborted(t *testing.T) {
+	handler := &Handler{
+		log:  slog.Default(),
+		repo: &failingRepository{mockRepository{versions: []string{"v1.1.0"}}},
+	}
+
+	// Failing after writing some of the archive aborts the response, rather
+	// than appending the error to it.
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("expected the response to be aborted, got %v", r)
+		}
+	}()
+	route("/v1/modules/:namespace/:name/:system/:version/proxy", handler.ProxyDownload).
+		ServeHTTP(httptest.NewRecorder(), mockRequest(t, "/v1/modules/repo/module/owner/1.1.0/proxy"))
+}
+
+func TestChecksum(t *testing.T) {
+	handler := &Handler{
+		log: slog.Default(),
+		repo: &mockRepository{
+			versions: []string{"v1.1.0"},
+			archive:  []byte("hello"),
+			version:  expect.Value("v1.1.0"),
+		},
+	}
+
+	rr := httptest.NewRecorder()
+	h := route("/v1/modules/:namespace/:name/:system/:version/proxy.sha256", handler.Checksum)
+	h.ServeHTTP(rr, mockRequest(t, "/v1/modules/repo/module/owner/1.1.0/proxy.sha256"))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status code, exp: %d, got: %d", http.StatusOK, rr.Code)
+	}
+	exp := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n"
+	if got := rr.Body.String(); got != exp {
+		t.Errorf("unexpected checksum, exp: %q, got: %q", exp, got)
+	}
+}
+
 // route is a helper function to wrap the router config of the handler func we
 // are testing. That we have to do this in the first place, and copy the routes
 // from main.go, is an indication that there's a poor abstraction in place that
@@ -106,6 +457,20 @@ func route(path string, f http.HandlerFunc) http.Handler {
 	return r
 }
 
+func mockCipher(t *testing.T) Cipher {
+	t.Helper()
+
+	c, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("creating cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		t.Fatalf("creating GCM: %v", err)
+	}
+	return gcm
+}
+
 // mockRequest simply creates an HTTP request suitable for testing the modules
 // handler.
 func mockRequest(t *testing.T, url string) *http.Request {
@@ -120,6 +485,7 @@ func mockRequest(t *testing.T, url string) *http.Request {
 
 type mockRepository struct {
 	versions []string
+	archive  []byte
 	err      error
 
 	owner   expect.V[string]
@@ -140,6 +506,9 @@ func (m *mockRepository) ProxyDownload(ctx context.Context, owner, repo, module,
 	m.repo.Got(repo)
 	m.module.Got(module)
 	m.version.Got(version)
+	if _, err := w.Write(m.archive); err != nil {
+		return err
+	}
 	return m.err
 }
 
@@ -151,3 +520,23 @@ func (m *mockRepository) validate(t *testing.T) {
 	m.module.Validate(t, "module")
 	m.version.Validate(t, "version")
 }
+
+type retryErr struct {
+	retryAfter time.Duration
+}
+
+func (e *retryErr) Error() string             { return "rate limited" }
+func (e *retryErr) StatusCode() int           { return http.StatusServiceUnavailable }
+func (e *retryErr) RetryAfter() time.Duration { return e.retryAfter }
+
+func TestRespErr_RetryAfter(t *testing.T) {
+	rr := httptest.NewRecorder()
+	respErr(rr, &retryErr{retryAfter: 1500 * time.Millisecond})
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code, exp: %d, got: %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if ra := rr.Header().Get("Retry-After"); ra != "2" {
+		t.Errorf("unexpected Retry-After, exp: 2, got: %s", ra)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/reMarkable/orbit/pkg/router"
+)
+
+const (
+	defaultLimit = 15
+	maxLimit     = 100
+)
+
+var errNoModules = &httpErr{
+	code: http.StatusNotImplemented,
+	msg:  "repository can't list modules",
+}
+
+// ModuleLister is implemented by the repositories that can enumerate their
+// modules, which is what the list and search endpoints are built on.
+type ModuleLister interface {
+	// ListModules returns every version of every module, as
+	// `namespace/name/system/version`, with the versions as known by the
+	// repository.
+	ListModules(ctx context.Context) ([]string, error)
+}
+
+// ListModules lists the latest version of all modules, or the ones of the
+// namespace, if given, optionally filtered by provider.
+func (h *Handler) ListModules(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("ListModules")
+	}
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+	)
+	h.respondModules(w, r, func(m moduleSummary) bool {
+		return namespace == "" || m.Namespace == namespace
+	})
+}
+
+// SearchModules lists the latest version of the modules whose namespace, name
+// or provider contains the query, ignoring case.
+func (h *Handler) SearchModules(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("SearchModules")
+	}
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	if q == "" {
+		respErr(w, &httpErr{
+			code: http.StatusBadRequest,
+			msg:  "missing query",
+		})
+		return
+	}
+	h.respondModules(w, r, func(m moduleSummary) bool {
+		return strings.Contains(strings.ToLower(m.Namespace), q) ||
+			strings.Contains(strings.ToLower(m.Name), q) ||
+			strings.Contains(strings.ToLower(m.Provider), q)
+	})
+}
+
+func (h *Handler) respondModules(w http.ResponseWriter, r *http.Request, match func(moduleSummary) bool) {
+	offset, limit, err := pagination(r)
+	if err != nil {
+		respErr(w, err)
+		return
+	}
+
+	all, err := h.listModules(r.Context())
+	if err != nil {
+		h.log.Error("list modules", "err", err)
+		respErr(w, err)
+		return
+	}
+	provider := r.URL.Query().Get("provider")
+	matching := slices.DeleteFunc(all, func(m moduleSummary) bool {
+		return !match(m) || (provider != "" && m.Provider != provider)
+	})
+
+	res := newListModulesResponse(r.URL, matching, offset, limit)
+	if err := encodeJSON(w, res); err != nil {
+		h.log.Error("encode response", "err", err)
+		return
+	}
+}
+
+// listModules returns the latest version of every module, in order, leaving
+// out the modules without any versions we'd serve.
+func (h *Handler) listModules(ctx context.Context) ([]moduleSummary, error) {
+	lister, ok := h.repo.(ModuleLister)
+	if !ok {
+		return nil, errNoModules
+	}
+	entries, err := lister.ListModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[[3]string][]string{}
+	for _, e := range entries {
+		parts := strings.SplitN(e, "/", 4)
+		if len(parts) != 4 {
+			continue
+		}
+		key := [3]string{parts[0], parts[1], parts[2]}
+		raw[key] = append(raw[key], parts[3])
+	}
+
+	modules := make([]moduleSummary, 0, len(raw))
+	for key, versions := range raw {
+		parsed := h.parseVersions(key[2], key[0], key[1], versions)
+		if len(parsed) == 0 {
+			continue
+		}
+		latest := parsed[len(parsed)-1].version.String()
+		modules = append(modules, moduleSummary{
+			ID:        strings.Join([]string{key[0], key[1], key[2], latest}, "/"),
+			Namespace: key[0],
+			Name:      key[1],
+			Provider:  key[2],
+			Version:   latest,
+		})
+	}
+	slices.SortFunc(modules, func(a, b moduleSummary) int {
+		return cmp.Or(
+			cmp.Compare(a.Namespace, b.Namespace),
+			cmp.Compare(a.Name, b.Name),
+			cmp.Compare(a.Provider, b.Provider),
+		)
+	})
+	return modules, nil
+}
+
+// pagination returns the offset and limit of the request, as given by the
+// query parameters of the same names.
+func pagination(r *http.Request) (int, int, error) {
+	offset, err := intParam(r, "offset", 0)
+	if err != nil || offset < 0 {
+		return 0, 0, &httpErr{
+			code: http.StatusBadRequest,
+			msg:  "invalid offset",
+		}
+	}
+	limit, err := intParam(r, "limit", defaultLimit)
+	if err != nil || limit < 1 {
+		return 0, 0, &httpErr{
+			code: http.StatusBadRequest,
+			msg:  "invalid limit",
+		}
+	}
+	return offset, min(limit, maxLimit), nil
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func newListModulesResponse(u *url.URL, modules []moduleSummary, offset, limit int) *listModulesResponse {
+	res := &listModulesResponse{
+		Meta: pageMeta{
+			Limit:         limit,
+			CurrentOffset: offset,
+		},
+		Modules: modules[min(offset, len(modules)):min(offset+limit, len(modules))],
+	}
+	if next := offset + limit; next < len(modules) {
+		res.Meta.NextOffset = &next
+		res.Meta.NextURL = pageURL(u, next, limit)
+	}
+	if offset > 0 {
+		prev := max(offset-limit, 0)
+		res.Meta.PrevOffset = &prev
+		res.Meta.PrevURL = pageURL(u, prev, limit)
+	}
+	return res
+}
+
+func pageURL(u *url.URL, offset, limit int) string {
+	q := u.Query()
+	q.Set("offset", strconv.Itoa(offset))
+	q.Set("limit", strconv.Itoa(limit))
+	return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+}
+
+type listModulesResponse struct {
+	Meta    pageMeta        `json:"meta"`
+	Modules []moduleSummary `json:"modules"`
+}
+
+type pageMeta struct {
+	Limit         int    `json:"limit"`
+	CurrentOffset int    `json:"current_offset"`
+	NextOffset    *int   `json:"next_offset,omitempty"`
+	PrevOffset    *int   `json:"prev_offset,omitempty"`
+	NextURL       string `json:"next_url,omitempty"`
+	PrevURL       string `json:"prev_url,omitempty"`
+}
+
+type moduleSummary struct {
+	ID        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Provider  string `json:"provider"`
+	Version   string `json:"version"`
+}
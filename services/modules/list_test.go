@@ -0,0 +1,150 @@
+package modules
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type mockModuleLister struct {
+	mockRepository
+	modules []string
+}
+
+func (m *mockModuleLister) ListModules(ctx context.Context) ([]string, error) {
+	return m.modules, m.err
+}
+
+func TestListModules(t *testing.T) {
+	repo := &mockModuleLister{
+		modules: []string{
+			"infra/vpc/aws/v1.0.0",
+			"infra/vpc/aws/v1.10.0",
+			"infra/vpc/aws/v1.2.0",
+			"infra/dns/aws/v0.1.0",
+			"infra/dns/google/v0.2.0",
+			"apps/web/aws/v2.0.0-rc.1",
+			"apps/queue/aws/latest",
+			"apps/bucket/aws/1.0.0",
+		},
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		url       string
+		handler   func(h *Handler) http.HandlerFunc
+		expStatus int
+		expBody   string
+	}{
+		{
+			name:      "all",
+			path:      "/v1/modules",
+			url:       "/v1/modules",
+			expStatus: http.StatusOK,
+			expBody: `{"meta":{"limit":15,"current_offset":0},"modules":[` +
+				`{"id":"apps/bucket/aws/1.0.0","namespace":"apps","name":"bucket","provider":"aws","version":"1.0.0"},` +
+				`{"id":"infra/dns/aws/0.1.0","namespace":"infra","name":"dns","provider":"aws","version":"0.1.0"},` +
+				`{"id":"infra/dns/google/0.2.0","namespace":"infra","name":"dns","provider":"google","version":"0.2.0"},` +
+				`{"id":"infra/vpc/aws/1.10.0","namespace":"infra","name":"vpc","provider":"aws","version":"1.10.0"}]}`,
+		},
+		{
+			name:      "namespace",
+			path:      "/v1/modules/:namespace",
+			url:       "/v1/modules/apps",
+			expStatus: http.StatusOK,
+			expBody: `{"meta":{"limit":15,"current_offset":0},"modules":[` +
+				`{"id":"apps/bucket/aws/1.0.0","namespace":"apps","name":"bucket","provider":"aws","version":"1.0.0"}]}`,
+		},
+		{
+			name:      "provider",
+			path:      "/v1/modules",
+			url:       "/v1/modules?provider=google",
+			expStatus: http.StatusOK,
+			expBody: `{"meta":{"limit":15,"current_offset":0},"modules":[` +
+				`{"id":"infra/dns/google/0.2.0","namespace":"infra","name":"dns","provider":"google","version":"0.2.0"}]}`,
+		},
+		{
+			name:      "paginated",
+			path:      "/v1/modules",
+			url:       "/v1/modules?offset=1&limit=2",
+			expStatus: http.StatusOK,
+			expBody: `{"meta":{"limit":2,"current_offset":1,"next_offset":3,"prev_offset":0,` +
+				`"next_url":"/v1/modules?limit=2&offset=3","prev_url":"/v1/modules?limit=2&offset=0"},"modules":[` +
+				`{"id":"infra/dns/aws/0.1.0","namespace":"infra","name":"dns","provider":"aws","version":"0.1.0"},` +
+				`{"id":"infra/dns/google/0.2.0","namespace":"infra","name":"dns","provider":"google","version":"0.2.0"}]}`,
+		},
+		{
+			name:      "past_the_end",
+			path:      "/v1/modules",
+			url:       "/v1/modules?offset=10",
+			expStatus: http.StatusOK,
+			expBody: `{"meta":{"limit":15,"current_offset":10,"prev_offset":0,` +
+				`"prev_url":"/v1/modules?limit=15&offset=0"},"modules":[]}`,
+		},
+		{
+			name:      "invalid_limit",
+			path:      "/v1/modules",
+			url:       "/v1/modules?limit=0",
+			expStatus: http.StatusBadRequest,
+			expBody:   `Bad Request`,
+		},
+		{
+			name:      "search",
+			path:      "/v1/modules/search",
+			url:       "/v1/modules/search?q=DNS",
+			handler:   func(h *Handler) http.HandlerFunc { return h.SearchModules },
+			expStatus: http.StatusOK,
+			expBody: `{"meta":{"limit":15,"current_offset":0},"modules":[` +
+				`{"id":"infra/dns/aws/0.1.0","namespace":"infra","name":"dns","provider":"aws","version":"0.1.0"},` +
+				`{"id":"infra/dns/google/0.2.0","namespace":"infra","name":"dns","provider":"google","version":"0.2.0"}]}`,
+		},
+		{
+			name:      "search_without_query",
+			path:      "/v1/modules/search",
+			url:       "/v1/modules/search",
+			handler:   func(h *Handler) http.HandlerFunc { return h.SearchModules },
+			expStatus: http.StatusBadRequest,
+			expBody:   `Bad Request`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &Handler{
+				log:  slog.Default(),
+				repo: repo,
+			}
+			f := handler.ListModules
+			if tt.handler != nil {
+				f = tt.handler(handler)
+			}
+
+			rr := httptest.NewRecorder()
+			route(tt.path, f).ServeHTTP(rr, mockRequest(t, tt.url))
+
+			if rr.Code != tt.expStatus {
+				t.Errorf("unexpected status code, exp: %d, got: %d", tt.expStatus, rr.Code)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expBody {
+				t.Errorf("unexpected response body, exp: %s, got: %s", tt.expBody, body)
+			}
+		})
+	}
+}
+
+func TestListModules_Unsupported(t *testing.T) {
+	handler := &Handler{
+		log:  slog.Default(),
+		repo: &mockRepository{},
+	}
+
+	rr := httptest.NewRecorder()
+	route("/v1/modules", handler.ListModules).ServeHTTP(rr, mockRequest(t, "/v1/modules"))
+
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("unexpected status code, exp: %d, got: %d", http.StatusNotImplemented, rr.Code)
+	}
+}
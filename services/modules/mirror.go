@@ -0,0 +1,438 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/reMarkable/orbit/pkg/registry"
+	"github.com/reMarkable/orbit/pkg/router"
+)
+
+// ProviderRegistry is the upstream registry of the mirrored providers.
+type ProviderRegistry interface {
+	ProviderVersions(ctx context.Context, hostname, namespace, typ string) ([]registry.Version, error)
+	ProviderPackage(ctx context.Context, hostname, namespace, typ, version, os, arch string) (registry.Package, error)
+	Download(ctx context.Context, url string, w io.Writer) error
+}
+
+func NewMirror(r ProviderRegistry, s KeyValueStore, f FileStorage, l Logger, mh *MetricsHandler) *Mirror {
+	return &Mirror{
+		files:    f,
+		log:      l,
+		mh:       mh,
+		registry: r,
+		store:    s,
+	}
+}
+
+// Mirror implements the provider network mirror protocol, pulling the
+// providers from their registries on demand. The versions and packages are
+// kept in the store, and the packages themselves, once verified, in the files,
+// along with their `h1:` hashes.
+//
+// https://developer.hashicorp.com/terraform/internals/provider-network-mirror-protocol
+type Mirror struct {
+	files    FileStorage
+	log      Logger
+	mh       *MetricsHandler
+	registry ProviderRegistry
+	store    KeyValueStore
+
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	// fetching holds the names of the packages being prefetched, and
+	// prefetches is waited on by the tests.
+	fetching   sync.Map
+	prefetches sync.WaitGroup
+}
+
+// Index lists the versions of the provider.
+func (m *Mirror) Index(w http.ResponseWriter, r *http.Request) {
+	if m.mh != nil {
+		m.mh.IncrementRequestCount("MirrorIndex")
+	}
+	var (
+		ctx       = r.Context()
+		hostname  = router.GetParameter(ctx, "hostname")
+		namespace = router.GetParameter(ctx, "namespace")
+		typ       = router.GetParameter(ctx, "type")
+	)
+
+	versions, err := m.versions(ctx, hostname, namespace, typ)
+	if err != nil {
+		m.log.Error("mirror versions", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	res := mirrorIndexResponse{
+		Versions: make(map[string]struct{}, len(versions)),
+	}
+	for _, v := range versions {
+		res.Versions[v.Version] = struct{}{}
+	}
+	if err := encodeJSON(w, &res); err != nil {
+		m.log.Error("encode response", "err", err)
+		return
+	}
+}
+
+// Version lists the packages of the version of the provider, by platform, as
+// requested by `<version>.json`.
+func (m *Mirror) Version(w http.ResponseWriter, r *http.Request) {
+	if m.mh != nil {
+		m.mh.IncrementRequestCount("MirrorVersion")
+	}
+	var (
+		ctx       = r.Context()
+		hostname  = router.GetParameter(ctx, "hostname")
+		namespace = router.GetParameter(ctx, "namespace")
+		typ       = router.GetParameter(ctx, "type")
+	)
+	version, ok := strings.CutSuffix(router.GetParameter(ctx, "version"), ".json")
+	if !ok {
+		respErr(w, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "not found",
+		})
+		return
+	}
+
+	versions, err := m.versions(ctx, hostname, namespace, typ)
+	if err != nil {
+		m.log.Error("mirror versions", "err", err)
+		respErr(w, err)
+		return
+	}
+	i := slices.IndexFunc(versions, func(v registry.Version) bool {
+		return v.Version == version
+	})
+	if i < 0 {
+		respErr(w, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "no such version",
+		})
+		return
+	}
+
+	res := mirrorVersionResponse{
+		Archives: make(map[string]mirrorArchive, len(versions[i].Platforms)),
+	}
+	var unhashed []registry.Package
+	for _, p := range versions[i].Platforms {
+		pkg, err := m.providerPackage(ctx, hostname, namespace, typ, version, p.OS, p.Arch)
+		if err != nil {
+			m.log.Error("mirror package", "err", err)
+			respErr(w, err)
+			return
+		}
+		hashes := m.hashes(hostname, namespace, typ, pkg)
+		if len(hashes) == 1 {
+			unhashed = append(unhashed, pkg)
+		}
+		res.Archives[p.OS+"_"+p.Arch] = mirrorArchive{
+			// Relative to this response, and leading to Archive.
+			URL:    version + "/" + pkg.Filename,
+			Hashes: hashes,
+		}
+	}
+	m.prefetch(ctx, hostname, namespace, typ, unhashed)
+
+	if err := encodeJSON(w, &res); err != nil {
+		m.log.Error("encode response", "err", err)
+		return
+	}
+}
+
+// prefetch downloads the packages in the background, for their `h1:` hashes,
+// which Terraform needs to lock the providers for other platforms than its
+// own. They're too large to download while Terraform waits for the version.
+func (m *Mirror) prefetch(ctx context.Context, hostname, namespace, typ string, pkgs []registry.Package) {
+	if len(pkgs) == 0 {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	m.prefetches.Add(1)
+	go func() {
+		defer m.prefetches.Done()
+		for _, pkg := range pkgs {
+			name := m.filename(hostname, namespace, typ, pkg.Filename)
+			if _, ok := m.fetching.LoadOrStore(name, struct{}{}); ok {
+				continue
+			}
+			m.misses.Add(1)
+			if err := m.download(ctx, name, pkg, io.Discard); err != nil {
+				m.log.Error("mirror prefetch", "err", err)
+			}
+			m.fetching.Delete(name)
+		}
+	}()
+}
+
+// Archive downloads the package, from the files if it's there, or else from
+// the upstream registry, keeping it in the files once its checksum is
+// verified.
+func (m *Mirror) Archive(w http.ResponseWriter, r *http.Request) {
+	if m.mh != nil {
+		m.mh.IncrementRequestCount("MirrorArchive")
+	}
+	var (
+		ctx       = r.Context()
+		hostname  = router.GetParameter(ctx, "hostname")
+		namespace = router.GetParameter(ctx, "namespace")
+		typ       = router.GetParameter(ctx, "type")
+		version   = router.GetParameter(ctx, "version")
+		filename  = router.GetParameter(ctx, "filename")
+	)
+
+	// The packages are named `terraform-provider-<type>_<version>_<os>_<arch>.zip`.
+	parts := strings.Split(strings.TrimSuffix(filename, ".zip"), "_")
+	if len(parts) < 3 || !strings.HasSuffix(filename, ".zip") {
+		respErr(w, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "no such package",
+		})
+		return
+	}
+	pkg, err := m.providerPackage(ctx, hostname, namespace, typ, version, parts[len(parts)-2], parts[len(parts)-1])
+	if err != nil {
+		m.log.Error("mirror package", "err", err)
+		respErr(w, err)
+		return
+	}
+	if pkg.Filename != filename {
+		respErr(w, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "no such package",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	name := m.filename(hostname, namespace, typ, filename)
+	if f, err := m.files.Open(name); err == nil {
+		m.hits.Add(1)
+		defer func() {
+			if err := f.Close(); err != nil {
+				m.log.Error("failed to close cached file", "err", err)
+			}
+		}()
+		if _, err := io.Copy(w, f); err != nil {
+			m.log.Error("failed to copy cached file", "err", err)
+		}
+		return
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		// We'll just download it again, as the cache does.
+		m.log.Error("failed to open cached file", "err", err)
+	}
+
+	m.misses.Add(1)
+	if err := m.download(ctx, name, pkg, w); err != nil {
+		m.log.Error("mirror download", "err", err)
+		respErr(w, err)
+		return
+	}
+}
+
+// Hits and Misses return how many packages were served from the files, and
+// how many had to be downloaded.
+func (m *Mirror) Hits() int {
+	return int(m.hits.Load())
+}
+
+func (m *Mirror) Misses() int {
+	return int(m.misses.Load())
+}
+
+// versions returns the versions of the provider, which are stored as the
+// version followed by its platforms, e.g. `3.6.0 linux_amd64 darwin_arm64`.
+func (m *Mirror) versions(ctx context.Context, hostname, namespace, typ string) ([]registry.Version, error) {
+	key := strings.Join([]string{"mirror", hostname, namespace, typ}, "/")
+	if v, ok := m.store.Get(key); ok {
+		versions := make([]registry.Version, len(v))
+		for n, s := range v {
+			version, platforms, _ := strings.Cut(s, " ")
+			versions[n].Version = version
+			for _, p := range strings.Fields(platforms) {
+				goos, goarch, _ := strings.Cut(p, "_")
+				versions[n].Platforms = append(versions[n].Platforms, registry.Platform{OS: goos, Arch: goarch})
+			}
+		}
+		return versions, nil
+	}
+
+	versions, err := m.registry.ProviderVersions(ctx, hostname, namespace, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	v := make([]string, len(versions))
+	for n, version := range versions {
+		fields := []string{version.Version}
+		for _, p := range version.Platforms {
+			fields = append(fields, p.OS+"_"+p.Arch)
+		}
+		v[n] = strings.Join(fields, " ")
+	}
+	m.store.Set(key, v)
+	return versions, nil
+}
+
+// providerPackage returns the package of the version for the platform, which
+// is stored as its filename, download URL and checksum.
+func (m *Mirror) providerPackage(ctx context.Context, hostname, namespace, typ, version, goos, goarch string) (registry.Package, error) {
+	key := strings.Join([]string{"mirror", hostname, namespace, typ, version, goos, goarch}, "/")
+	if v, ok := m.store.Get(key); ok && len(v) == 3 {
+		return registry.Package{Filename: v[0], DownloadURL: v[1], Shasum: v[2]}, nil
+	}
+
+	pkg, err := m.registry.ProviderPackage(ctx, hostname, namespace, typ, version, goos, goarch)
+	if err != nil {
+		return pkg, err
+	}
+
+	m.store.Set(key, []string{pkg.Filename, pkg.DownloadURL, pkg.Shasum})
+	return pkg, nil
+}
+
+// hashes returns the hashes of the package, which Terraform verifies it by:
+// the `zh:` hash given by the registry, and the `h1:` hash, once we have the
+// package and have been able to compute it, as prefetched for the version.
+func (m *Mirror) hashes(hostname, namespace, typ string, pkg registry.Package) []string {
+	hashes := []string{"zh:" + pkg.Shasum}
+	f, err := m.files.Open(m.filename(hostname, namespace, typ, pkg.Filename) + ".h1")
+	if err != nil {
+		return hashes
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			m.log.Error("failed to close cached file", "err", err)
+		}
+	}()
+
+	b, err := io.ReadAll(f)
+	if h1 := strings.TrimSpace(string(b)); err == nil && strings.HasPrefix(h1, "h1:") {
+		hashes = append([]string{h1}, hashes...)
+	}
+	return hashes
+}
+
+// download writes the package, once it's been downloaded in full and verified,
+// keeping it in the files, along with its `h1:` hash.
+func (m *Mirror) download(ctx context.Context, name string, pkg registry.Package, w io.Writer) error {
+	tmp, err := os.CreateTemp("", "orbit-mirror-*.zip")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	sum := sha256.New()
+	if err := m.registry.Download(ctx, pkg.DownloadURL, io.MultiWriter(tmp, sum)); err != nil {
+		return err
+	}
+	if shasum := hex.EncodeToString(sum.Sum(nil)); shasum != pkg.Shasum {
+		return &httpErr{
+			code: http.StatusBadGateway,
+			msg:  fmt.Sprintf("checksum mismatch of %s: %s", pkg.Filename, shasum),
+		}
+	}
+
+	h1, err := hashPackage(tmp.Name())
+	if err != nil {
+		return err
+	}
+	// Failing to keep the package only means it's downloaded again.
+	if err := keepFile(m.files, name, tmp); err != nil {
+		m.log.Error("failed to cache package", "err", err)
+	} else if err := keepFile(m.files, name+".h1", strings.NewReader(h1+"\n")); err != nil {
+		m.log.Error("failed to cache package hash", "err", err)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking package: %w", err)
+	}
+	if _, err := io.Copy(w, tmp); err != nil {
+		return fmt.Errorf("copying package: %w", err)
+	}
+	return nil
+}
+
+func (m *Mirror) filename(hostname, namespace, typ, filename string) string {
+	return strings.Join([]string{"mirror", hostname, namespace, typ, filename}, "-")
+}
+
+// hashPackage returns the `h1:` hash of the package, which is that of the
+// files in it, rather than of the zip, as computed by Terraform for the lock
+// files: the SHA-256 of the sorted lines of `<SHA-256 of file>  <name>`.
+//
+// https://pkg.go.dev/golang.org/x/mod/sumdb/dirhash#Hash1
+func hashPackage(path string) (string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return "", fmt.Errorf("opening package: %w", err)
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+
+	files := slices.DeleteFunc(slices.Clone(zr.File), func(f *zip.File) bool {
+		return f.FileInfo().IsDir()
+	})
+	slices.SortFunc(files, func(a, b *zip.File) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	summary := sha256.New()
+	for _, f := range files {
+		if strings.Contains(f.Name, "\n") {
+			return "", fmt.Errorf("invalid file name %q in package", f.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return "", fmt.Errorf("opening %s: %w", f.Name, err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		_ = r.Close()
+		if err != nil {
+			return "", fmt.Errorf("reading %s: %w", f.Name, err)
+		}
+		fmt.Fprintf(summary, "%x  %s\n", h.Sum(nil), f.Name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(summary.Sum(nil)), nil
+}
+
+type mirrorIndexResponse struct {
+	Versions map[string]struct{} `json:"versions"`
+}
+
+type mirrorVersionResponse struct {
+	Archives map[string]mirrorArchive `json:"archives"`
+}
+
+type mirrorArchive struct {
+	URL    string   `json:"url"`
+	Hashes []string `json:"hashes"`
+}
@@ -0,0 +1,220 @@
+package modules
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/reMarkable/orbit/pkg/registry"
+)
+
+// mockPackage returns a provider package, along with its `h1:` hash, as
+// computed by dirhash.Hash1.
+func mockPackage(t *testing.T) ([]byte, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{
+		{"terraform-provider-thing_v1.0.0", "binary"},
+		{"LICENSE", "license"},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("creating %s: %v", f.name, err)
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			t.Fatalf("writing %s: %v", f.name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing zip: %v", err)
+	}
+	return buf.Bytes(), "h1:yBdWrLrGc2KWWSh7K0oT6vrrJdS6PkWHW2Zg08jjUpI="
+}
+
+// newMockUpstream starts a stand-in for the upstream registry, serving a
+// single version of a provider, counting the downloads of the package.
+func newMockUpstream(t *testing.T, pkg []byte, shasum string) (*Mirror, string, *atomic.Int32) {
+	t.Helper()
+
+	var downloads atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/terraform.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"providers.v1":"/v1/providers/"}`))
+	})
+	mux.HandleFunc("GET /v1/providers/infra/thing/versions", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"versions":[{"version":"1.0.0","protocols":["5.0"],"platforms":[` +
+			`{"os":"linux","arch":"amd64"},{"os":"darwin","arch":"arm64"}]}]}`))
+	})
+	mux.HandleFunc("GET /v1/providers/infra/thing/1.0.0/download/{os}/{arch}", func(w http.ResponseWriter, r *http.Request) {
+		filename := fmt.Sprintf("terraform-provider-thing_1.0.0_%s_%s.zip", r.PathValue("os"), r.PathValue("arch"))
+		_, _ = fmt.Fprintf(w, `{"filename":%q,"download_url":"/files/%s","shasum":%q}`, filename, filename, shasum)
+	})
+	mux.HandleFunc("GET /files/{filename}", func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		_, _ = w.Write(pkg)
+	})
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror := NewMirror(
+		registry.New(registry.Config{Hosts: []string{u.Host}}, srv.Client()),
+		&mockKeyValueStore{data: make(map[string][]string)},
+		&mockFileStorage{files: make(map[string][]byte)},
+		slog.Default(),
+		nil,
+	)
+	return mirror, u.Host, &downloads
+}
+
+func TestMirror(t *testing.T) {
+	pkg, h1 := mockPackage(t)
+	zh := fmt.Sprintf("%x", sha256.Sum256(pkg))
+	mirror, host, downloads := newMockUpstream(t, pkg, zh)
+
+	get := func(path, url string, h http.HandlerFunc) *httptest.ResponseRecorder {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		route(path, h).ServeHTTP(rr, mockRequest(t, url))
+		return rr
+	}
+	base := "/v1/mirror/" + host + "/infra/thing/"
+
+	rr := get("/v1/mirror/:hostname/:namespace/:type/index.json", base+"index.json", mirror.Index)
+	if exp := `{"versions":{"1.0.0":{}}}`; strings.TrimSpace(rr.Body.String()) != exp {
+		t.Errorf("unexpected index, exp: %s, got: %s", exp, rr.Body.String())
+	}
+
+	version := func() string {
+		t.Helper()
+		rr := get("/v1/mirror/:hostname/:namespace/:type/:version", base+"1.0.0.json", mirror.Version)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected status code %d", rr.Code)
+		}
+		return strings.TrimSpace(rr.Body.String())
+	}
+	// Until we have the packages, we only know their zh: hashes.
+	exp := fmt.Sprintf(`{"archives":{`+
+		`"darwin_arm64":{"url":"1.0.0/terraform-provider-thing_1.0.0_darwin_arm64.zip","hashes":["zh:%s"]},`+
+		`"linux_amd64":{"url":"1.0.0/terraform-provider-thing_1.0.0_linux_amd64.zip","hashes":["zh:%s"]}}}`, zh, zh)
+	if got := version(); got != exp {
+		t.Errorf("unexpected version, exp: %s, got: %s", exp, got)
+	}
+
+	// They're prefetched for their h1: hashes, of every platform.
+	mirror.prefetches.Wait()
+	exp = fmt.Sprintf(`{"archives":{`+
+		`"darwin_arm64":{"url":"1.0.0/terraform-provider-thing_1.0.0_darwin_arm64.zip","hashes":["%s","zh:%s"]},`+
+		`"linux_amd64":{"url":"1.0.0/terraform-provider-thing_1.0.0_linux_amd64.zip","hashes":["%s","zh:%s"]}}}`, h1, zh, h1, zh)
+	if got := version(); got != exp {
+		t.Errorf("unexpected version, exp: %s, got: %s", exp, got)
+	}
+	mirror.prefetches.Wait()
+
+	for range 2 {
+		rr := get("/v1/mirror/:hostname/:namespace/:type/:version/:filename",
+			base+"1.0.0/terraform-provider-thing_1.0.0_linux_amd64.zip", mirror.Archive)
+		if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), pkg) {
+			t.Errorf("unexpected package, status code %d", rr.Code)
+		}
+	}
+	if n := downloads.Load(); n != 2 {
+		t.Errorf("expected the packages downloaded once each, got %d", n)
+	}
+	if mirror.Hits() != 2 || mirror.Misses() != 2 {
+		t.Errorf("unexpected hits %d and misses %d", mirror.Hits(), mirror.Misses())
+	}
+}
+
+func TestMirror_Archive(t *testing.T) {
+	pkg, _ := mockPackage(t)
+	mirror, host, downloads := newMockUpstream(t, pkg, fmt.Sprintf("%x", sha256.Sum256(pkg)))
+
+	// Packages not yet prefetched are downloaded on demand.
+	for range 2 {
+		rr := httptest.NewRecorder()
+		route("/v1/mirror/:hostname/:namespace/:type/:version/:filename", mirror.Archive).
+			ServeHTTP(rr, mockRequest(t, "/v1/mirror/"+host+"/infra/thing/1.0.0/terraform-provider-thing_1.0.0_linux_amd64.zip"))
+		if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), pkg) {
+			t.Errorf("unexpected package, status code %d", rr.Code)
+		}
+	}
+	if n := downloads.Load(); n != 1 {
+		t.Errorf("expected the package downloaded once, got %d", n)
+	}
+	if mirror.Hits() != 1 || mirror.Misses() != 1 {
+		t.Errorf("unexpected hits %d and misses %d", mirror.Hits(), mirror.Misses())
+	}
+}
+
+func TestMirror_Invalid(t *testing.T) {
+	pkg, _ := mockPackage(t)
+	mirror, host, _ := newMockUpstream(t, pkg, "0000")
+	base := "/v1/mirror/" + host + "/infra/thing/"
+
+	tests := []struct {
+		name      string
+		path      string
+		url       string
+		handler   http.HandlerFunc
+		expStatus int
+	}{
+		{
+			name:      "unknown_host",
+			path:      "/v1/mirror/:hostname/:namespace/:type/index.json",
+			url:       "/v1/mirror/example.com/infra/thing/index.json",
+			handler:   mirror.Index,
+			expStatus: http.StatusForbidden,
+		},
+		{
+			name:      "unknown_version",
+			path:      "/v1/mirror/:hostname/:namespace/:type/:version",
+			url:       base + "2.0.0.json",
+			handler:   mirror.Version,
+			expStatus: http.StatusNotFound,
+		},
+		{
+			name:      "not_json",
+			path:      "/v1/mirror/:hostname/:namespace/:type/:version",
+			url:       base + "1.0.0",
+			handler:   mirror.Version,
+			expStatus: http.StatusNotFound,
+		},
+		{
+			name:      "unknown_package",
+			path:      "/v1/mirror/:hostname/:namespace/:type/:version/:filename",
+			url:       base + "1.0.0/terraform-provider-other_1.0.0_linux_amd64.zip",
+			handler:   mirror.Archive,
+			expStatus: http.StatusNotFound,
+		},
+		{
+			name:      "checksum_mismatch",
+			path:      "/v1/mirror/:hostname/:namespace/:type/:version/:filename",
+			url:       base + "1.0.0/terraform-provider-thing_1.0.0_linux_amd64.zip",
+			handler:   mirror.Archive,
+			expStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			route(tt.path, tt.handler).ServeHTTP(rr, mockRequest(t, tt.url))
+			if rr.Code != tt.expStatus {
+				t.Errorf("unexpected status code, exp: %d, got: %d", tt.expStatus, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reMarkable/orbit/pkg/semver"
+)
+
+// CommitRepository is implemented by the repositories able to resolve the
+// versions to the commits they're tagged at, and to download by commit.
+type CommitRepository interface {
+	Repository
+	ResolveCommit(ctx context.Context, owner, repo, module, version string) (string, error)
+	DownloadCommit(ctx context.Context, owner, repo, module, version, commit string, w io.Writer) error
+}
+
+// PinStore keeps the commits the versions are pinned to. Versions are only
+// ever pinned once, so setting the pins leaves the ones already set.
+type PinStore interface {
+	Get(key string) (string, bool)
+	Set(key, commit string) error
+	SetAll(pins map[string]string) error
+}
+
+// PinMode decides what to do about versions whose tags have moved since they
+// were pinned.
+type PinMode string
+
+const (
+	// PinKeep keeps serving the commit the version was pinned to.
+	PinKeep PinMode = "keep"
+	// PinRefuse refuses to serve the version at all.
+	PinRefuse PinMode = "refuse"
+)
+
+func ParsePinMode(s string) (PinMode, error) {
+	switch m := PinMode(strings.ToLower(s)); m {
+	case PinKeep, PinRefuse:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown pin mode: %q", s)
+}
+
+// NewPinner pins the versions in the store, keeping the commits the tags were
+// last found at in the checks store for as long as they're not checked again.
+func NewPinner(r CommitRepository, s PinStore, checks KeyValueStore, mode PinMode, l Logger) *Pinner {
+	return &Pinner{
+		checks: checks,
+		log:    l,
+		mode:   mode,
+		repo:   r,
+		store:  s,
+	}
+}
+
+// Pinner implements the modules repository by pinning the versions to the
+// commits they were tagged at when first seen, and downloading by commit from
+// then on, since tags can be moved.
+type Pinner struct {
+	checks KeyValueStore
+	log    Logger
+	mode   PinMode
+	moved  atomic.Int64
+	repo   CommitRepository
+	store  PinStore
+
+	// pinning holds the modules whose versions are being pinned, and batches
+	// is waited on by the tests.
+	pinning sync.Map
+	batches sync.WaitGroup
+}
+
+// ListVersions pins the versions not already pinned, so that tags moved before
+// the versions are first downloaded are detected as well. They're pinned in
+// the background, rather than having Terraform wait for every tag to be
+// resolved.
+func (p *Pinner) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
+	versions, err := p.repo.ListVersions(ctx, owner, repo, module)
+	if err != nil {
+		return nil, err
+	}
+
+	var unpinned []string
+	for _, version := range versions {
+		if _, ok := p.store.Get(pinKey(owner, repo, module, version)); ok {
+			continue
+		}
+		// Only the semantic versions are ever served.
+		if _, err := semver.Parse(version); err != nil {
+			continue
+		}
+		unpinned = append(unpinned, version)
+	}
+	p.pinAll(ctx, owner, repo, module, unpinned)
+	return versions, nil
+}
+
+// pinAll pins the versions of the module in the background, writing the pins
+// all at once. Modules already being pinned are left to the batch pinning
+// them, and any versions failing are pinned when downloaded instead.
+func (p *Pinner) pinAll(ctx context.Context, owner, repo, module string, versions []string) {
+	if len(versions) == 0 {
+		return
+	}
+	name := strings.Join([]string{owner, repo, module}, "/")
+	if _, ok := p.pinning.LoadOrStore(name, struct{}{}); ok {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	p.batches.Add(1)
+	go func() {
+		defer p.batches.Done()
+		defer p.pinning.Delete(name)
+
+		pins := make(map[string]string, len(versions))
+		for _, version := range versions {
+			key := pinKey(owner, repo, module, version)
+			commit, err := p.repo.ResolveCommit(ctx, owner, repo, module, version)
+			if err != nil {
+				p.log.Error("failed to pin version", "version", key, "err", err)
+				continue
+			}
+			p.checks.Set(key, []string{commit})
+			pins[key] = commit
+		}
+		if err := p.store.SetAll(pins); err != nil {
+			p.log.Error("failed to pin versions", "module", name, "err", err)
+		}
+	}()
+}
+
+func (p *Pinner) ListModules(ctx context.Context) ([]string, error) {
+	lister, ok := p.repo.(ModuleLister)
+	if !ok {
+		return nil, errNoModules
+	}
+	return lister.ListModules(ctx)
+}
+
+// DescribeVersion tells the commit the version is pinned to, if it is, since
+// that's the one downloaded.
+func (p *Pinner) DescribeVersion(ctx context.Context, owner, repo, module, version string) (string, string, time.Time, error) {
+	d, ok := p.repo.(VersionDescriber)
+	if !ok {
+		return "", "", time.Time{}, errNoDescriptions
+	}
+	source, commit, published, err := d.DescribeVersion(ctx, owner, repo, module, version)
+	if pinned, ok := p.store.Get(pinKey(owner, repo, module, version)); ok {
+		commit = pinned
+	}
+	return source, commit, published, err
+}
+
+// ProviderAssets and ProviderAsset pass through, since the providers are
+// verified by their signed checksums rather than pinned.
+func (p *Pinner) ProviderAssets(ctx context.Context, namespace, typ string) ([]string, error) {
+	pr, ok := p.repo.(ProviderRepository)
+	if !ok {
+		return nil, errNoProviders
+	}
+	return pr.ProviderAssets(ctx, namespace, typ)
+}
+
+func (p *Pinner) ProviderAsset(ctx context.Context, namespace, typ, version, asset string, w io.Writer) error {
+	pr, ok := p.repo.(ProviderRepository)
+	if !ok {
+		return errNoProviders
+	}
+	return pr.ProviderAsset(ctx, namespace, typ, version, asset, w)
+}
+
+func (p *Pinner) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	pinned, err := p.pin(ctx, owner, repo, module, version)
+	if err != nil {
+		return err
+	}
+	return p.repo.DownloadCommit(ctx, owner, repo, module, version, pinned, w)
+}
+
+// Checksum is the checksum of the archive of the commit the version is pinned
+// to, since that's the one downloaded.
+func (p *Pinner) Checksum(ctx context.Context, owner, repo, module, version string) (string, error) {
+	cr, ok := p.repo.(ChecksumRepository)
+	if !ok {
+		return "", errNoChecksums
+	}
+	pinned, err := p.pin(ctx, owner, repo, module, version)
+	if err != nil {
+		return "", err
+	}
+	return cr.ChecksumCommit(ctx, owner, repo, module, version, pinned)
+}
+
+func (p *Pinner) ChecksumCommit(ctx context.Context, owner, repo, module, version, commit string) (string, error) {
+	cr, ok := p.repo.(ChecksumRepository)
+	if !ok {
+		return "", errNoChecksums
+	}
+	return cr.ChecksumCommit(ctx, owner, repo, module, version, commit)
+}
+
+// pin returns the commit the version is pinned to, pinning it to the commit
+// it's tagged at, if it isn't already. The tags of pinned versions are only
+// checked again once the last check has expired from the checks store.
+func (p *Pinner) pin(ctx context.Context, owner, repo, module, version string) (string, error) {
+	key := pinKey(owner, repo, module, version)
+	pinned, ok := p.store.Get(key)
+
+	var commit string
+	if v, checked := p.checks.Get(key); ok && checked && len(v) == 1 {
+		commit = v[0]
+	} else {
+		var err error
+		if commit, err = p.repo.ResolveCommit(ctx, owner, repo, module, version); err != nil {
+			return "", err
+		}
+		p.checks.Set(key, []string{commit})
+	}
+
+	switch {
+	case !ok:
+		if err := p.store.Set(key, commit); err != nil {
+			return "", fmt.Errorf("pinning %s: %w", key, err)
+		}
+		pinned = commit
+	case pinned != commit:
+		p.moved.Add(1)
+		p.log.Error("version moved since pinned", "version", key, "pinned", pinned, "commit", commit, "mode", p.mode)
+		if p.mode == PinRefuse {
+			return "", &httpErr{
+				code: http.StatusConflict,
+				msg:  "version moved since pinned",
+			}
+		}
+	}
+	return pinned, nil
+}
+
+func pinKey(owner, repo, module, version string) string {
+	return strings.Join([]string{owner, repo, module, version}, "/")
+}
+
+// Moved returns how many times versions were found to have moved.
+func (p *Pinner) Moved() int {
+	return int(p.moved.Load())
+}
+
+// FilePins implements the PinStore interface by keeping the pins in a JSON
+// file, which is rewritten whenever versions are pinned. The pins are few and
+// rarely added, in batches when listed, so that's good enough.
+type FilePins struct {
+	path string
+	mu   sync.RWMutex
+	pins map[string]string
+}
+
+// NewFilePins loads the pins from the file at the path, if it exists.
+func NewFilePins(path string) (*FilePins, error) {
+	f := &FilePins{
+		path: path,
+		pins: map[string]string{},
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading pins: %w", err)
+	}
+	if err := json.Unmarshal(b, &f.pins); err != nil {
+		return nil, fmt.Errorf("parsing pins: %w", err)
+	}
+	return f, nil
+}
+
+func (f *FilePins) Get(key string) (string, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	commit, ok := f.pins[key]
+	return commit, ok
+}
+
+func (f *FilePins) Set(key, commit string) error {
+	return f.SetAll(map[string]string{key: commit})
+}
+
+func (f *FilePins) SetAll(pins map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var added []string
+	for key, commit := range pins {
+		if _, ok := f.pins[key]; !ok {
+			f.pins[key] = commit
+			added = append(added, key)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if err := f.save(); err != nil {
+		for _, key := range added {
+			delete(f.pins, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FilePins) save() error {
+	b, err := json.MarshalIndent(f.pins, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file atomically, so a crash doesn't lose all the pins.
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
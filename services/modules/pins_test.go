@@ -0,0 +1,180 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+type mockCommitRepository struct {
+	mockCacheRepository
+	commits    map[string]string
+	resolved   int
+	downloaded []string
+}
+
+func (m *mockCommitRepository) ResolveCommit(ctx context.Context, owner, repo, module, version string) (string, error) {
+	m.resolved++
+	commit, ok := m.commits[version]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return commit, nil
+}
+
+func (m *mockCommitRepository) DownloadCommit(ctx context.Context, owner, repo, module, version, commit string, w io.Writer) error {
+	m.downloaded = append(m.downloaded, commit)
+	_, err := w.Write([]byte("tarball at " + commit))
+	return err
+}
+
+func TestPinner_ProxyDownload(t *testing.T) {
+	pins, err := NewFilePins(filepath.Join(t.TempDir(), "pins.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	repo := &mockCommitRepository{commits: map[string]string{"v1.0.0": "aaa"}}
+	checks := &mockKeyValueStore{data: make(map[string][]string)}
+	p := NewPinner(repo, pins, checks, PinKeep, &mockLogger{})
+
+	var buf bytes.Buffer
+	if err := p.ProxyDownload(context.Background(), "owner", "repo", "module", "v1.0.0", &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if commit, ok := pins.Get("owner/repo/module/v1.0.0"); !ok || commit != "aaa" {
+		t.Errorf("expected the version pinned to aaa, got %q", commit)
+	}
+
+	// The tag isn't checked again until the last check has expired.
+	repo.commits["v1.0.0"] = "bbb"
+	if err := p.ProxyDownload(context.Background(), "owner", "repo", "module", "v1.0.0", io.Discard); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if repo.resolved != 1 || p.Moved() != 0 {
+		t.Errorf("expected a single check, got %d, and no moved versions, got %d", repo.resolved, p.Moved())
+	}
+
+	// Once the tag is checked again, the pinned commit is still served.
+	delete(checks.data, "owner/repo/module/v1.0.0")
+	buf.Reset()
+	if err := p.ProxyDownload(context.Background(), "owner", "repo", "module", "v1.0.0", &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != "tarball at aaa" {
+		t.Errorf("expected the pinned commit, got %q", buf.String())
+	}
+	if p.Moved() != 1 {
+		t.Errorf("expected one moved version, got %d", p.Moved())
+	}
+}
+
+func TestPinner_Refuse(t *testing.T) {
+	pins, err := NewFilePins(filepath.Join(t.TempDir(), "pins.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := pins.Set("owner/repo/module/v1.0.0", "aaa"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	repo := &mockCommitRepository{commits: map[string]string{"v1.0.0": "bbb"}}
+	p := NewPinner(repo, pins, &mockKeyValueStore{data: make(map[string][]string)}, PinRefuse, &mockLogger{})
+
+	err = p.ProxyDownload(context.Background(), "owner", "repo", "module", "v1.0.0", io.Discard)
+	var herr *httpErr
+	if !errors.As(err, &herr) || herr.code != http.StatusConflict {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+	if len(repo.downloaded) > 0 {
+		t.Errorf("expected nothing downloaded, got %v", repo.downloaded)
+	}
+}
+
+func TestPinner_ListVersions(t *testing.T) {
+	pins, err := NewFilePins(filepath.Join(t.TempDir(), "pins.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := pins.Set("owner/repo/module/v1.0.0", "aaa"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	repo := &mockCommitRepository{
+		mockCacheRepository: mockCacheRepository{versions: map[string][]string{
+			"owner/repo/module": {"v1.0.0", "v1.1.0", "latest"},
+		}},
+		commits: map[string]string{"v1.0.0": "aaa", "v1.1.0": "bbb", "latest": "bbb"},
+	}
+	p := NewPinner(repo, pins, &mockKeyValueStore{data: make(map[string][]string)}, PinRefuse, &mockLogger{})
+
+	versions, err := p.ListVersions(context.Background(), "owner", "repo", "module")
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("expected the versions, got %v (%v)", versions, err)
+	}
+	p.batches.Wait()
+	if commit, ok := pins.Get("owner/repo/module/v1.1.0"); !ok || commit != "bbb" {
+		t.Errorf("expected the version pinned to bbb when listed, got %q", commit)
+	}
+	if _, ok := pins.Get("owner/repo/module/latest"); ok {
+		t.Error("expected no pin of a version that's never served")
+	}
+	if repo.resolved != 1 {
+		t.Errorf("expected only the new version resolved, got %d", repo.resolved)
+	}
+
+	// A tag moved after being listed, but before being downloaded, is
+	// detected by the download.
+	repo.commits["v1.1.0"] = "ccc"
+	p.checks = &mockKeyValueStore{data: make(map[string][]string)}
+	err = p.ProxyDownload(context.Background(), "owner", "repo", "module", "v1.1.0", io.Discard)
+	var herr *httpErr
+	if !errors.As(err, &herr) || herr.code != http.StatusConflict {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+}
+
+func TestFilePins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pins.json")
+	pins, err := NewFilePins(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := pins.Set("owner/repo/module/v1.0.0", "aaa"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reloaded, err := NewFilePins(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if commit, ok := reloaded.Get("owner/repo/module/v1.0.0"); !ok || commit != "aaa" {
+		t.Errorf("expected the pin to persist, got %q", commit)
+	}
+
+	// Pinned versions stay pinned.
+	if err := pins.SetAll(map[string]string{"owner/repo/module/v1.0.0": "bbb", "owner/repo/module/v1.1.0": "ccc"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reloaded, err = NewFilePins(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for key, exp := range map[string]string{"owner/repo/module/v1.0.0": "aaa", "owner/repo/module/v1.1.0": "ccc"} {
+		if commit, _ := reloaded.Get(key); commit != exp {
+			t.Errorf("%s: expected %q, got %q", key, exp, commit)
+		}
+	}
+}
+
+func TestParsePinMode(t *testing.T) {
+	for s, exp := range map[string]PinMode{"keep": PinKeep, "Refuse": PinRefuse} {
+		if got, err := ParsePinMode(s); err != nil || got != exp {
+			t.Errorf("%s: expected %s, got %s (%v)", s, exp, got, err)
+		}
+	}
+	if _, err := ParsePinMode("ignore"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,493 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/reMarkable/orbit/pkg/auth"
+	"github.com/reMarkable/orbit/pkg/openpgp"
+	"github.com/reMarkable/orbit/pkg/router"
+	"github.com/reMarkable/orbit/pkg/semver"
+)
+
+var errNoProviders = &httpErr{
+	code: http.StatusNotImplemented,
+	msg:  "repository can't serve providers",
+}
+
+var errFileTooLarge = errors.New("file too large")
+
+// defaultProtocols are the plugin protocols of providers released without a
+// manifest, which the public registry assumes as well.
+var defaultProtocols = []string{"5.0"}
+
+// ProviderRepository is implemented by the repositories that can serve
+// providers, released with the assets named like the ones of the public
+// registry:
+//
+//	terraform-provider-<type>_<version>_<os>_<arch>.zip
+//	terraform-provider-<type>_<version>_SHA256SUMS
+//	terraform-provider-<type>_<version>_SHA256SUMS.sig
+//	terraform-provider-<type>_<version>_manifest.json
+type ProviderRepository interface {
+	// ProviderAssets returns the assets of every release of the provider, as
+	// `version/asset`, with the versions as known by the repository.
+	ProviderAssets(ctx context.Context, namespace, typ string) ([]string, error)
+	ProviderAsset(ctx context.Context, namespace, typ, version, asset string, w io.Writer) error
+}
+
+// loadProviderKeys reads the ASCII armored public keys the providers of the
+// namespaces are signed with, given the paths to them.
+func loadProviderKeys(paths map[string]string) (map[string]gpgPublicKey, error) {
+	keys := make(map[string]gpgPublicKey, len(paths))
+	for namespace, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading provider key: %w", err)
+		}
+		id, err := openpgp.KeyID(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("provider key of %s: %w", namespace, err)
+		}
+		keys[namespace] = gpgPublicKey{
+			KeyID:      id,
+			ASCIIArmor: string(b),
+		}
+	}
+	return keys, nil
+}
+
+// ListProviderVersions lists the versions of the provider, and the platforms
+// and protocols of each. The manifests giving the protocols are only read when
+// a version is downloaded, so the defaults are listed until then, rather than
+// having Terraform wait for the manifest of every release.
+func (h *Handler) ListProviderVersions(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("ListProviderVersions")
+	}
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		typ       = router.GetParameter(ctx, "type")
+	)
+
+	releases, err := h.providerReleases(ctx, namespace, typ)
+	if err != nil {
+		h.log.Error("list provider versions", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	res := providerVersionsResponse{
+		Versions: make([]providerVersion, len(releases)),
+	}
+	for n, rel := range releases {
+		protocols := defaultProtocols
+		if p, ok := h.protocols.Load(providerKey(namespace, typ, rel)); ok {
+			protocols = p.([]string)
+		}
+		res.Versions[n] = providerVersion{
+			Version:   rel.version.String(),
+			Protocols: protocols,
+			Platforms: rel.platforms,
+		}
+	}
+
+	if err := encodeJSON(w, &res); err != nil {
+		h.log.Error("encode response", "err", err)
+		return
+	}
+}
+
+// ProviderDownload describes the package of a version of the provider for the
+// platform, with where to download it, its checksums and signature, along with
+// the keys to verify them with. The downloads are proxied, like the ones of the
+// modules, since they may need authentication upstream.
+func (h *Handler) ProviderDownload(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("ProviderDownload")
+	}
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		typ       = router.GetParameter(ctx, "type")
+		version   = router.GetParameter(ctx, "version")
+		goos      = router.GetParameter(ctx, "os")
+		goarch    = router.GetParameter(ctx, "arch")
+	)
+
+	key, ok := h.providerKeys[namespace]
+	if !ok {
+		h.log.Error("provider download", "err", "no signing key", "namespace", namespace)
+		respErr(w, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "no signing key for namespace",
+		})
+		return
+	}
+
+	rel, err := h.providerRelease(ctx, namespace, typ, version)
+	if err != nil {
+		h.log.Error("resolve provider version", "err", err)
+		respErr(w, err)
+		return
+	}
+	i := slices.IndexFunc(rel.platforms, func(p providerPlatform) bool {
+		return p.OS == goos && p.Arch == goarch
+	})
+	if i < 0 {
+		respErr(w, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "no such platform",
+		})
+		return
+	}
+	filename := rel.platforms[i].filename
+
+	sums, err := h.providerShasums(ctx, namespace, typ, rel)
+	if err != nil {
+		h.log.Error("provider shasums", "err", err)
+		respErr(w, err)
+		return
+	}
+	shasum, ok := sums[filename]
+	if !ok {
+		h.log.Error("provider shasums", "err", "no checksum", "filename", filename)
+		respErr(w, fmt.Errorf("no checksum of %s", filename))
+		return
+	}
+	protocols := h.providerProtocols(ctx, namespace, typ, rel)
+
+	// The URLs are relative to this one, which Terraform resolves them
+	// against, and lead to ProviderAssetProxy.
+	var query string
+	if token := auth.GetToken(ctx, ""); token != "" {
+		encoded, err := h.encodeToken(token)
+		if err != nil {
+			h.log.Error("encoding token", "err", err)
+			respErr(w, err)
+			return
+		}
+		query = "?token=" + encoded
+	}
+	assetURL := func(asset string) string {
+		return "../../asset/" + asset + query
+	}
+
+	res := providerDownloadResponse{
+		Protocols:           protocols,
+		OS:                  goos,
+		Arch:                goarch,
+		Filename:            filename,
+		DownloadURL:         assetURL(filename),
+		ShasumsURL:          assetURL(rel.shasums),
+		ShasumsSignatureURL: assetURL(rel.signature),
+		Shasum:              shasum,
+		SigningKeys: signingKeys{
+			GPGPublicKeys: []gpgPublicKey{key},
+		},
+	}
+	if err := encodeJSON(w, &res); err != nil {
+		h.log.Error("encode response", "err", err)
+		return
+	}
+}
+
+// ProviderAssetProxy downloads the package, checksums or signature of a
+// version of the provider.
+func (h *Handler) ProviderAssetProxy(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("ProviderAssetProxy")
+	}
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		typ       = router.GetParameter(ctx, "type")
+		version   = router.GetParameter(ctx, "version")
+		filename  = router.GetParameter(ctx, "filename")
+	)
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		token, err := h.decodeToken(token)
+		if err != nil {
+			h.log.Error("decoding token", "err", err)
+			respErr(w, err)
+			return
+		}
+		ctx = auth.WithToken(ctx, token)
+	}
+
+	rel, err := h.providerRelease(ctx, namespace, typ, version)
+	if err != nil {
+		h.log.Error("resolve provider version", "err", err)
+		respErr(w, err)
+		return
+	}
+	// Only what the registry protocol refers to is served.
+	if filename != rel.shasums && filename != rel.signature && !slices.ContainsFunc(rel.platforms, func(p providerPlatform) bool {
+		return p.filename == filename
+	}) {
+		respErr(w, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "no such asset",
+		})
+		return
+	}
+
+	pr := h.repo.(ProviderRepository)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := pr.ProviderAsset(ctx, namespace, typ, rel.raw, filename, w); err != nil {
+		h.log.Error("proxy provider asset", "err", err)
+		respErr(w, err)
+		return
+	}
+}
+
+// providerRelease is a release of a provider, with the assets the registry
+// protocol needs.
+type providerRelease struct {
+	version   semver.Version
+	raw       string
+	platforms []providerPlatform
+	shasums   string
+	signature string
+	manifest  string
+}
+
+// providerReleases returns the releases of the provider, in order, leaving out
+// the ones without any packages, or without signed checksums of them, which
+// Terraform won't install.
+func (h *Handler) providerReleases(ctx context.Context, namespace, typ string) ([]providerRelease, error) {
+	pr, ok := h.repo.(ProviderRepository)
+	if !ok {
+		return nil, errNoProviders
+	}
+	assets, err := pr.ProviderAssets(ctx, namespace, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		prefix = "terraform-provider-" + typ + "_"
+		byTag  = map[string]*providerRelease{}
+	)
+	for _, a := range assets {
+		tag, name, _ := strings.Cut(a, "/")
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		rel, ok := byTag[tag]
+		if !ok {
+			v, err := semver.Parse(tag)
+			if err != nil || (v.IsPrerelease() && !h.cfg.Prereleases) {
+				continue
+			}
+			rel = &providerRelease{version: v, raw: tag}
+			byTag[tag] = rel
+		}
+
+		// The versions can't have underscores, so what follows the version
+		// in the name can be told apart.
+		parts := strings.Split(rest, "_")
+		switch {
+		case len(parts) == 2 && parts[1] == "SHA256SUMS":
+			rel.shasums = name
+		case len(parts) == 2 && parts[1] == "SHA256SUMS.sig":
+			rel.signature = name
+		case len(parts) == 2 && parts[1] == "manifest.json":
+			rel.manifest = name
+		case len(parts) == 3 && strings.HasSuffix(parts[2], ".zip"):
+			rel.platforms = append(rel.platforms, providerPlatform{
+				OS:       parts[1],
+				Arch:     strings.TrimSuffix(parts[2], ".zip"),
+				filename: name,
+			})
+		}
+	}
+
+	releases := make([]providerRelease, 0, len(byTag))
+	for _, rel := range byTag {
+		if len(rel.platforms) == 0 || rel.shasums == "" || rel.signature == "" {
+			continue
+		}
+		releases = append(releases, *rel)
+	}
+	slices.SortFunc(releases, func(a, b providerRelease) int {
+		if c := semver.Compare(a.version, b.version); c != 0 {
+			return c
+		}
+		return strings.Compare(a.raw, b.raw)
+	})
+	// The same version could be tagged both with and without the prefix, in
+	// which case we'll go with the first one.
+	return slices.CompactFunc(releases, func(a, b providerRelease) bool {
+		return a.version.String() == b.version.String()
+	}), nil
+}
+
+// providerRelease returns the release of the version of the provider.
+func (h *Handler) providerRelease(ctx context.Context, namespace, typ, version string) (providerRelease, error) {
+	requested, err := parseVersion(version)
+	if err != nil {
+		return providerRelease{}, err
+	}
+
+	releases, err := h.providerReleases(ctx, namespace, typ)
+	if err != nil {
+		return providerRelease{}, err
+	}
+	for _, rel := range releases {
+		if rel.version.String() == requested.String() {
+			return rel, nil
+		}
+	}
+	return providerRelease{}, &httpErr{
+		code: http.StatusNotFound,
+		msg:  "no such version",
+	}
+}
+
+// providerProtocols returns the plugin protocols of the release, as given by
+// its manifest, which is only read once. Releases with a manifest that can't be
+// read get the defaults, like the ones without.
+func (h *Handler) providerProtocols(ctx context.Context, namespace, typ string, rel providerRelease) []string {
+	key := providerKey(namespace, typ, rel)
+	if p, ok := h.protocols.Load(key); ok {
+		return p.([]string)
+	}
+
+	protocols, err := h.providerManifest(ctx, namespace, typ, rel)
+	if err != nil {
+		h.log.Error("provider manifest", "err", err, "namespace", namespace, "type", typ, "version", rel.raw)
+		return defaultProtocols
+	}
+	h.protocols.Store(key, protocols)
+	return protocols
+}
+
+// providerManifest returns the protocols listed by the manifest of the release.
+func (h *Handler) providerManifest(ctx context.Context, namespace, typ string, rel providerRelease) ([]string, error) {
+	if rel.manifest == "" {
+		return defaultProtocols, nil
+	}
+
+	b, err := h.providerFile(ctx, namespace, typ, rel.raw, rel.manifest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Metadata struct {
+			ProtocolVersions []string `json:"protocol_versions"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", rel.manifest, err)
+	}
+	if len(manifest.Metadata.ProtocolVersions) == 0 {
+		return defaultProtocols, nil
+	}
+	return manifest.Metadata.ProtocolVersions, nil
+}
+
+// providerKey is what the protocols of the release are kept by.
+func providerKey(namespace, typ string, rel providerRelease) string {
+	return namespace + "/" + typ + "/" + rel.raw
+}
+
+// providerShasums returns the SHA-256 checksums of the release, by filename.
+func (h *Handler) providerShasums(ctx context.Context, namespace, typ string, rel providerRelease) (map[string]string, error) {
+	b, err := h.providerFile(ctx, namespace, typ, rel.raw, rel.shasums)
+	if err != nil {
+		return nil, err
+	}
+
+	// The checksums are listed as by sha256sum, i.e. `<checksum>  <filename>`.
+	sums := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if sum, filename, ok := strings.Cut(s.Text(), "  "); ok {
+			sums[filename] = sum
+		}
+	}
+	return sums, s.Err()
+}
+
+// providerFile returns the content of the asset, which is expected to be one
+// of the small ones.
+func (h *Handler) providerFile(ctx context.Context, namespace, typ, version, asset string) ([]byte, error) {
+	buf := limitedBuffer{limit: maxDocSize}
+	err := h.repo.(ProviderRepository).ProviderAsset(ctx, namespace, typ, version, asset, &buf)
+	if errors.Is(err, errFileTooLarge) {
+		return nil, fmt.Errorf("%s is too large", asset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.buf.Bytes(), nil
+}
+
+// limitedBuffer fails with errFileTooLarge once more than its limit has been
+// written to it, rather than holding all of it. The buffer isn't embedded, as
+// its ReadFrom would have io.Copy bypass the limit.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.limit {
+		return 0, errFileTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+type providerVersionsResponse struct {
+	Versions []providerVersion `json:"versions"`
+}
+
+type providerVersion struct {
+	Version   string             `json:"version"`
+	Protocols []string           `json:"protocols"`
+	Platforms []providerPlatform `json:"platforms"`
+}
+
+type providerPlatform struct {
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	filename string
+}
+
+type providerDownloadResponse struct {
+	Protocols           []string    `json:"protocols"`
+	OS                  string      `json:"os"`
+	Arch                string      `json:"arch"`
+	Filename            string      `json:"filename"`
+	DownloadURL         string      `json:"download_url"`
+	ShasumsURL          string      `json:"shasums_url"`
+	ShasumsSignatureURL string      `json:"shasums_signature_url"`
+	Shasum              string      `json:"shasum"`
+	SigningKeys         signingKeys `json:"signing_keys"`
+}
+
+type signingKeys struct {
+	GPGPublicKeys []gpgPublicKey `json:"gpg_public_keys"`
+}
+
+type gpgPublicKey struct {
+	KeyID      string `json:"key_id"`
+	ASCIIArmor string `json:"ascii_armor"`
+}
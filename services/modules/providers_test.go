@@ -0,0 +1,266 @@
+package modules
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type mockProviderRepository struct {
+	mockRepository
+	// releases are the assets of the releases, by tag and name.
+	releases map[string]map[string]string
+}
+
+func (m *mockProviderRepository) ProviderAssets(ctx context.Context, namespace, typ string) ([]string, error) {
+	var assets []string
+	for tag, files := range m.releases {
+		for name := range files {
+			assets = append(assets, tag+"/"+name)
+		}
+	}
+	slices.Sort(assets)
+	return assets, m.err
+}
+
+func (m *mockProviderRepository) ProviderAsset(ctx context.Context, namespace, typ, version, asset string, w io.Writer) error {
+	content, ok := m.releases[version][asset]
+	if !ok {
+		return &httpErr{code: http.StatusNotFound, msg: "no such asset"}
+	}
+	_, err := io.Copy(w, strings.NewReader(content))
+	return err
+}
+
+func mockProviderReleases() map[string]map[string]string {
+	return map[string]map[string]string{
+		"v1.0.0": {
+			"terraform-provider-thing_1.0.0_linux_amd64.zip":  "linux",
+			"terraform-provider-thing_1.0.0_darwin_arm64.zip": "darwin",
+			"terraform-provider-thing_1.0.0_SHA256SUMS": "aaa  terraform-provider-thing_1.0.0_darwin_arm64.zip\n" +
+				"bbb  terraform-provider-thing_1.0.0_linux_amd64.zip\n",
+			"terraform-provider-thing_1.0.0_SHA256SUMS.sig": "signature",
+		},
+		"v1.1.0": {
+			"terraform-provider-thing_1.1.0_linux_amd64.zip":    "linux",
+			"terraform-provider-thing_1.1.0_SHA256SUMS":         "ccc  terraform-provider-thing_1.1.0_linux_amd64.zip\n",
+			"terraform-provider-thing_1.1.0_SHA256SUMS.sig":     "signature",
+			"terraform-provider-thing_1.1.0_manifest.json":      `{"version":1,"metadata":{"protocol_versions":["6.0"]}}`,
+			"terraform-provider-thing_1.1.0_linux_amd64.tar.gz": "ignored",
+		},
+		// Unsigned, so Terraform wouldn't install it anyway.
+		"v1.2.0": {
+			"terraform-provider-thing_1.2.0_linux_amd64.zip": "linux",
+			"terraform-provider-thing_1.2.0_SHA256SUMS":      "ddd  terraform-provider-thing_1.2.0_linux_amd64.zip\n",
+		},
+		"v2.0.0-rc.1": {
+			"terraform-provider-thing_2.0.0-rc.1_linux_amd64.zip": "linux",
+			"terraform-provider-thing_2.0.0-rc.1_SHA256SUMS":      "eee  terraform-provider-thing_2.0.0-rc.1_linux_amd64.zip\n",
+			"terraform-provider-thing_2.0.0-rc.1_SHA256SUMS.sig":  "signature",
+			"terraform-provider-other_2.0.0-rc.1_linux_amd64.zip": "other",
+		},
+	}
+}
+
+func TestProviders(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		url       string
+		handler   func(h *Handler) http.HandlerFunc
+		repo      Repository
+		expStatus int
+		expBody   string
+	}{
+		{
+			name:      "versions",
+			path:      "/v1/providers/:namespace/:type/versions",
+			url:       "/v1/providers/infra/thing/versions",
+			handler:   func(h *Handler) http.HandlerFunc { return h.ListProviderVersions },
+			expStatus: http.StatusOK,
+			// The manifests are only read by the downloads.
+			expBody: `{"versions":[` +
+				`{"version":"1.0.0","protocols":["5.0"],"platforms":[{"os":"darwin","arch":"arm64"},{"os":"linux","arch":"amd64"}]},` +
+				`{"version":"1.1.0","protocols":["5.0"],"platforms":[{"os":"linux","arch":"amd64"}]}]}`,
+		},
+		{
+			name:      "versions_unsupported",
+			path:      "/v1/providers/:namespace/:type/versions",
+			url:       "/v1/providers/infra/thing/versions",
+			handler:   func(h *Handler) http.HandlerFunc { return h.ListProviderVersions },
+			repo:      &mockRepository{},
+			expStatus: http.StatusNotImplemented,
+			expBody:   `Not Implemented`,
+		},
+		{
+			name:      "download",
+			path:      "/v1/providers/:namespace/:type/:version/download/:os/:arch",
+			url:       "/v1/providers/infra/thing/1.0.0/download/linux/amd64",
+			handler:   func(h *Handler) http.HandlerFunc { return h.ProviderDownload },
+			expStatus: http.StatusOK,
+			expBody: `{"protocols":["5.0"],"os":"linux","arch":"amd64","filename":"terraform-provider-thing_1.0.0_linux_amd64.zip",` +
+				`"download_url":"../../asset/terraform-provider-thing_1.0.0_linux_amd64.zip",` +
+				`"shasums_url":"../../asset/terraform-provider-thing_1.0.0_SHA256SUMS",` +
+				`"shasums_signature_url":"../../asset/terraform-provider-thing_1.0.0_SHA256SUMS.sig",` +
+				`"shasum":"bbb","signing_keys":{"gpg_public_keys":[{"key_id":"ABCD","ascii_armor":"armored"}]}}`,
+		},
+		{
+			name:      "download_unknown_platform",
+			path:      "/v1/providers/:namespace/:type/:version/download/:os/:arch",
+			url:       "/v1/providers/infra/thing/1.1.0/download/darwin/arm64",
+			handler:   func(h *Handler) http.HandlerFunc { return h.ProviderDownload },
+			expStatus: http.StatusNotFound,
+			expBody:   `Not Found`,
+		},
+		{
+			name:      "download_unsigned",
+			path:      "/v1/providers/:namespace/:type/:version/download/:os/:arch",
+			url:       "/v1/providers/infra/thing/1.2.0/download/linux/amd64",
+			handler:   func(h *Handler) http.HandlerFunc { return h.ProviderDownload },
+			expStatus: http.StatusNotFound,
+			expBody:   `Not Found`,
+		},
+		{
+			name:      "download_no_key",
+			path:      "/v1/providers/:namespace/:type/:version/download/:os/:arch",
+			url:       "/v1/providers/apps/thing/1.0.0/download/linux/amd64",
+			handler:   func(h *Handler) http.HandlerFunc { return h.ProviderDownload },
+			expStatus: http.StatusNotFound,
+			expBody:   `Not Found`,
+		},
+		{
+			name:      "asset",
+			path:      "/v1/providers/:namespace/:type/:version/asset/:filename",
+			url:       "/v1/providers/infra/thing/1.0.0/asset/terraform-provider-thing_1.0.0_darwin_arm64.zip",
+			handler:   func(h *Handler) http.HandlerFunc { return h.ProviderAssetProxy },
+			expStatus: http.StatusOK,
+			expBody:   `darwin`,
+		},
+		{
+			name:      "asset_unlisted",
+			path:      "/v1/providers/:namespace/:type/:version/asset/:filename",
+			url:       "/v1/providers/infra/thing/1.1.0/asset/terraform-provider-thing_1.1.0_linux_amd64.tar.gz",
+			handler:   func(h *Handler) http.HandlerFunc { return h.ProviderAssetProxy },
+			expStatus: http.StatusNotFound,
+			expBody:   `Not Found`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tt.repo
+			if repo == nil {
+				repo = &mockProviderRepository{releases: mockProviderReleases()}
+			}
+			handler := &Handler{
+				log: slog.Default(),
+				providerKeys: map[string]gpgPublicKey{
+					"infra": {KeyID: "ABCD", ASCIIArmor: "armored"},
+				},
+				repo: repo,
+			}
+
+			rr := httptest.NewRecorder()
+			route(tt.path, tt.handler(handler)).ServeHTTP(rr, mockRequest(t, tt.url))
+
+			if rr.Code != tt.expStatus {
+				t.Errorf("unexpected status code, exp: %d, got: %d", tt.expStatus, rr.Code)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expBody {
+				t.Errorf("unexpected response body, exp: %s, got: %s", tt.expBody, body)
+			}
+		})
+	}
+}
+
+func TestProviders_Protocols(t *testing.T) {
+	releases := mockProviderReleases()
+	releases["v1.0.0"]["terraform-provider-thing_1.0.0_manifest.json"] = `{"version":1,`
+	handler := &Handler{
+		log: slog.Default(),
+		providerKeys: map[string]gpgPublicKey{
+			"infra": {KeyID: "ABCD", ASCIIArmor: "armored"},
+		},
+		repo: &mockProviderRepository{releases: releases},
+	}
+	get := func(path, url string, h http.HandlerFunc) string {
+		rr := httptest.NewRecorder()
+		route(path, h).ServeHTTP(rr, mockRequest(t, url))
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status code %d", url, rr.Code)
+		}
+		return rr.Body.String()
+	}
+	download := func(version string) string {
+		return get("/v1/providers/:namespace/:type/:version/download/:os/:arch",
+			"/v1/providers/infra/thing/"+version+"/download/linux/amd64", handler.ProviderDownload)
+	}
+
+	// A malformed manifest leaves the defaults, rather than failing.
+	if body := download("1.0.0"); !strings.Contains(body, `"protocols":["5.0"]`) {
+		t.Errorf("expected the default protocols, got %s", body)
+	}
+	if body := download("1.1.0"); !strings.Contains(body, `"protocols":["6.0"]`) {
+		t.Errorf("expected the protocols of the manifest, got %s", body)
+	}
+
+	// Once read, the protocols are listed along with the versions.
+	body := get("/v1/providers/:namespace/:type/versions", "/v1/providers/infra/thing/versions", handler.ListProviderVersions)
+	if !strings.Contains(body, `{"version":"1.1.0","protocols":["6.0"]`) {
+		t.Errorf("expected the protocols of the manifest listed, got %s", body)
+	}
+}
+
+func TestProviderFile_TooLarge(t *testing.T) {
+	releases := mockProviderReleases()
+	releases["v1.0.0"]["terraform-provider-thing_1.0.0_SHA256SUMS"] = strings.Repeat("a", maxDocSize+1)
+	handler := &Handler{
+		log:  slog.Default(),
+		repo: &mockProviderRepository{releases: releases},
+	}
+
+	_, err := handler.providerFile(context.Background(), "infra", "thing", "v1.0.0", "terraform-provider-thing_1.0.0_SHA256SUMS")
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected the file to be too large, got %v", err)
+	}
+	if _, err := handler.providerFile(context.Background(), "infra", "thing", "v1.0.0", "terraform-provider-thing_1.0.0_SHA256SUMS.sig"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadProviderKeys(t *testing.T) {
+	// Exported by `gpg --armor --export`.
+	const armored = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEatLKLhYJKwYBBAHaRw8BAQdA58uethPRcpL+pMKek8ui2GtjGMhFNS00EirH
+mui9kc20HU9yYml0IFRlc3QgPHRlc3RAZXhhbXBsZS5jb20+iJAEExYIADgWIQS5
+fZPuUOWyUCXWy+xAg4gl/rw7tQUCatLKLgIbAwULCQgHAgYVCgkICwIEFgIDAQIe
+AQIXgAAKCRBAg4gl/rw7tQAHAQCEP1YAUdIi3BwPwGU1y9813fQyrPnzWQ33MeV+
+bLA6rwEAr4AxsuxEWoeeYpE/tNXGQnHwUQPt8ulb2gqK+AVVRws=
+=hOYh
+-----END PGP PUBLIC KEY BLOCK-----
+`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "infra.asc")
+	if err := os.WriteFile(path, []byte(armored), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadProviderKeys(map[string]string{"infra": path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key := keys["infra"]; key.KeyID != "40838825FEBC3BB5" || key.ASCIIArmor != armored {
+		t.Errorf("unexpected key %+v", key)
+	}
+
+	if _, err := loadProviderKeys(map[string]string{"infra": filepath.Join(dir, "missing.asc")}); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+
+	"github.com/reMarkable/orbit/pkg/markdown"
+	"github.com/reMarkable/orbit/pkg/router"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// pages are the templates of the UI, each parsed along with the layout, since
+// they all define the same blocks.
+var pages = map[string]*template.Template{}
+
+func init() {
+	for _, page := range []string{"index", "namespace", "module"} {
+		pages[page] = template.Must(template.ParseFS(templateFS, "templates/layout.html", "templates/"+page+".html"))
+	}
+}
+
+// UIIndex lists the namespaces, and how many modules there are in each.
+func (h *Handler) UIIndex(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("UIIndex")
+	}
+	modules, err := h.listModules(r.Context())
+	if err != nil {
+		h.log.Error("list modules", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	type namespace struct {
+		Name    string
+		Modules int
+	}
+	var namespaces []namespace
+	for _, m := range modules {
+		// The modules are in order, so those of a namespace are adjacent.
+		if n := len(namespaces); n > 0 && namespaces[n-1].Name == m.Namespace {
+			namespaces[n-1].Modules++
+			continue
+		}
+		namespaces = append(namespaces, namespace{Name: m.Namespace, Modules: 1})
+	}
+	h.render(w, "index", namespaces)
+}
+
+// UINamespace lists the modules of the namespace, with their latest versions.
+func (h *Handler) UINamespace(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("UINamespace")
+	}
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+	)
+	modules, err := h.listModules(ctx)
+	if err != nil {
+		h.log.Error("list modules", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	h.render(w, "namespace", struct {
+		Namespace string
+		Modules   []moduleSummary
+	}{
+		Namespace: namespace,
+		Modules: slices.DeleteFunc(modules, func(m moduleSummary) bool {
+			return m.Namespace != namespace
+		}),
+	})
+}
+
+// UIModule shows a version of a module, or the latest one, with its inputs,
+// outputs and README, and how to use it.
+func (h *Handler) UIModule(w http.ResponseWriter, r *http.Request) {
+	if h.mh != nil {
+		h.mh.IncrementRequestCount("UIModule")
+	}
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		name      = router.GetParameter(ctx, "name")
+		system    = router.GetParameter(ctx, "system")
+		version   = router.GetParameter(ctx, "version")
+	)
+	detail, err := h.describe(ctx, system, namespace, name, version)
+	if err != nil {
+		h.log.Error("module detail", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	// The registry is wherever the UI is served from.
+	usage := fmt.Sprintf("module %q {\n  source  = \"%s/%s/%s/%s\"\n  version = %q\n}",
+		name, r.Host, namespace, name, system, detail.Version)
+	h.render(w, "module", struct {
+		*moduleDetail
+		Usage  string
+		Readme template.HTML
+	}{
+		moduleDetail: detail,
+		Usage:        usage,
+		// The README is escaped by the renderer.
+		Readme: template.HTML(markdown.Render(detail.Root.Readme)),
+	})
+}
+
+// render writes the page, which is rendered up front, so that any error can
+// still be responded with.
+func (h *Handler) render(w http.ResponseWriter, page string, data any) {
+	var buf bytes.Buffer
+	if err := pages[page].ExecuteTemplate(&buf, "layout", data); err != nil {
+		h.log.Error("render page", "page", page, "err", err)
+		respErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		h.log.Error("write page", "page", page, "err", err)
+	}
+}
@@ -0,0 +1,104 @@
+package modules
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUI(t *testing.T) {
+	repo := &mockModuleLister{
+		mockRepository: mockRepository{
+			versions: []string{"v1.0.0", "v1.1.0"},
+			archive: mockArchive(t, map[string]string{
+				"README.md": "# VPC\n\nCreates a **VPC**. <script>alert(1)</script>\n",
+				"main.tf":   "variable \"cidr\" {\n  description = \"The CIDR <block>.\"\n}\noutput \"id\" {\n  value = 1\n}\n",
+			}),
+		},
+		modules: []string{
+			"infra/vpc/aws/v1.0.0",
+			"infra/vpc/aws/v1.1.0",
+			"infra/dns/aws/v0.1.0",
+			"apps/web/aws/v2.0.0",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		url      string
+		handler  func(h *Handler) http.HandlerFunc
+		contains []string
+	}{
+		{
+			name:    "index",
+			path:    "/ui",
+			url:     "/ui",
+			handler: func(h *Handler) http.HandlerFunc { return h.UIIndex },
+			contains: []string{
+				`<a href="/ui/apps">apps</a></td><td>1</td>`,
+				`<a href="/ui/infra">infra</a></td><td>2</td>`,
+			},
+		},
+		{
+			name:    "namespace",
+			path:    "/ui/:namespace",
+			url:     "/ui/infra",
+			handler: func(h *Handler) http.HandlerFunc { return h.UINamespace },
+			contains: []string{
+				`<a href="/ui/infra/dns/aws">dns</a>`,
+				`<a href="/ui/infra/vpc/aws">vpc</a>`,
+			},
+		},
+		{
+			name:    "module",
+			path:    "/ui/:namespace/:name/:system/:version",
+			url:     "/ui/infra/vpc/aws/1.0.0",
+			handler: func(h *Handler) http.HandlerFunc { return h.UIModule },
+			contains: []string{
+				"module &#34;vpc&#34; {\n  source  = &#34;registry.example.com/infra/vpc/aws&#34;\n  version = &#34;1.0.0&#34;\n}",
+				`<a href="/ui/infra/vpc/aws/1.0.0" class="current">1.0.0</a>`,
+				`<td><code>cidr</code></td>`,
+				`<td>The CIDR &lt;block&gt;.</td>`,
+				`<td><code>id</code></td>`,
+				`<h1>VPC</h1>`,
+				`<strong>VPC</strong>. &lt;script&gt;`,
+			},
+		},
+		{
+			name:     "latest",
+			path:     "/ui/:namespace/:name/:system",
+			url:      "/ui/infra/vpc/aws",
+			handler:  func(h *Handler) http.HandlerFunc { return h.UIModule },
+			contains: []string{`version = &#34;1.1.0&#34;`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &Handler{
+				log:  slog.Default(),
+				repo: repo,
+			}
+
+			req := mockRequest(t, tt.url)
+			req.Host = "registry.example.com"
+			rr := httptest.NewRecorder()
+			route(tt.path, tt.handler(handler)).ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("unexpected status code, exp: %d, got: %d", http.StatusOK, rr.Code)
+			}
+			if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+				t.Errorf("unexpected content type %s", ct)
+			}
+			body := rr.Body.String()
+			for _, s := range tt.contains {
+				if !strings.Contains(body, s) {
+					t.Errorf("expected the page to contain %q, got:\n%s", s, body)
+				}
+			}
+		})
+	}
+}
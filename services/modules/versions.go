@@ -0,0 +1,101 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/reMarkable/orbit/pkg/semver"
+)
+
+// moduleVersion is a semantic version of a module, along with the version as
+// known by the repository, typically with a `v` prefix.
+type moduleVersion struct {
+	version     semver.Version
+	raw         string
+	deprecation *Deprecation
+}
+
+// listVersions returns the versions of the module, in order. The registry
+// protocol only allows for semantic versions, so anything else, like a
+// `latest` tag, is dropped, as are pre-releases unless configured otherwise,
+// and withdrawn versions.
+func (h *Handler) listVersions(ctx context.Context, system, namespace, name string) ([]moduleVersion, error) {
+	raw, err := h.repo.ListVersions(ctx, system, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return h.parseVersions(system, namespace, name, raw), nil
+}
+
+// parseVersions is what's behind listVersions, for versions we already have.
+func (h *Handler) parseVersions(system, namespace, name string, raw []string) []moduleVersion {
+	versions := make([]moduleVersion, 0, len(raw))
+	for _, r := range raw {
+		v, err := semver.Parse(r)
+		if err != nil || (v.IsPrerelease() && !h.cfg.Prereleases) {
+			continue
+		}
+
+		mv := moduleVersion{version: v, raw: r}
+		if dep, ok := h.deprecations.lookup(namespace, name, system, v); ok {
+			if dep.Withdrawn {
+				continue
+			}
+			mv.deprecation = &dep
+		}
+		versions = append(versions, mv)
+	}
+
+	slices.SortStableFunc(versions, func(a, b moduleVersion) int {
+		return semver.Compare(a.version, b.version)
+	})
+	// The same version could be tagged both with and without the prefix, in
+	// which case we'll go with the first one.
+	return slices.CompactFunc(versions, func(a, b moduleVersion) bool {
+		return a.version.String() == b.version.String()
+	})
+}
+
+// resolveVersion maps a version requested by a client back to the version as
+// known by the repository.
+func (h *Handler) resolveVersion(ctx context.Context, system, namespace, name, version string) (string, error) {
+	requested, err := parseVersion(version)
+	if err != nil {
+		return "", err
+	}
+
+	versions, err := h.listVersions(ctx, system, namespace, name)
+	if err != nil {
+		return "", err
+	}
+	v, err := findVersion(versions, requested)
+	return v.raw, err
+}
+
+func parseVersion(version string) (semver.Version, error) {
+	v, err := semver.Parse(version)
+	if err != nil {
+		return v, &httpErr{
+			code: http.StatusBadRequest,
+			msg:  err.Error(),
+		}
+	}
+	return v, nil
+}
+
+func findVersion(versions []moduleVersion, requested semver.Version) (moduleVersion, error) {
+	for _, v := range versions {
+		if v.version.String() == requested.String() {
+			return v, nil
+		}
+	}
+	return moduleVersion{}, &httpErr{
+		code: http.StatusNotFound,
+		msg:  "no such version",
+	}
+}